@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events recorded in the audit log
+const (
+	auditLogin           = "login"
+	auditLoginFailed     = "login_failed"
+	auditLoginLocked     = "login_locked"
+	auditLogout          = "logout"
+	auditTokenUsed       = "token_used"
+	auditTokenInvalid    = "token_invalid"
+	auditTokenCreated    = "token_created"
+	auditTokenRevoked    = "token_revoked"
+	auditUserAdded       = "user_added"
+	auditUserRemoved     = "user_removed"
+	auditRoleChanged     = "role_changed"
+	auditPasswordChanged = "password_changed"
+	auditHouseholdMoved  = "household_moved"
+	auditHouseholdAdded  = "household_added"
+	auditSessionsPurged  = "sessions_purged"
+	auditBudgetChanged   = "budget_changed"
+	auditPromptChanged   = "prompt_changed"
+	auditRetagApplied    = "retag_applied"
+	auditTagsChanged     = "tags_changed"
+	auditUserLinked      = "user_linked"
+)
+
+var auditEvents = []string{
+	auditLogin, auditLoginFailed, auditLoginLocked, auditLogout,
+	auditTokenUsed, auditTokenInvalid, auditTokenCreated, auditTokenRevoked,
+	auditUserAdded, auditUserRemoved, auditRoleChanged, auditPasswordChanged,
+	auditHouseholdMoved, auditHouseholdAdded, auditSessionsPurged, auditBudgetChanged,
+	auditPromptChanged, auditRetagApplied, auditTagsChanged, auditUserLinked,
+}
+
+// auditRetention is how long entries are kept, older ones are deleted when
+// the server starts
+const auditRetention = 180 * 24 * time.Hour
+
+// auditCLI is recorded as the IP for changes made with the user and
+// household commands
+const auditCLI = "cli"
+
+type AuditEntry struct {
+	ID        int
+	CreatedAt time.Time
+	Event     string
+	// Username is who the entry is about, for failed logins it's whatever
+	// was typed in. It's empty for changes that aren't to a user.
+	Username string
+	// Actor is the logged in user who made the change, it's empty for the
+	// command line and for logins
+	Actor  string
+	IP     string
+	Detail string
+}
+
+func insertAuditEntry(db *sql.DB, entry *AuditEntry) error {
+	if _, err := db.Exec("INSERT INTO audit_log(created_at, event, username, actor, ip, detail) values(?,?,?,?,?,?)",
+		entry.CreatedAt.UTC().Format(time.RFC3339), entry.Event, entry.Username, entry.Actor, entry.IP, entry.Detail); err != nil {
+		return fmt.Errorf("unable to write audit log: %w", err)
+	}
+	return nil
+}
+
+// audit records an event about username for a request, whoever is logged in
+// is the actor. A broken audit log shouldn't lock everyone out so errors are
+// only printed.
+func audit(db *sql.DB, r *http.Request, event, username, detail string) {
+	entry := &AuditEntry{CreatedAt: time.Now(), Event: event, Username: username, Actor: requestUsername(r), IP: clientIP(r), Detail: detail}
+	if err := insertAuditEntry(db, entry); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// auditCommand records an event for a change made from the command line
+func auditCommand(db *sql.DB, event, username, detail string) {
+	entry := &AuditEntry{CreatedAt: time.Now(), Event: event, Username: username, IP: auditCLI, Detail: detail}
+	if err := insertAuditEntry(db, entry); err != nil {
+		fmt.Println(err)
+	}
+}
+
+type AuditFilter struct {
+	Event    string
+	Username string
+	// Before only returns entries older than this ID, for paging
+	Before int
+	Limit  int
+}
+
+// getAuditEntries returns the newest entries matching the filter first
+func getAuditEntries(db *sql.DB, filter AuditFilter) ([]*AuditEntry, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if filter.Event != "" {
+		where = append(where, "event = ?")
+		args = append(args, filter.Event)
+	}
+	if filter.Username != "" {
+		where = append(where, "(username = ? OR actor = ?)")
+		args = append(args, filter.Username, filter.Username)
+	}
+	if filter.Before > 0 {
+		where = append(where, "id < ?")
+		args = append(args, filter.Before)
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	args = append(args, filter.Limit)
+
+	rows, err := db.Query(`
+SELECT id, created_at, event, username, actor, ip, detail FROM audit_log
+WHERE `+strings.Join(where, " AND ")+`
+ORDER BY id DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry := &AuditEntry{}
+		var createdAt string
+		if err := rows.Scan(&entry.ID, &createdAt, &entry.Event, &entry.Username, &entry.Actor, &entry.IP, &entry.Detail); err != nil {
+			return nil, fmt.Errorf("unable to scan audit entry: %w", err)
+		}
+		entry.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// deleteOldAuditEntries keeps the log from growing forever, api tokens used
+// by scripts add an entry per request
+func deleteOldAuditEntries(db *sql.DB, now time.Time) error {
+	if _, err := db.Exec("DELETE FROM audit_log WHERE created_at < ?", now.UTC().Add(-auditRetention).Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("unable to delete old audit entries: %w", err)
+	}
+	return nil
+}
+
+type auditPage struct {
+	Entries []*AuditEntry
+	Events  []string
+	Filter  AuditFilter
+	// Older is the ID to page back from, zero on the last page
+	Older int
+}
+
+func auditLog(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		query := r.URL.Query()
+		filter := AuditFilter{Event: query.Get("event"), Username: query.Get("username"), Limit: 100}
+		if before := query.Get("before"); before != "" {
+			var err error
+			if filter.Before, err = strconv.Atoi(before); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: before must be an integer")
+				return
+			}
+		}
+
+		entries, err := getAuditEntries(db, filter)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		page := auditPage{Entries: entries, Events: auditEvents, Filter: filter}
+		if len(entries) == filter.Limit {
+			page.Older = entries[len(entries)-1].ID
+		}
+		if err := renderTemplate(w, r, "audit.html", page); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error rendering audit log: %v", err)
+			return
+		}
+	}
+}
@@ -1,30 +1,118 @@
 package main
 
 import (
-	"crypto/sha256"
-	"crypto/subtle"
+	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
-	"os"
+	"net/url"
+	"strings"
+	"time"
 )
 
-func basicAuth(next http.HandlerFunc) http.HandlerFunc {
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	tokenContextKey
+	csrfContextKey
+)
+
+// requireAuth lets a request through with a session cookie from /login, an
+// api token or basic auth credentials, which are kept for scripted clients.
+// Browsers without any of them are sent to the login page.
+func requireAuth(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
-		if ok {
-			expectedUsernameHash, expectedPasswordHash := retrieveUser(username)
-			usernameHash := sha256.Sum256([]byte(username))
-			passwordHash := sha256.Sum256([]byte(password))
+		ip := clientIP(r)
+		now := time.Now()
 
-			usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
-			passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
+		if token, ok := bearerToken(r); ok {
+			// tokens are too long to guess but a client hammering away
+			// with bad ones is still throttled by its IP
+			if wait, err := loginLockedFor(db, ip, "", now); err != nil {
+				fmt.Println(err)
+			} else if wait > 0 {
+				tooManyAttempts(w, wait)
+				return
+			}
 
-			if usernameMatch && passwordMatch {
-				next.ServeHTTP(w, r)
+			user, apiToken, err := getAPITokenUser(db, token, now)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: unable to check api token")
+				fmt.Println("error checking api token", err)
+				return
+			}
+			if user == nil {
+				audit(db, r, auditTokenInvalid, "", r.Method+" "+r.URL.Path)
+				if _, err := recordLoginFailure(db, ip, "", now); err != nil {
+					fmt.Println(err)
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Unauthorized: invalid, expired or revoked api token", http.StatusUnauthorized)
 				return
 			}
 
-			fmt.Println("denied access to:", username)
+			audit(db, r, auditTokenUsed, user.Username, fmt.Sprintf("%s %s with %q", r.Method, r.URL.Path, apiToken.Name))
+
+			r = withUser(r, user)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, apiToken)))
+			return
+		}
+
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			user, err := getSessionUser(db, cookie.Value, now)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: unable to check session")
+				fmt.Println("error checking session", err)
+				return
+			}
+			if user != nil {
+				next.ServeHTTP(w, withUser(r, user))
+				return
+			}
+		}
+
+		if username, password, ok := r.BasicAuth(); ok {
+			wait, err := loginLockedFor(db, ip, username, now)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: unable to check credentials")
+				fmt.Println(err)
+				return
+			}
+			if wait > 0 {
+				audit(db, r, auditLoginLocked, username, "basic auth")
+				tooManyAttempts(w, wait)
+				return
+			}
+
+			user, err := authenticateUser(db, username, password)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: unable to check credentials")
+				fmt.Println("error authenticating", username, err)
+				return
+			}
+
+			// scripts send basic auth on every request, only failures are
+			// logged so they don't drown everything else out
+			if user != nil {
+				if err := clearLoginFailures(db, user.Username); err != nil {
+					fmt.Println(err)
+				}
+				next.ServeHTTP(w, withUser(r, user))
+				return
+			}
+
+			audit(db, r, auditLoginFailed, username, "basic auth")
+			if _, err := recordLoginFailure(db, ip, username, now); err != nil {
+				fmt.Println(err)
+			}
+		} else if wantsLoginPage(r) {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
 		}
 
 		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -32,6 +120,69 @@ func basicAuth(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-func retrieveUser(username string) ([32]byte, [32]byte) {
-	return sha256.Sum256([]byte(username)), sha256.Sum256([]byte(os.Getenv(fmt.Sprintf("USER_%s_PASSWORD", username))))
+// optionalAuth is requireAuth for pages anyone can see. Requests without
+// credentials, or with only a session that has ended, go through with no
+// user and the page decides what they're shown.
+func optionalAuth(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	authed := requireAuth(db, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok {
+			authed(w, r)
+			return
+		}
+		if _, _, ok := r.BasicAuth(); ok {
+			authed(w, r)
+			return
+		}
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			if user, err := getSessionUser(db, cookie.Value, time.Now()); err != nil {
+				fmt.Println("error checking session", err)
+			} else if user != nil {
+				next.ServeHTTP(w, withUser(r, user))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wantsLoginPage is true for a browser loading a page, anything else gets a
+// plain 401 so scripts see why they failed
+func wantsLoginPage(r *http.Request) bool {
+	if r.Method != http.MethodGet || strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/extract" {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func withUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// requestUser returns who made the request, handlers behind requireAuth can
+// rely on this being set
+func requestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// requestToken returns the api token the request was made with, or nil if
+// it came from a session or basic auth
+func requestToken(r *http.Request) *APIToken {
+	token, _ := r.Context().Value(tokenContextKey).(*APIToken)
+	return token
+}
+
+// tokenAllows reports whether the request's api token has the scope,
+// requests that didn't use a token are only limited by the user's role
+func tokenAllows(r *http.Request, scope string) bool {
+	token := requestToken(r)
+	return token == nil || token.HasScope(scope)
+}
+
+func requestUsername(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return user.Username
+	}
+	return ""
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Forms that change anything carry a token that has to match the csrf
+// cookie, another site can make a browser post a form here but can't read
+// the cookie to fill the token in. The token is an HMAC of the cookie so a
+// cookie planted from a sibling domain is no good without the key either.
+const (
+	csrfCookieName = "csrf"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+func csrfToken(secret []byte, cookie string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(cookie))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// csrfExempt is true for requests a browser can't be tricked into sending
+// from another site: api tokens are never sent automatically and a json
+// body can't be posted cross site without CORS, which isn't allowed here
+func csrfExempt(r *http.Request) bool {
+	if _, ok := bearerToken(r); ok {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// csrfProtect sits in front of every route, it hands out the cookie and
+// rejects unsafe requests that don't carry the matching token
+func csrfProtect(secret []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cookie string
+		if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != "" {
+			cookie = c.Value
+		} else {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: unable to generate csrf cookie")
+				return
+			}
+			cookie = base64.RawURLEncoding.EncodeToString(b)
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    cookie,
+				Path:     "/",
+				MaxAge:   int(sessionLifetime.Seconds()),
+				HttpOnly: true,
+				Secure:   strings.HasPrefix(requestBaseURL(r), "https://"),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		token := csrfToken(secret, cookie)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !csrfExempt(r) {
+				sent := r.Header.Get(csrfHeaderName)
+				if sent == "" {
+					sent = r.PostFormValue(csrfFieldName)
+				}
+				if !hmac.Equal([]byte(sent), []byte(token)) {
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprintf(w, "forbidden: this form has expired or didn't come from this site, go back, reload the page and try again")
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey, token)))
+	})
+}
+
+// renderTemplate executes a template with csrfField filled in with the
+// request's token, every page with a form is rendered this way
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, data interface{}) error {
+	token, _ := r.Context().Value(csrfContextKey).(string)
+	t, err := templates.Clone()
+	if err != nil {
+		return err
+	}
+	t.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(token) + `">`)
+		},
+	})
+	return t.ExecuteTemplate(w, name, data)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_csrfProtect(t *testing.T) {
+	secret := []byte("secret")
+	handler := csrfProtect(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// a first visit hands out the cookie
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/list", nil))
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("GET got %d", res.Code)
+	}
+	var cookie *http.Cookie
+	for _, c := range res.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("expected a csrf cookie to be set")
+	}
+	token := csrfToken(secret, cookie.Value)
+
+	post := func(form url.Values, contentType string, header map[string]string) int {
+		req := httptest.NewRequest(http.MethodPost, "/edit", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", contentType)
+		req.AddCookie(cookie)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+	formType := "application/x-www-form-urlencoded"
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		ctype  string
+		header map[string]string
+		want   int
+	}{
+		{"form token", url.Values{csrfFieldName: {token}}, formType, nil, http.StatusNoContent},
+		{"header token", url.Values{}, formType, map[string]string{csrfHeaderName: token}, http.StatusNoContent},
+		{"no token", url.Values{}, formType, nil, http.StatusForbidden},
+		{"wrong token", url.Values{csrfFieldName: {csrfToken([]byte("other"), cookie.Value)}}, formType, nil, http.StatusForbidden},
+		{"cookie as token", url.Values{csrfFieldName: {cookie.Value}}, formType, nil, http.StatusForbidden},
+		{"api token", url.Values{}, formType, map[string]string{"Authorization": "Bearer fa_abc"}, http.StatusNoContent},
+		{"json", url.Values{}, "application/json; charset=utf-8", nil, http.StatusNoContent},
+		{"text posing as json", url.Values{}, "text/plain", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := post(tt.form, tt.ctype, tt.header); got != tt.want {
+				t.Errorf("POST got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,21 +1,45 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 )
 
+// insertRecipeVersion stores recipe as a new version of the one it was read
+// as, it stays in the same household and keeps its shares. New recipes need
+// HouseholdID set by the caller.
 func insertRecipeVersion(db *sql.DB, recipe *Recipe) (*Recipe, error) {
-	storedIDForParent := recipe.ID
-	recipe.ID = 0
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error beginning db transaction for recipe insertion: %w", err)
+	}
+	defer tx.Rollback()
 
-	insertPrep, err := db.Prepare("INSERT INTO recipes(parent_id, version, name, reference, recipe_data) values(?,?,?,?,?)")
+	newRecipe, err := insertRecipeVersionTx(tx, recipe)
 	if err != nil {
-		return nil, fmt.Errorf("unable to prepare for recipe insertion: %w", err)
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("unable to commit recipe insertion: %w", err)
+	}
+	return newRecipe, nil
+}
+
+// insertRecipeVersionTx is insertRecipeVersion as part of a bigger
+// transaction, nothing is stored until the caller commits
+func insertRecipeVersionTx(tx *sql.Tx, recipe *Recipe) (*Recipe, error) {
+	storedIDForParent := recipe.ID
+	recipe.ID = 0
+	if recipe.HouseholdID == 0 {
+		return nil, fmt.Errorf("recipe has no household")
 	}
 
 	recipe_data, err := json.Marshal(recipe)
@@ -23,35 +47,26 @@ func insertRecipeVersion(db *sql.DB, recipe *Recipe) (*Recipe, error) {
 		return nil, fmt.Errorf("unable to marshal recipe as json for insertion: %w", err)
 	}
 
-	if _, err := insertPrep.Exec(storedIDForParent, recipe.Version+1, recipe.Name, recipe.Reference, recipe_data); err != nil {
+	res, err := tx.Exec("INSERT INTO recipes(parent_id, version, name, reference, recipe_data, household_id) values(?,?,?,?,?,?)",
+		storedIDForParent, recipe.Version+1, recipe.Name, recipe.Reference, recipe_data, recipe.HouseholdID)
+	if err != nil {
 		return nil, fmt.Errorf("unable to insert new recipe version: %w", err)
 	}
-
-	// read recipe back on parent_id
-	readbackPrep, err := db.Prepare("SELECT id, recipe_data FROM recipes WHERE parent_id = ?")
+	id, err := res.LastInsertId()
 	if err != nil {
-		return nil, fmt.Errorf("unable to prepare for readback, your new recipe can be found in /list")
+		return nil, fmt.Errorf("unable to read new recipe id, your new recipe can be found in /list")
 	}
 
-	var (
-		idN         sql.NullInt16
-		recipeDataN sql.NullString
-	)
-	if err := readbackPrep.QueryRow(storedIDForParent).Scan(&idN, &recipeDataN); err != nil {
-		return nil, fmt.Errorf("unable to scan row: %w", err)
+	if storedIDForParent != 0 {
+		if _, err := tx.Exec("INSERT INTO recipe_shares(recipe_id, household_id) SELECT ?, household_id FROM recipe_shares WHERE recipe_id = ?", id, storedIDForParent); err != nil {
+			return nil, fmt.Errorf("unable to carry shares over to the new version: %w", err)
+		}
 	}
 
-	var (
-		id              int
-		new_recipe_data string
-	)
-	if ok := idN.Valid; ok {
-		id = int(idN.Int16)
-	} else {
-		return nil, fmt.Errorf("unable to find recipe")
-	}
-	if ok := recipeDataN.Valid; ok {
-		new_recipe_data = recipeDataN.String
+	// read recipe back
+	var new_recipe_data string
+	if err := tx.QueryRow("SELECT recipe_data FROM recipes WHERE id = ?", id).Scan(&new_recipe_data); err != nil {
+		return nil, fmt.Errorf("unable to scan row: %w", err)
 	}
 
 	newRecipe := &Recipe{}
@@ -59,20 +74,25 @@ func insertRecipeVersion(db *sql.DB, recipe *Recipe) (*Recipe, error) {
 		return nil, fmt.Errorf("unable to unmarshal recipe we just wrote: %w", err)
 	}
 
-	newRecipe.ID = id
+	newRecipe.ID = int(id)
+	newRecipe.HouseholdID = recipe.HouseholdID
 
 	return newRecipe, nil
 }
 
-func getAllRecipeMeta(db *sql.DB) ([]*Recipe, error) {
-	prep, err := db.Prepare("SELECT id, parent_id, version, name, reference FROM recipes")
+// visibleRecipes limits a query on recipes to the ones a household can see,
+// its own and any shared with it. It takes the household ID twice.
+const visibleRecipes = "(household_id = ? OR id IN (SELECT recipe_id FROM recipe_shares WHERE household_id = ?))"
+
+func getAllRecipeMeta(db *sql.DB, householdID int) ([]*Recipe, error) {
+	prep, err := db.Prepare("SELECT id, parent_id, version, name, reference, household_id FROM recipes WHERE " + visibleRecipes + " ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
 
 	recipesMap := map[int]*Recipe{}
 
-	rows, err := prep.Query()
+	rows, err := prep.Query(householdID, householdID)
 	if err != nil {
 		return nil, err
 	}
@@ -85,8 +105,9 @@ func getAllRecipeMeta(db *sql.DB) ([]*Recipe, error) {
 			versionN   sql.NullInt16
 			nameN      sql.NullString
 			referenceN sql.NullString
+			household  int
 		)
-		if err := rows.Scan(&idN, &parentIDn, &versionN, &nameN, &referenceN); err != nil {
+		if err := rows.Scan(&idN, &parentIDn, &versionN, &nameN, &referenceN, &household); err != nil {
 			return nil, fmt.Errorf("unable to scan row: %w", err)
 		}
 
@@ -117,12 +138,14 @@ func getAllRecipeMeta(db *sql.DB) ([]*Recipe, error) {
 		}
 
 		recipe := &Recipe{
-			ID:        id,
-			Version:   version,
-			Name:      name,
-			Reference: reference,
+			ID:          id,
+			Version:     version,
+			Name:        name,
+			Reference:   reference,
+			HouseholdID: household,
+			Shared:      household != householdID,
 		}
-		if _, ok := recipesMap[parentID]; !ok {
+		if _, ok := recipesMap[parentID]; ok {
 			delete(recipesMap, parentID)
 		}
 		recipesMap[id] = recipe
@@ -137,16 +160,17 @@ func getAllRecipeMeta(db *sql.DB) ([]*Recipe, error) {
 }
 
 // getAllRecipes uses json unmarshalling to get every current version of every
-// recipe in the db, prefer using getAllRecipeMeta and fetch only what you need
-func getAllRecipes(db *sql.DB) ([]*Recipe, error) {
-	prep, err := db.Prepare("SELECT id, parent_id, recipe_data FROM recipes")
+// recipe the household can see, prefer using getAllRecipeMeta and fetch only
+// what you need
+func getAllRecipes(db *sql.DB, householdID int) ([]*Recipe, error) {
+	prep, err := db.Prepare("SELECT id, parent_id, recipe_data, household_id FROM recipes WHERE " + visibleRecipes + " ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
 
 	recipesMap := map[int]*Recipe{}
 
-	rows, err := prep.Query()
+	rows, err := prep.Query(householdID, householdID)
 	if err != nil {
 		return nil, err
 	}
@@ -154,19 +178,25 @@ func getAllRecipes(db *sql.DB) ([]*Recipe, error) {
 
 	for rows.Next() {
 		recipe_data := []byte{}
-		id, parentID := 0, 0
-		if err := rows.Scan(&id, &parentID, &recipe_data); err != nil {
+		id := 0
+		household := 0
+		var parentIDn sql.NullInt64
+		if err := rows.Scan(&id, &parentIDn, &recipe_data, &household); err != nil {
 			return nil, err
 		}
+		parentID := int(parentIDn.Int64)
 
-		recipe := &Recipe{
-			ID: id,
-		}
+		recipe := &Recipe{}
 		if err := json.Unmarshal(recipe_data, recipe); err != nil {
 			return nil, err
 		}
+		recipe.ID = id
+		recipe.HouseholdID = household
+		recipe.Shared = household != householdID
 
-		if _, ok := recipesMap[parentID]; !ok {
+		// rows come in id order so a version's parent is always already
+		// here to be replaced by it
+		if _, ok := recipesMap[parentID]; ok {
 			delete(recipesMap, parentID)
 		}
 		recipesMap[id] = recipe
@@ -181,14 +211,21 @@ func getAllRecipes(db *sql.DB) ([]*Recipe, error) {
 	return recipes, nil
 }
 
-func getRecipeByID(db *sql.DB, id int) (*Recipe, error) {
-	prep, err := db.Prepare("SELECT recipe_data FROM recipes WHERE id = ?")
+// getRecipeByID returns the recipe if the household can see it, or nil if
+// it doesn't exist or belongs to another household
+func getRecipeByID(db *sql.DB, householdID, id int) (*Recipe, error) {
+	prep, err := db.Prepare("SELECT recipe_data, household_id FROM recipes WHERE id = ? AND " + visibleRecipes)
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare for getting single recipe: %w", err)
 	}
 
 	recipe_data := []byte{}
-	if err := prep.QueryRow(id).Scan(&recipe_data); err != nil {
+	household := 0
+	err = prep.QueryRow(id, householdID, householdID).Scan(&recipe_data, &household)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, fmt.Errorf("unable to scan recipe_data: %w", err)
 	}
 
@@ -196,10 +233,285 @@ func getRecipeByID(db *sql.DB, id int) (*Recipe, error) {
 	if err := json.Unmarshal(recipe_data, recipe); err != nil {
 		return nil, fmt.Errorf("unable to unmarshal recipe_data: %w\njson string: %s", err, string(recipe_data))
 	}
+	recipe.ID = id
+	recipe.HouseholdID = household
+	recipe.Shared = household != householdID
 
 	return recipe, nil
 }
 
+// schema holds every table that lives alongside recipes, each statement has
+// to be safe to run on every start up
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS households (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+	// everything from before households existed belongs to this one
+	`INSERT OR IGNORE INTO households(id, name) values(1, 'Home');`,
+	`CREATE TABLE IF NOT EXISTS recipe_shares (
+    recipe_id INTEGER NOT NULL REFERENCES recipes(id),
+    household_id INTEGER NOT NULL REFERENCES households(id),
+    PRIMARY KEY (recipe_id, household_id)
+);`,
+	`CREATE TABLE IF NOT EXISTS meal_plans (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    start_date TEXT NOT NULL
+);`,
+	`CREATE TABLE IF NOT EXISTS meal_plan_slots (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    plan_id INTEGER NOT NULL REFERENCES meal_plans(id),
+    date TEXT NOT NULL,
+    meal TEXT NOT NULL,
+    recipe_id INTEGER NOT NULL REFERENCES recipes(id),
+    servings INTEGER NOT NULL
+);`,
+	`CREATE TABLE IF NOT EXISTS shopping_list_checks (
+    list_key TEXT NOT NULL,
+    item TEXT NOT NULL,
+    PRIMARY KEY (list_key, item)
+);`,
+	`CREATE TABLE IF NOT EXISTS pantry_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ingredient TEXT NOT NULL,
+    quantity REAL,
+    unit TEXT,
+    expires TEXT
+);`,
+	`CREATE TABLE IF NOT EXISTS calendar_tokens (
+    username TEXT PRIMARY KEY,
+    token TEXT NOT NULL UNIQUE
+);`,
+	`CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    created_at TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    revoked_at TEXT
+);`,
+	`CREATE TABLE IF NOT EXISTS login_failures (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TEXT NOT NULL,
+    locked_until TEXT NOT NULL
+);`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TEXT NOT NULL,
+    event TEXT NOT NULL,
+    username TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    detail TEXT NOT NULL
+);`,
+	`CREATE INDEX IF NOT EXISTS audit_log_username ON audit_log(username)`,
+	`CREATE TABLE IF NOT EXISTS llm_usage (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    household_id INTEGER NOT NULL,
+    recipe_id INTEGER NOT NULL,
+    task TEXT NOT NULL,
+    model TEXT NOT NULL,
+    prompt_tokens INTEGER NOT NULL,
+    completion_tokens INTEGER NOT NULL,
+    cost_micros INTEGER NOT NULL
+);`,
+	`CREATE INDEX IF NOT EXISTS llm_usage_created_at ON llm_usage(created_at)`,
+	`CREATE TABLE IF NOT EXISTS llm_budgets (
+    scope TEXT NOT NULL,
+    subject_id INTEGER NOT NULL,
+    monthly_limit_micros INTEGER NOT NULL,
+    PRIMARY KEY (scope, subject_id)
+);`,
+	`CREATE TABLE IF NOT EXISTS generation_jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    recipe_id INTEGER NOT NULL,
+    serving_size INTEGER NOT NULL,
+    household_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    result_recipe_id INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL,
+    started_at TEXT NOT NULL DEFAULT '',
+    finished_at TEXT NOT NULL DEFAULT ''
+);`,
+	`CREATE TABLE IF NOT EXISTS generation_cache (
+    key TEXT PRIMARY KEY,
+    model TEXT NOT NULL,
+    prompt_version INTEGER NOT NULL,
+    recipe_name TEXT NOT NULL,
+    serving_size INTEGER NOT NULL,
+    text TEXT NOT NULL,
+    prompt_tokens INTEGER NOT NULL DEFAULT 0,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL,
+    hits INTEGER NOT NULL DEFAULT 0,
+    last_hit_at TEXT NOT NULL DEFAULT ''
+);`,
+	`CREATE TABLE IF NOT EXISTS generation_cache_stats (
+    day TEXT PRIMARY KEY,
+    hits INTEGER NOT NULL DEFAULT 0,
+    misses INTEGER NOT NULL DEFAULT 0,
+    fresh INTEGER NOT NULL DEFAULT 0,
+    saved_micros INTEGER NOT NULL DEFAULT 0
+);`,
+	`CREATE TABLE IF NOT EXISTS prompt_templates (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    system TEXT NOT NULL,
+    user TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    created_by TEXT NOT NULL DEFAULT '',
+    UNIQUE (task, version)
+);`,
+	`CREATE TABLE IF NOT EXISTS retag_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    use_llm INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    total INTEGER NOT NULL DEFAULT 0,
+    done INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    finished_at TEXT NOT NULL DEFAULT ''
+);`,
+	`CREATE TABLE IF NOT EXISTS retag_proposals (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    run_id INTEGER NOT NULL REFERENCES retag_runs(id),
+    recipe_id INTEGER NOT NULL,
+    household_id INTEGER NOT NULL,
+    recipe_name TEXT NOT NULL,
+    old_tags TEXT NOT NULL,
+    new_tags TEXT NOT NULL,
+    status TEXT NOT NULL,
+    result_recipe_id INTEGER NOT NULL DEFAULT 0
+);`,
+	`CREATE TABLE IF NOT EXISTS ingredient_classes (
+    name TEXT PRIMARY KEY,
+    allergens TEXT NOT NULL,
+    not_for TEXT NOT NULL,
+    model TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);`,
+	`CREATE TABLE IF NOT EXISTS app_secrets (
+    name TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);`,
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    scopes TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    expires_at TEXT,
+    last_used_at TEXT,
+    revoked_at TEXT
+);`,
+}
+
+// schemaColumns are columns added to tables after they were first created,
+// backfill runs once when the column is added to bring existing rows in line
+var schemaColumns = []struct {
+	Table      string
+	Column     string
+	Definition string
+	Backfill   string
+}{
+	// everyone could do everything before roles existed so existing users
+	// keep that, new users start as viewers
+	{"users", "role", "TEXT NOT NULL DEFAULT 'viewer'", "UPDATE users SET role = 'admin'"},
+	{"users", "oidc_subject", "TEXT", ""},
+	{"users", "household_id", "INTEGER NOT NULL DEFAULT 1", ""},
+	{"recipes", "household_id", "INTEGER NOT NULL DEFAULT 1", ""},
+	{"meal_plans", "household_id", "INTEGER NOT NULL DEFAULT 1", ""},
+	{"pantry_items", "household_id", "INTEGER NOT NULL DEFAULT 1", ""},
+	{"generation_jobs", "fresh", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"generation_jobs", "dietary", "TEXT NOT NULL DEFAULT ''", ""},
+	{"generation_cache", "dietary", "TEXT NOT NULL DEFAULT ''", ""},
+	{"audit_log", "actor", "TEXT NOT NULL DEFAULT ''", ""},
+}
+
+// schemaIndexes are applied after schemaColumns so they can use columns
+// that were added later
+var schemaIndexes = []string{
+	// a job is only in flight once for a recipe, serving size and dietary
+	// requirements, the first version of this index left out dietary
+	`DROP INDEX IF EXISTS generation_jobs_in_flight`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS generation_jobs_in_flight_dietary ON generation_jobs(recipe_id, serving_size, dietary) WHERE status IN ('queued', 'running')`,
+}
+
+func migrateDB(db *sql.DB) error {
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("unable to apply schema statement %q: %w", stmt, err)
+		}
+	}
+
+	for _, c := range schemaColumns {
+		exists, err := columnExists(db, c.Table, c.Column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.Table, c.Column, c.Definition)); err != nil {
+			return fmt.Errorf("unable to add column %s.%s: %w", c.Table, c.Column, err)
+		}
+		if c.Backfill != "" {
+			if _, err := db.Exec(c.Backfill); err != nil {
+				return fmt.Errorf("unable to backfill column %s.%s: %w", c.Table, c.Column, err)
+			}
+		}
+	}
+
+	for _, stmt := range schemaIndexes {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("unable to apply schema statement %q: %w", stmt, err)
+		}
+	}
+
+	return seedPromptTemplates(db, time.Now())
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("unable to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultN   sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultN, &primaryKey); err != nil {
+			return false, fmt.Errorf("unable to scan columns of %s: %w", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
 func checkDBSeeded(db *sql.DB) (bool, error) {
 	count := 0
 	err := db.QueryRow("SELECT COUNT(*) FROM recipes").Scan(&count)
@@ -281,3 +593,21 @@ CREATE TABLE IF NOT EXISTS recipes (
 
 	return nil
 }
+
+// getAppSecret returns a random key kept in the db under name, making it the
+// first time it's asked for
+func getAppSecret(db *sql.DB, name string) ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("unable to generate %s secret: %w", name, err)
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO app_secrets(name, value) values(?, ?)", name, hex.EncodeToString(b)); err != nil {
+		return nil, fmt.Errorf("unable to store %s secret: %w", name, err)
+	}
+
+	var secret string
+	if err := db.QueryRow("SELECT value FROM app_secrets WHERE name = ?", name).Scan(&secret); err != nil {
+		return nil, fmt.Errorf("unable to get %s secret: %w", name, err)
+	}
+	return hex.DecodeString(secret)
+}
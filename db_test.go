@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func Test_getAllRecipes_latestVersions(t *testing.T) {
+	db := newTestDB(t)
+
+	// recipes from before versions were saved by insertRecipeVersion have
+	// no parent at all
+	res, err := db.Exec(`INSERT INTO recipes(parent_id, version, name, reference, recipe_data, household_id) values(NULL, 1, 'Soup', '', '{"name":"Soup","version":1}', ?)`, defaultHouseholdID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	soupID, _ := res.LastInsertId()
+
+	soup, err := getRecipeByID(db, defaultHouseholdID, int(soupID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soup == nil || soup.ID != int(soupID) {
+		t.Fatalf("expected getRecipeByID to set the ID to %d, got %+v", soupID, soup)
+	}
+
+	curry, err := insertRecipeVersion(db, &Recipe{Name: "Curry", HouseholdID: defaultHouseholdID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	soup.Name = "Leek soup"
+	soup2, err := insertRecipeVersion(db, soup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	soup3, err := insertRecipeVersion(db, soup2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipes, err := getAllRecipes(db, defaultHouseholdID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[int]string{}
+	for _, r := range recipes {
+		got[r.ID] = r.Name
+	}
+	want := map[int]string{curry.ID: "Curry", soup3.ID: "Leek soup"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getAllRecipes() = %v, want only the latest versions %v", got, want)
+	}
+
+	metas, err := getAllRecipeMeta(db, defaultHouseholdID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, r := range metas {
+		ids = append(ids, r.ID)
+	}
+	sort.Ints(ids)
+	if !reflect.DeepEqual(ids, []int{curry.ID, soup3.ID}) {
+		t.Errorf("getAllRecipeMeta() = %v, want %v", ids, []int{curry.ID, soup3.ID})
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Diets a recipe can be suitable for, in the order they're shown
+const (
+	dietVegetarian  = "Vegetarian"
+	dietVegan       = "Vegan"
+	dietPescatarian = "Pescatarian"
+	dietGlutenFree  = "Gluten-free"
+	dietDairyFree   = "Dairy-free"
+)
+
+var diets = []string{dietVegetarian, dietVegan, dietPescatarian, dietGlutenFree, dietDairyFree}
+
+// The 14 allergens UK and EU food law says have to be declared, in the
+// order they're shown
+const (
+	allergenCelery      = "Celery"
+	allergenGluten      = "Gluten"
+	allergenCrustaceans = "Crustaceans"
+	allergenEggs        = "Eggs"
+	allergenFish        = "Fish"
+	allergenLupin       = "Lupin"
+	allergenMilk        = "Milk"
+	allergenMolluscs    = "Molluscs"
+	allergenMustard     = "Mustard"
+	allergenTreeNuts    = "Tree nuts"
+	allergenPeanuts     = "Peanuts"
+	allergenSesame      = "Sesame"
+	allergenSoya        = "Soya"
+	allergenSulphites   = "Sulphites"
+)
+
+var allergens = []string{
+	allergenCelery, allergenGluten, allergenCrustaceans, allergenEggs, allergenFish,
+	allergenLupin, allergenMilk, allergenMolluscs, allergenMustard, allergenTreeNuts,
+	allergenPeanuts, allergenSesame, allergenSoya, allergenSulphites,
+}
+
+// allergenDiets are the diets an allergen rules out, so rules only need to
+// list the diets an ingredient rules out on top of its allergens
+var allergenDiets = map[string][]string{
+	allergenGluten:      {dietGlutenFree},
+	allergenMilk:        {dietDairyFree, dietVegan},
+	allergenEggs:        {dietVegan},
+	allergenFish:        {dietVegetarian, dietVegan},
+	allergenCrustaceans: {dietVegetarian, dietVegan},
+	allergenMolluscs:    {dietVegetarian, dietVegan},
+}
+
+// the diets ruled out by things that aren't allergens
+var (
+	notForMeat   = []string{dietVegetarian, dietVegan, dietPescatarian}
+	notForAnimal = []string{dietVegan}
+	// hard Italian cheeses are made with animal rennet
+	notForRennet = []string{dietVegetarian, dietVegan}
+)
+
+// IngredientClass is what's known about one ingredient
+type IngredientClass struct {
+	Allergens []string `json:"allergens"`
+	NotFor    []string `json:"not_for"`
+}
+
+type ingredientRule struct {
+	Keywords  []string
+	Allergens []string
+	NotFor    []string
+}
+
+// ingredientRules say what ingredients contain. Keywords are matched as
+// whole words ignoring plurals, and where matches overlap the longest wins,
+// so "peanut butter" isn't butter and "coconut milk" isn't milk. Anything
+// matching no rule at all is unknown. When in doubt a rule lists the
+// allergen, it's better to skip a recipe that was safe than the other way
+// round.
+var ingredientRules = []ingredientRule{
+	// meat
+	{[]string{"chicken", "beef", "pork", "lamb", "mutton", "veal", "venison", "duck", "turkey", "goose", "rabbit", "pheasant", "bacon", "pancetta", "lardon", "prosciutto", "parma ham", "ham", "salami", "pepperoni", "chorizo", "sausage", "mince", "steak", "brisket", "oxtail", "liver", "kidney", "gelatine", "gelatin", "lard", "suet", "dripping", "bone marrow", "meatball", "burger"}, nil, notForMeat},
+	{[]string{"vegetable suet"}, []string{allergenGluten}, nil},
+	{[]string{"chicken stock", "beef stock", "lamb stock", "ham stock", "chicken broth", "beef broth", "bone broth", "gravy"}, []string{allergenCelery}, notForMeat},
+
+	// fish and shellfish
+	{[]string{"fish", "salmon", "tuna", "cod", "haddock", "mackerel", "sardine", "anchovy", "anchovies", "trout", "sea bass", "bass", "pollock", "hake", "tilapia", "halibut", "plaice", "monkfish", "swordfish", "kipper", "sea bream", "herring", "fish sauce", "nam pla", "fish stock", "bonito", "dashi"}, []string{allergenFish}, nil},
+	{[]string{"worcestershire sauce", "worcestershire"}, []string{allergenFish, allergenGluten, allergenSulphites}, nil},
+	{[]string{"caesar", "caesar dressing", "caesar salad dressing"}, []string{allergenFish, allergenEggs, allergenMilk, allergenMustard}, notForRennet},
+	{[]string{"prawn", "shrimp", "crab", "lobster", "langoustine", "crayfish", "shrimp paste"}, []string{allergenCrustaceans}, nil},
+	{[]string{"mussel", "clam", "oyster", "scallop", "squid", "calamari", "octopus", "cockle", "whelk", "cuttlefish"}, []string{allergenMolluscs}, nil},
+	{[]string{"oyster sauce"}, []string{allergenMolluscs, allergenGluten, allergenSoya}, nil},
+
+	// dairy and eggs
+	{[]string{"milk", "butter", "cream", "double cream", "single cream", "whipping cream", "sour cream", "soured cream", "clotted cream", "creme fraiche", "crème fraîche", "cheese", "cheddar", "mozzarella", "feta", "halloumi", "ricotta", "mascarpone", "paneer", "cream cheese", "cottage cheese", "goat cheese", "goats cheese", "brie", "camembert", "stilton", "emmental", "yoghurt", "yogurt", "greek yoghurt", "greek yogurt", "ghee", "buttermilk", "whey", "condensed milk", "evaporated milk", "milk powder", "white chocolate", "milk chocolate", "naan", "tzatziki", "raita", "bechamel", "béchamel"}, []string{allergenMilk}, nil},
+	{[]string{"parmesan", "parmigiano", "parmigiano reggiano", "pecorino", "grana padano", "gorgonzola", "gruyere", "gruyère", "manchego"}, []string{allergenMilk}, notForRennet},
+	{[]string{"egg", "egg yolk", "egg white", "meringue", "aioli", "quorn"}, []string{allergenEggs}, nil},
+	{[]string{"mayonnaise", "mayo"}, []string{allergenEggs, allergenMustard}, nil},
+	{[]string{"custard", "ice cream", "hollandaise", "bearnaise"}, []string{allergenMilk, allergenEggs}, nil},
+	{[]string{"honey"}, nil, notForAnimal},
+
+	// cereals containing gluten
+	{[]string{"flour", "plain flour", "self raising flour", "strong flour", "bread flour", "wholemeal flour", "wheat", "bread", "breadcrumb", "panko", "pasta", "spaghetti", "penne", "fusilli", "rigatoni", "linguine", "tagliatelle", "pappardelle", "lasagne", "lasagna", "macaroni", "orzo", "gnocchi", "ravioli", "tortellini", "noodle", "udon", "ramen", "couscous", "bulgur", "bulgar", "freekeh", "barley", "pearl barley", "rye", "spelt", "semolina", "seitan", "oat", "porridge", "tortilla", "wrap", "pitta", "pita", "baguette", "ciabatta", "focaccia", "sourdough", "bun", "roll", "crouton", "pastry", "puff pastry", "filo", "filo pastry", "shortcrust pastry", "cracker", "biscuit", "digestive", "beer", "ale", "stout", "malt vinegar", "malt", "dumpling", "stuffing", "pizza dough"}, []string{allergenGluten}, nil},
+	{[]string{"egg noodle", "egg pasta", "fresh pasta"}, []string{allergenGluten, allergenEggs}, nil},
+	{[]string{"brioche", "croissant", "cake", "sponge", "pancake", "crepe", "waffle", "yorkshire pudding", "batter"}, []string{allergenGluten, allergenEggs, allergenMilk}, nil},
+
+	// nuts
+	{[]string{"almond", "ground almond", "flaked almond", "almond flour", "almond milk", "almond butter", "walnut", "pecan", "cashew", "hazelnut", "pistachio", "brazil nut", "macadamia", "pine nut", "chestnut", "marzipan", "praline", "frangipane", "amaretto", "walnut oil", "hazelnut oil"}, []string{allergenTreeNuts}, nil},
+	{[]string{"nut", "mixed nut", "nut butter", "nut oil"}, []string{allergenTreeNuts, allergenPeanuts}, nil},
+	{[]string{"pesto", "basil pesto", "green pesto"}, []string{allergenTreeNuts, allergenMilk}, notForRennet},
+	{[]string{"nutella", "chocolate spread"}, []string{allergenTreeNuts, allergenMilk, allergenSoya}, nil},
+	{[]string{"chocolate", "chocolate chip"}, []string{allergenMilk, allergenSoya}, nil},
+	{[]string{"dark chocolate"}, []string{allergenSoya}, nil},
+	{[]string{"peanut", "peanut butter", "peanut oil", "groundnut", "groundnut oil", "monkey nut", "satay", "satay sauce"}, []string{allergenPeanuts}, nil},
+
+	// the rest of the 14
+	{[]string{"sesame", "sesame seed", "sesame oil", "tahini", "hummus", "houmous", "halva", "za atar", "zaatar", "dukkah"}, []string{allergenSesame}, nil},
+	{[]string{"soy", "soya", "tofu", "tempeh", "edamame", "miso", "tamari", "soy milk", "soya milk", "bean curd", "soy mince", "soya mince", "textured vegetable protein"}, []string{allergenSoya}, nil},
+	{[]string{"soy sauce", "soya sauce", "teriyaki", "teriyaki sauce", "hoisin", "hoisin sauce", "black bean sauce"}, []string{allergenSoya, allergenGluten}, nil},
+	{[]string{"mustard", "dijon", "dijon mustard", "wholegrain mustard", "english mustard", "mustard seed", "mustard powder", "piccalilli"}, []string{allergenMustard}, nil},
+	{[]string{"celery", "celeriac", "celery salt", "celery seed", "vegetable stock", "vegetable broth", "stock cube", "bouillon"}, []string{allergenCelery}, nil},
+	{[]string{"lupin", "lupin flour"}, []string{allergenLupin}, nil},
+	{[]string{"wine", "red wine", "white wine", "rice wine", "shaoxing wine", "sherry", "vermouth", "marsala", "madeira", "cider", "wine vinegar", "red wine vinegar", "white wine vinegar", "cider vinegar", "balsamic", "balsamic vinegar", "sherry vinegar", "dried apricot", "dried fruit", "raisin", "sultana", "currant", "mixed peel", "glace cherry"}, []string{allergenSulphites}, nil},
+
+	// plants and pantry things with none of the 14. Some are here so they
+	// win over a shorter match, "rice noodle" isn't a noodle made of wheat
+	{[]string{
+		"onion", "red onion", "spring onion", "shallot", "leek", "garlic", "chive", "scallion",
+		"carrot", "parsnip", "swede", "turnip", "beetroot", "radish", "potato", "sweet potato", "yam",
+		"tomato", "cherry tomato", "tomato puree", "tomato paste", "passata", "chopped tomato", "sun dried tomato", "ketchup",
+		"pepper", "bell pepper", "red pepper", "green pepper", "yellow pepper", "black pepper", "white pepper", "peppercorn", "chilli", "chillies", "chili", "jalapeno", "jalapeño", "cayenne", "chilli flake", "chilli powder", "chili powder", "sweet chilli sauce", "hot sauce", "sriracha", "harissa",
+		"lemon", "lime", "orange", "grapefruit", "apple", "pear", "banana", "mango", "pineapple", "peach", "plum", "cherry", "grape", "berry", "berries", "strawberry", "raspberry", "blueberry", "blackberry", "cranberry", "pomegranate", "melon", "watermelon", "kiwi", "fig", "date", "rhubarb", "apricot", "coconut", "desiccated coconut", "coconut milk", "coconut cream", "coconut oil", "coconut yoghurt", "coconut yogurt",
+		"salad", "salad leaves", "mixed leaves", "spinach", "kale", "chard", "cabbage", "red cabbage", "lettuce", "rocket", "watercress", "cress", "broccoli", "tenderstem", "cauliflower", "brussels sprout", "sprout", "bean sprout", "pak choi", "bok choy", "asparagus", "artichoke", "fennel", "okra",
+		"courgette", "zucchini", "aubergine", "eggplant", "squash", "butternut", "butternut squash", "pumpkin", "cucumber", "avocado", "mushroom", "shiitake", "porcini", "olive", "caper", "gherkin", "pickle",
+		"pea", "petit pois", "mangetout", "sugar snap", "green bean", "runner bean", "broad bean", "bean", "black bean", "kidney bean", "cannellini bean", "butter bean", "haricot bean", "borlotti bean", "pinto bean", "baked bean", "chickpea", "lentil", "red lentil", "green lentil", "puy lentil", "split pea",
+		"rice", "basmati", "basmati rice", "arborio", "risotto rice", "brown rice", "wild rice", "rice noodle", "rice paper", "rice flour", "rice vinegar", "quinoa", "buckwheat", "millet", "polenta", "cornmeal", "corn", "sweetcorn", "cornflour", "cornstarch", "corn tortilla", "tapioca", "potato starch", "arrowroot", "gram flour", "chickpea flour", "coconut flour", "glass noodle",
+		"parsley", "coriander", "cilantro", "basil", "mint", "dill", "rosemary", "thyme", "sage", "oregano", "tarragon", "marjoram", "bay", "bay leaf", "lemongrass", "kaffir lime", "lime leaf", "curry leaf", "herb", "mixed herb",
+		"ginger", "turmeric", "cumin", "coriander seed", "paprika", "smoked paprika", "cinnamon", "nutmeg", "clove", "cardamom", "star anise", "fennel seed", "garam masala", "curry powder", "five spice", "allspice", "saffron", "sumac", "fenugreek", "nigella seed", "vanilla", "vanilla extract", "spice", "mixed spice",
+		"salt", "sea salt", "sugar", "brown sugar", "caster sugar", "icing sugar", "demerara", "maple syrup", "golden syrup", "agave", "treacle", "molasses", "jam", "marmalade", "cocoa", "cocoa powder",
+		"oil", "olive oil", "extra virgin olive oil", "vegetable oil", "sunflower oil", "rapeseed oil", "cooking spray", "vinegar", "white vinegar", "distilled vinegar", "lemon juice", "lime juice", "orange juice", "orange zest", "lemon zest", "lime zest",
+		"water", "ice", "yeast", "baking powder", "bicarbonate of soda", "baking soda", "cream of tartar", "agar", "pumpkin seed", "sunflower seed", "chia seed", "flaxseed", "linseed", "poppy seed", "vegetable", "mixed vegetable", "salsa", "guacamole", "chutney", "mango chutney",
+	}, nil, nil},
+}
+
+// dietQualifiers are words in front of an ingredient that take away what
+// the rule for it would say, like vegan cheese or gluten free pasta. They
+// only count for what comes after them, "vegetarian sausage" isn't meat but
+// "sausage and vegetarian gravy" is.
+var dietQualifiers = map[string]IngredientClass{
+	"vegan":       {Allergens: []string{allergenMilk, allergenEggs}, NotFor: []string{dietVegetarian, dietVegan, dietPescatarian, dietDairyFree}},
+	"plant based": {Allergens: []string{allergenMilk, allergenEggs}, NotFor: []string{dietVegetarian, dietVegan, dietPescatarian, dietDairyFree}},
+	"vegetarian":  {NotFor: []string{dietVegetarian, dietPescatarian}},
+	"veggie":      {NotFor: []string{dietVegetarian, dietPescatarian}},
+	"meat free":   {NotFor: []string{dietVegetarian, dietPescatarian}},
+	"quorn":       {NotFor: []string{dietVegetarian, dietPescatarian}},
+	"gluten free": {Allergens: []string{allergenGluten}},
+	"dairy free":  {Allergens: []string{allergenMilk}},
+	"egg free":    {Allergens: []string{allergenEggs}},
+}
+
+// ingredientWords splits an ingredient into lower case singular words,
+// dropping anything that isn't a letter
+func ingredientWords(name string) []string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool { return !unicode.IsLetter(r) })
+	for i, w := range words {
+		words[i] = singular(w)
+	}
+	return words
+}
+
+// ingredientKey is how classifications from the model are looked up
+func ingredientKey(name string) string {
+	return strings.Join(ingredientWords(name), " ")
+}
+
+type ruleKeyword struct {
+	words []string
+	rule  *ingredientRule
+}
+
+// ruleKeywords are the keywords of every rule by their first word
+var ruleKeywords = indexIngredientRules(ingredientRules)
+
+func indexIngredientRules(rules []ingredientRule) map[string][]ruleKeyword {
+	index := map[string][]ruleKeyword{}
+	for i := range rules {
+		for _, keyword := range rules[i].Keywords {
+			words := ingredientWords(keyword)
+			index[words[0]] = append(index[words[0]], ruleKeyword{words, &rules[i]})
+		}
+	}
+	return index
+}
+
+// qualifierJoins end what a qualifier covers, "vegan cheddar cheese" is
+// all vegan but "vegan mayo and cheese" isn't
+var qualifierJoins = map[string]bool{"and": true, "or": true, "with": true, "plus": true}
+
+// qualifiersBefore returns the qualifiers in front of word i back to the
+// start of its part of the ingredient, there can be more than one like
+// "vegan gluten free"
+func qualifiersBefore(words []string, i int) []IngredientClass {
+	found := []IngredientClass{}
+	for i--; i >= 0 && !qualifierJoins[words[i]]; i-- {
+		if q, ok := dietQualifiers[words[i]]; ok {
+			found = append(found, q)
+		}
+		if i > 0 {
+			if q, ok := dietQualifiers[words[i-1]+" "+words[i]]; ok {
+				found, i = append(found, q), i-1
+			}
+		}
+	}
+	return found
+}
+
+// ingredientFillers are words that don't change what's in an ingredient,
+// like "to taste" or which cut of chicken it is
+var ingredientFillers = map[string]bool{
+	"a": true, "an": true, "of": true, "to": true, "taste": true, "for": true,
+	"serving": true, "as": true, "needed": true, "some": true, "extra": true,
+	"whole": true, "raw": true, "frozen": true, "tinned": true, "canned": true,
+	"thigh": true, "breast": true, "leg": true, "drumstick": true, "wing": true,
+	"fillet": true, "boneless": true, "skinless": true, "salted": true,
+	"unsalted": true, "king": true, "tiger": true,
+}
+
+// coveredWords marks the qualifiers, joins and words about how much or how
+// it's prepared, which don't need a rule to match them
+func coveredWords(words []string, taken []bool) {
+	for i, w := range words {
+		switch {
+		case qualifierJoins[w], preparationWords[w], isKnownUnit(w), ingredientFillers[w]:
+			taken[i] = true
+		case dietQualifiers[w].Allergens != nil || dietQualifiers[w].NotFor != nil:
+			taken[i] = true
+		case i > 0 && (dietQualifiers[words[i-1]+" "+w].Allergens != nil || dietQualifiers[words[i-1]+" "+w].NotFor != nil):
+			taken[i-1], taken[i] = true, true
+		}
+	}
+}
+
+// classifyIngredient works out what an ingredient contains from the rule
+// table. ok is false unless every word is matched by a rule or doesn't
+// change what it is, "lemon curd" isn't just lemon and is left to the model.
+func classifyIngredient(name string) (IngredientClass, bool) {
+	words := ingredientWords(name)
+
+	type match struct {
+		start, end int
+		rule       *ingredientRule
+	}
+	matches := []match{}
+	for i, w := range words {
+		for _, k := range ruleKeywords[w] {
+			if i+len(k.words) > len(words) {
+				continue
+			}
+			if strings.Join(words[i:i+len(k.words)], " ") == strings.Join(k.words, " ") {
+				matches = append(matches, match{i, i + len(k.words), k.rule})
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return IngredientClass{}, false
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].end-matches[i].start > matches[j].end-matches[j].start
+	})
+
+	allergenSet, notForSet := map[string]bool{}, map[string]bool{}
+	taken := make([]bool, len(words))
+	for _, m := range matches {
+		overlaps := false
+		for i := m.start; i < m.end; i++ {
+			overlaps = overlaps || taken[i]
+		}
+		if overlaps {
+			continue
+		}
+		for i := m.start; i < m.end; i++ {
+			taken[i] = true
+		}
+
+		matchAllergens, matchNotFor := map[string]bool{}, map[string]bool{}
+		for _, a := range m.rule.Allergens {
+			matchAllergens[a] = true
+		}
+		for _, d := range m.rule.NotFor {
+			matchNotFor[d] = true
+		}
+		qualifiers := qualifiersBefore(words, m.start)
+		for _, q := range qualifiers {
+			for _, a := range q.Allergens {
+				delete(matchAllergens, a)
+			}
+		}
+		for a := range matchAllergens {
+			allergenSet[a] = true
+			for _, d := range allergenDiets[a] {
+				matchNotFor[d] = true
+			}
+		}
+		for _, q := range qualifiers {
+			for _, d := range q.NotFor {
+				delete(matchNotFor, d)
+			}
+		}
+		for d := range matchNotFor {
+			notForSet[d] = true
+		}
+	}
+
+	coveredWords(words, taken)
+	for _, t := range taken {
+		if !t {
+			return IngredientClass{}, false
+		}
+	}
+
+	return IngredientClass{Allergens: inOrder(allergens, allergenSet), NotFor: inOrder(diets, notForSet)}, true
+}
+
+// inOrder returns the members of set in the order of list
+func inOrder(list []string, set map[string]bool) []string {
+	ordered := []string{}
+	for _, s := range list {
+		if set[s] {
+			ordered = append(ordered, s)
+		}
+	}
+	return ordered
+}
+
+// DietInfo is what a recipe is suitable for and the allergens it contains,
+// worked out from its ingredients
+type DietInfo struct {
+	// Classified is false for recipes that haven't been generated, nothing
+	// is known about them
+	Classified bool
+	Suitable   []string
+	Allergens  []string
+	// Sources are the ingredients each allergen is in
+	Sources map[string][]string
+	// Unknown are ingredients nothing is known about, no diets are claimed
+	// while there are any and the allergens may be missing some
+	Unknown []string
+	// Guessed are ingredients the model classified as they're not in the
+	// rule table. Its answer is used for Allergens but nothing is claimed
+	// on it, the diets that rely on it are Unverified instead of Suitable.
+	Guessed    []string
+	Unverified []string
+}
+
+// classifyRecipe checks every ingredient of the recipe against the rule
+// table, falling back on what the model said about ones it doesn't know
+func classifyRecipe(recipe *Recipe, guessed map[string]IngredientClass) *DietInfo {
+	info := &DietInfo{Sources: map[string][]string{}}
+	if recipe.Content == nil || len(recipe.Content.Ingredients) == 0 {
+		return info
+	}
+	info.Classified = true
+
+	names := []string{}
+	for name := range recipe.Content.Ingredients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	allergenSet, notForSet := map[string]bool{}, map[string]bool{}
+	for _, name := range names {
+		class, ok := classifyIngredient(name)
+		if !ok {
+			if class, ok = guessed[ingredientKey(name)]; ok {
+				info.Guessed = append(info.Guessed, name)
+			} else {
+				info.Unknown = append(info.Unknown, name)
+				continue
+			}
+		}
+		for _, a := range class.Allergens {
+			allergenSet[a] = true
+			info.Sources[a] = append(info.Sources[a], name)
+		}
+		for _, d := range class.NotFor {
+			notForSet[d] = true
+		}
+	}
+
+	info.Allergens = inOrder(allergens, allergenSet)
+	if len(info.Unknown) == 0 {
+		for _, d := range diets {
+			switch {
+			case notForSet[d]:
+			case len(info.Guessed) > 0:
+				info.Unverified = append(info.Unverified, d)
+			default:
+				info.Suitable = append(info.Suitable, d)
+			}
+		}
+	}
+	return info
+}
+
+// Complete is true when the rule table knows every ingredient, the model's
+// guesses don't count as someone with an allergy can't rely on them
+func (d *DietInfo) Complete() bool {
+	return d.Classified && len(d.Unknown) == 0 && len(d.Guessed) == 0
+}
+
+func (d *DietInfo) SuitableFor(diet string) bool {
+	return containsString(d.Suitable, diet)
+}
+
+func (d *DietInfo) Contains(allergen string) bool {
+	return containsString(d.Allergens, allergen)
+}
+
+// FreeFrom is only true when the rule table says no ingredient has the
+// allergen
+func (d *DietInfo) FreeFrom(allergen string) bool {
+	return d.Complete() && !d.Contains(allergen)
+}
+
+// Badges are the diets worth showing, vegan recipes are vegetarian and
+// vegetarian ones are pescatarian so only the strictest of those is shown
+func (d *DietInfo) Badges() []string {
+	return strictestDiets(d.Suitable)
+}
+
+// UnverifiedBadges are the diets that only hold if the model's guesses
+// are right
+func (d *DietInfo) UnverifiedBadges() []string {
+	return strictestDiets(d.Unverified)
+}
+
+func strictestDiets(list []string) []string {
+	badges := []string{}
+	for _, diet := range list {
+		if (diet == dietVegetarian && containsString(list, dietVegan)) || (diet == dietPescatarian && containsString(list, dietVegetarian)) {
+			continue
+		}
+		badges = append(badges, diet)
+	}
+	return badges
+}
+
+// getIngredientClasses returns what the model has said about ingredients
+// the rule table doesn't know, by ingredientKey
+func getIngredientClasses(db *sql.DB) (map[string]IngredientClass, error) {
+	rows, err := db.Query("SELECT name, allergens, not_for FROM ingredient_classes")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ingredient classes: %w", err)
+	}
+	defer rows.Close()
+
+	classes := map[string]IngredientClass{}
+	for rows.Next() {
+		var name, allergensJSON, notForJSON string
+		if err := rows.Scan(&name, &allergensJSON, &notForJSON); err != nil {
+			return nil, fmt.Errorf("unable to scan ingredient class: %w", err)
+		}
+		class := IngredientClass{}
+		if err := json.Unmarshal([]byte(allergensJSON), &class.Allergens); err != nil {
+			return nil, fmt.Errorf("unable to read allergens for %s: %w", name, err)
+		}
+		if err := json.Unmarshal([]byte(notForJSON), &class.NotFor); err != nil {
+			return nil, fmt.Errorf("unable to read diets for %s: %w", name, err)
+		}
+		classes[name] = class
+	}
+	return classes, rows.Err()
+}
+
+func saveIngredientClass(db *sql.DB, name string, class IngredientClass, model string, now time.Time) error {
+	allergensJSON, _ := json.Marshal(class.Allergens)
+	notForJSON, _ := json.Marshal(class.NotFor)
+	if _, err := db.Exec("INSERT OR REPLACE INTO ingredient_classes(name, allergens, not_for, model, created_at) values(?,?,?,?,?)",
+		ingredientKey(name), allergensJSON, notForJSON, model, now.UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("unable to save ingredient class: %w", err)
+	}
+	return nil
+}
+
+// cleanIngredientClass keeps the allergens and diets the model gave that
+// are ones we know, whatever case they're in, and adds the diets its
+// allergens rule out
+func cleanIngredientClass(class IngredientClass) IngredientClass {
+	allergenSet, notForSet := map[string]bool{}, map[string]bool{}
+	for _, given := range class.Allergens {
+		for _, a := range allergens {
+			if strings.EqualFold(strings.TrimSpace(given), a) {
+				allergenSet[a] = true
+				for _, d := range allergenDiets[a] {
+					notForSet[d] = true
+				}
+			}
+		}
+	}
+	for _, given := range class.NotFor {
+		for _, d := range diets {
+			if strings.EqualFold(strings.TrimSpace(given), d) {
+				notForSet[d] = true
+			}
+		}
+	}
+	return IngredientClass{Allergens: inOrder(allergens, allergenSet), NotFor: inOrder(diets, notForSet)}
+}
+
+// classifyAllergens asks the model about the ingredients of a recipe that
+// the rule table doesn't know, what it says is kept for every recipe with
+// the same ingredient. It's a POST from the recipe page as it costs money.
+func classifyAllergens(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+		if !canDo(r, roleEditor) {
+			forbidden(w, r, roleEditor)
+			return
+		}
+		if !tokenAllows(r, "generate") {
+			forbiddenScope(w, "generate")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error parsing form: %v", err)
+			return
+		}
+
+		recipeID, err := strconv.Atoi(r.PostFormValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: recipe ID must be an integer")
+			return
+		}
+		servingSize, err := strconv.Atoi(r.PostFormValue("serving_size"))
+		if err != nil || servingSize < 1 {
+			servingSize = 2
+		}
+
+		user := requestUser(r)
+		recipe, err := getRecipeByID(db, user.HouseholdID, recipeID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if recipe == nil || recipe.Shared {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: recipe not found")
+			return
+		}
+		back := fmt.Sprintf("/recipe?id=%d&serving_size=%d", recipe.ID, servingSize)
+
+		guessed, err := getIngredientClasses(db)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		info := classifyRecipe(recipe, guessed)
+		if len(info.Unknown) == 0 {
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+
+		now := time.Now()
+		if err := checkBudget(db, user, now); err != nil {
+			if !budgetExceeded(w, err) {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+			}
+			return
+		}
+		prompt, err := renderPrompt(db, usageTaskAllergens, PromptData{Name: recipe.Name, Ingredients: strings.Join(info.Unknown, "\n")})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		classes, usage, err := generateIngredientClasses(info.Unknown, prompt)
+		if err := recordUsage(db, user, recipe.ID, usage, now); err != nil {
+			fmt.Println(err)
+		}
+		if errors.Is(err, errGenerationUnavailable) {
+			generationUnavailable(w, r)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		for name, class := range classes {
+			if err := saveIngredientClass(db, name, class, llmProvider.Model(usageTaskAllergens), now); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_classifyIngredient(t *testing.T) {
+	tests := []struct {
+		name          string
+		wantAllergens []string
+		wantNotFor    []string
+		wantOK        bool
+	}{
+		{"onions, finely diced", []string{}, []string{}, true},
+		{"chicken thighs", []string{}, notForMeat, true},
+		{"unsalted butter", []string{allergenMilk}, []string{dietVegan, dietDairyFree}, true},
+		{"peanut butter", []string{allergenPeanuts}, []string{}, true},
+		{"coconut milk", []string{}, []string{}, true},
+		{"butternut squash", []string{}, []string{}, true},
+		{"nutmeg", []string{}, []string{}, true},
+		{"pine nuts", []string{allergenTreeNuts}, []string{}, true},
+		{"mixed nuts", []string{allergenTreeNuts, allergenPeanuts}, []string{}, true},
+		{"rice noodles", []string{}, []string{}, true},
+		{"egg noodles", []string{allergenGluten, allergenEggs}, []string{dietVegan, dietGlutenFree}, true},
+		{"gluten-free spaghetti", []string{}, []string{}, true},
+		{"vegan cheddar cheese", []string{}, []string{}, true},
+		{"vegan mayo and cheese", []string{allergenMilk, allergenMustard}, []string{dietVegan, dietDairyFree}, true},
+		{"vegetarian sausages", []string{}, []string{dietVegan}, true},
+		{"sausage and vegetarian gravy", []string{allergenCelery}, notForMeat, true},
+		{"parmesan, grated", []string{allergenMilk}, []string{dietVegetarian, dietVegan, dietDairyFree}, true},
+		{"king prawns", []string{allergenCrustaceans}, []string{dietVegetarian, dietVegan}, true},
+		{"Worcestershire sauce", []string{allergenGluten, allergenFish, allergenSulphites}, []string{dietVegetarian, dietVegan, dietGlutenFree}, true},
+		{"soy sauce", []string{allergenGluten, allergenSoya}, []string{dietGlutenFree}, true},
+		{"honey", []string{}, []string{dietVegan}, true},
+		{"stock", nil, nil, false},
+		{"gochujang", nil, nil, false},
+		{"lemon curd", nil, nil, false},
+		{"chicken korma paste", nil, nil, false},
+		{"rice pudding", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := classifyIngredient(tt.name)
+			if ok != tt.wantOK {
+				t.Fatalf("classifyIngredient() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(got.Allergens, tt.wantAllergens) || !reflect.DeepEqual(got.NotFor, tt.wantNotFor) {
+				t.Errorf("classifyIngredient() = %+v, want allergens %v not for %v", got, tt.wantAllergens, tt.wantNotFor)
+			}
+		})
+	}
+}
+
+func Test_classifyRecipe(t *testing.T) {
+	recipe := func(ingredients ...string) *Recipe {
+		content := &RecipeContent{Ingredients: map[string]*IngredientAmount{}}
+		for _, name := range ingredients {
+			content.Ingredients[name] = &IngredientAmount{Amount: "1"}
+		}
+		return &Recipe{Content: content}
+	}
+
+	dal := classifyRecipe(recipe("red lentils", "onion", "garam masala", "coconut milk", "rice"), nil)
+	if !reflect.DeepEqual(dal.Suitable, diets) || !reflect.DeepEqual(dal.Badges(), []string{dietVegan, dietGlutenFree, dietDairyFree}) {
+		t.Errorf("expected the dal to suit every diet, got %v with badges %v", dal.Suitable, dal.Badges())
+	}
+	if !dal.FreeFrom(allergenPeanuts) {
+		t.Errorf("expected the dal to be free from peanuts")
+	}
+
+	satay := classifyRecipe(recipe("chicken breast", "peanut butter", "soy sauce", "lime"), nil)
+	if !reflect.DeepEqual(satay.Allergens, []string{allergenGluten, allergenPeanuts, allergenSoya}) {
+		t.Errorf("unexpected allergens %v", satay.Allergens)
+	}
+	if !reflect.DeepEqual(satay.Suitable, []string{dietDairyFree}) || !reflect.DeepEqual(satay.Sources[allergenPeanuts], []string{"peanut butter"}) {
+		t.Errorf("unexpected diets %v and sources %v", satay.Suitable, satay.Sources)
+	}
+
+	// an unknown ingredient means nothing can be claimed until the model
+	// has said what's in it
+	curry := recipe("tofu", "green curry paste", "rice")
+	unknown := classifyRecipe(curry, nil)
+	if len(unknown.Suitable) != 0 || unknown.Complete() || unknown.FreeFrom(allergenPeanuts) || !reflect.DeepEqual(unknown.Unknown, []string{"green curry paste"}) {
+		t.Errorf("expected no claims with an unknown ingredient, got %+v", unknown)
+	}
+	guessed := classifyRecipe(curry, map[string]IngredientClass{
+		"green curry paste": {Allergens: []string{allergenCrustaceans}, NotFor: []string{dietVegetarian, dietVegan}},
+	})
+	if !reflect.DeepEqual(guessed.Guessed, []string{"green curry paste"}) || !reflect.DeepEqual(guessed.Allergens, []string{allergenCrustaceans, allergenSoya}) {
+		t.Errorf("expected the model's answer to be used for allergens, got %+v", guessed)
+	}
+	// but nothing is claimed on a guess, someone with a nut allergy can't
+	// rely on the model saying there are no nuts in it
+	if guessed.Complete() || len(guessed.Suitable) != 0 || guessed.SuitableFor(dietGlutenFree) || guessed.FreeFrom(allergenPeanuts) || guessed.FreeFrom(allergenTreeNuts) {
+		t.Errorf("expected no claims on the model's guess, got %+v", guessed)
+	}
+	if !reflect.DeepEqual(guessed.Unverified, []string{dietPescatarian, dietGlutenFree, dietDairyFree}) || !reflect.DeepEqual(guessed.UnverifiedBadges(), []string{dietPescatarian, dietGlutenFree, dietDairyFree}) {
+		t.Errorf("expected the diets the guess allows to be unverified, got %v", guessed.Unverified)
+	}
+	item := &listRecipe{Recipe: curry, Diet: guessed}
+	if item.matches(map[string]bool{}, map[string]bool{allergenPeanuts: true}) || item.matches(map[string]bool{dietDairyFree: true}, map[string]bool{}) {
+		t.Errorf("expected a guessed recipe to be left out of filtered lists")
+	}
+
+	// a word the rules don't know could be what the ingredient really is
+	tart := classifyRecipe(recipe("lemon curd", "chicken korma paste"), nil)
+	if tart.FreeFrom(allergenEggs) || tart.FreeFrom(allergenMilk) || tart.FreeFrom(allergenTreeNuts) || !reflect.DeepEqual(tart.Unknown, []string{"chicken korma paste", "lemon curd"}) {
+		t.Errorf("expected partly matched ingredients to be unknown, got %+v", tart)
+	}
+
+	if empty := classifyRecipe(&Recipe{}, nil); empty.Classified || empty.FreeFrom(allergenPeanuts) {
+		t.Errorf("expected a recipe without ingredients not to be classified, got %+v", empty)
+	}
+}
+
+func Test_generateIngredientClasses(t *testing.T) {
+	db := newTestDB(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		answer := "Here you go:\n" + `{"Green curry paste": {"allergens": ["crustaceans", "Nightshades"], "not_for": ["vegan"]}}`
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"model":   "small",
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": answer}}},
+		})
+	}))
+	defer srv.Close()
+
+	oldProvider, oldClient := llmProvider, client
+	defer func() { llmProvider, client = oldProvider, oldClient }()
+	llmProvider = LLMProvider{BaseURL: srv.URL + "/v1", Models: map[string]string{usageTaskAllergens: "small"}}
+	client = newLLMClient(llmProvider.ClientConfig())
+
+	prompt, err := renderPrompt(db, usageTaskAllergens, PromptData{Ingredients: "green curry paste\ngochujang"})
+	if err != nil {
+		t.Fatalf("unable to render prompt: %v", err)
+	}
+	classes, usage, err := generateIngredientClasses([]string{"green curry paste", "gochujang"}, prompt)
+	if err != nil {
+		t.Fatalf("generateIngredientClasses() error = %v", err)
+	}
+	want := map[string]IngredientClass{
+		"green curry paste": {Allergens: []string{allergenCrustaceans}, NotFor: []string{dietVegetarian, dietVegan}},
+	}
+	if !reflect.DeepEqual(classes, want) || usage.Task != usageTaskAllergens {
+		t.Errorf("generateIngredientClasses() = %+v, %+v, want %+v", classes, usage, want)
+	}
+
+	for name, class := range classes {
+		if err := saveIngredientClass(db, name, class, usage.Model, time.Now()); err != nil {
+			t.Fatalf("unable to save class: %v", err)
+		}
+	}
+	saved, err := getIngredientClasses(db)
+	if err != nil {
+		t.Fatalf("unable to get classes: %v", err)
+	}
+	if !reflect.DeepEqual(saved, want) {
+		t.Errorf("getIngredientClasses() = %+v, want %+v", saved, want)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// epubBook is the data shared by every document in an exported cookbook
+type epubBook struct {
+	Title       string
+	Identifier  string
+	Modified    string
+	Recipes     []*Recipe
+	Tags        []*epubIndexEntry
+	Ingredients []*epubIndexEntry
+	Untagged    []*Recipe
+}
+
+// epubIndexEntry is a single heading in the tag or ingredient index along
+// with every recipe it points at
+type epubIndexEntry struct {
+	Name    string
+	Anchor  string
+	Recipes []*Recipe
+}
+
+var nonAnchorChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// epubAnchor is the id of a name's entry in an index, names that only
+// differ in case or punctuation share one. A name with no letters or digits
+// at all gets a hash of itself so it doesn't share with every other one.
+func epubAnchor(prefix, name string) string {
+	slug := strings.Trim(nonAnchorChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		slug = fmt.Sprintf("%x", sha1.Sum([]byte(strings.TrimSpace(name))))[:8]
+	}
+	return prefix + "-" + slug
+}
+
+// epubIngredient is an ingredient line in a chapter, ID is unique in the
+// chapter and Anchor is its entry in the ingredient index
+type epubIngredient struct {
+	Name   string
+	Amount *IngredientAmount
+	ID     string
+	Anchor string
+}
+
+// epubIngredients lists a recipe's ingredients by name. Ingredients that
+// share an index entry, like "Salt" and "salt", get a counter on the end of
+// their ids to keep them unique in the chapter.
+func epubIngredients(ingredients map[string]*IngredientAmount) []*epubIngredient {
+	names := []string{}
+	for name := range ingredients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	used := map[string]bool{}
+	list := []*epubIngredient{}
+	for _, name := range names {
+		anchor := epubAnchor("ingredient", name)
+		id := anchor
+		for n := 2; used[id]; n++ {
+			id = fmt.Sprintf("%s-%d", anchor, n)
+		}
+		used[id] = true
+		list = append(list, &epubIngredient{Name: name, Amount: ingredients[name], ID: id, Anchor: anchor})
+	}
+	return list
+}
+
+func epubChapterFile(r *Recipe) string {
+	return fmt.Sprintf("recipe-%d.xhtml", r.ID)
+}
+
+var epubFuncs = template.FuncMap{
+	"chapter":     epubChapterFile,
+	"tagAnchor":   func(name string) string { return epubAnchor("tag", name) },
+	"ingredients": epubIngredients,
+}
+
+var epubTemplates = template.Must(template.New("epub").Funcs(epubFuncs).Parse(`
+{{ define "container.xml" }}<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+{{ end }}
+
+{{ define "content.opf" }}<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="en">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">{{ .Identifier }}</dc:identifier>
+    <dc:title>{{ .Title }}</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">{{ .Modified }}</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+    {{ range .Recipes }}<item id="recipe-{{ .ID }}" href="{{ chapter . }}" media-type="application/xhtml+xml"/>
+    {{ end }}<item id="tags" href="tags.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ingredients" href="ingredients.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="nav"/>
+    {{ range .Recipes }}<itemref idref="recipe-{{ .ID }}"/>
+    {{ end }}<itemref idref="tags"/>
+    <itemref idref="ingredients"/>
+  </spine>
+</package>
+{{ end }}
+
+{{ define "head" }}<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="en">
+<head>
+  <title>{{ . }}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+{{ end }}
+
+{{ define "nav.xhtml" }}{{ template "head" .Title }}<body>
+  <nav epub:type="toc" id="toc">
+    <h1>{{ .Title }}</h1>
+    <ol>
+      {{ range .Tags }}<li>
+        <span>{{ .Name }}</span>
+        <ol>
+          {{ range .Recipes }}<li><a href="{{ chapter . }}">{{ .Name }}</a></li>
+          {{ end }}
+        </ol>
+      </li>
+      {{ end }}{{ if .Untagged }}<li>
+        <span>Untagged</span>
+        <ol>
+          {{ range .Untagged }}<li><a href="{{ chapter . }}">{{ .Name }}</a></li>
+          {{ end }}
+        </ol>
+      </li>
+      {{ end }}<li><a href="tags.xhtml">Tag Index</a></li>
+      <li><a href="ingredients.xhtml">Ingredient Index</a></li>
+    </ol>
+  </nav>
+  <nav epub:type="landmarks" hidden="hidden">
+    <ol>
+      <li><a epub:type="toc" href="nav.xhtml">Contents</a></li>
+      <li><a epub:type="index" href="ingredients.xhtml">Ingredient Index</a></li>
+    </ol>
+  </nav>
+</body>
+</html>
+{{ end }}
+
+{{ define "recipe.xhtml" }}{{ template "head" .Name }}<body>
+  <section epub:type="chapter">
+    <h1>{{ .Name }}</h1>
+    {{ if .Tags }}<p class="tags">{{ range $i, $t := .Tags }}{{ if $i }}, {{ end }}<a href="tags.xhtml#{{ tagAnchor $t }}">{{ $t }}</a>{{ end }}</p>
+    {{ end }}{{ if .Reference }}<p>Source: <a href="{{ .Reference }}">{{ .Reference }}</a></p>
+    {{ end }}{{ with .Content }}<p>Servings: {{ .Servings }}</p>
+    <h2>Ingredients</h2>
+    <ul>
+      {{ range ingredients .Ingredients }}<li id="{{ .ID }}">{{ with .Amount }}{{ .Amount }} {{ .Unit }} {{ end }}<a href="ingredients.xhtml#{{ .Anchor }}">{{ .Name }}</a></li>
+      {{ end }}
+    </ul>
+    <h2>Instructions</h2>
+    <ol>
+      {{ range .MethodLines }}<li>{{ . }}</li>
+      {{ end }}
+    </ol>
+    {{ if .Suggestions }}<h2>Serving/Presentation Suggestions</h2>
+    <ul>
+      {{ range .Suggestions }}<li>{{ . }}</li>
+      {{ end }}
+    </ul>
+    {{ end }}{{ if .Modifications }}<h2>Modifications</h2>
+    <ul>
+      {{ range .Modifications }}<li>{{ . }}</li>
+      {{ end }}
+    </ul>
+    {{ end }}{{ else }}<p>This recipe has not been written up yet.</p>
+    {{ end }}
+  </section>
+</body>
+</html>
+{{ end }}
+
+{{ define "index.xhtml" }}{{ template "head" .Title }}<body>
+  <section epub:type="index">
+    <h1>{{ .Title }}</h1>
+    <dl>
+      {{ range .Entries }}<dt id="{{ .Anchor }}">{{ .Name }}</dt>
+      {{ range .Recipes }}<dd><a href="{{ chapter . }}">{{ .Name }}</a></dd>
+      {{ end }}{{ end }}
+    </dl>
+  </section>
+</body>
+</html>
+{{ end }}
+`))
+
+const epubStylesheet = `body { font-family: serif; line-height: 1.4; }
+h1 { margin-bottom: 0.2em; }
+.tags { font-style: italic; }
+dt { font-weight: bold; margin-top: 0.6em; }
+`
+
+// buildEPUBBook groups the recipes into the tag navigation and the tag and
+// ingredient indexes, everything is sorted so an export is reproducible
+func buildEPUBBook(title string, recipes []*Recipe, modified time.Time) *epubBook {
+	sorted := make([]*Recipe, len(recipes))
+	copy(sorted, recipes)
+	sort.Slice(sorted, func(i, j int) bool {
+		if !strings.EqualFold(sorted[i].Name, sorted[j].Name) {
+			return strings.ToLower(sorted[i].Name) < strings.ToLower(sorted[j].Name)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	book := &epubBook{
+		Title:    title,
+		Modified: modified.UTC().Format("2006-01-02T15:04:05Z"),
+		Recipes:  sorted,
+	}
+
+	tags := map[string]*epubIndexEntry{}
+	ingredients := map[string]*epubIndexEntry{}
+	idHash := sha1.New()
+	for _, r := range sorted {
+		fmt.Fprintf(idHash, "%d:%d;", r.ID, r.Version)
+
+		seenTags := map[string]bool{}
+		for _, t := range r.Tags {
+			t = strings.TrimSpace(t)
+			anchor := epubAnchor("tag", t)
+			if t == "" || seenTags[anchor] {
+				continue
+			}
+			seenTags[anchor] = true
+			if _, ok := tags[anchor]; !ok {
+				tags[anchor] = &epubIndexEntry{Name: t, Anchor: anchor}
+			}
+			tags[anchor].Recipes = append(tags[anchor].Recipes, r)
+		}
+		if len(seenTags) == 0 {
+			book.Untagged = append(book.Untagged, r)
+		}
+
+		if r.Content == nil {
+			continue
+		}
+		names := []string{}
+		for name := range r.Content.Ingredients {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		seenIngredients := map[string]bool{}
+		for _, name := range names {
+			anchor := epubAnchor("ingredient", name)
+			if seenIngredients[anchor] {
+				continue
+			}
+			seenIngredients[anchor] = true
+			if _, ok := ingredients[anchor]; !ok {
+				ingredients[anchor] = &epubIndexEntry{Name: strings.TrimSpace(name), Anchor: anchor}
+			}
+			ingredients[anchor].Recipes = append(ingredients[anchor].Recipes, r)
+		}
+	}
+
+	book.Tags = sortedIndexEntries(tags)
+	book.Ingredients = sortedIndexEntries(ingredients)
+
+	sum := idHash.Sum(nil)
+	book.Identifier = fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+
+	return book
+}
+
+func sortedIndexEntries(entries map[string]*epubIndexEntry) []*epubIndexEntry {
+	sorted := []*epubIndexEntry{}
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Anchor < sorted[j].Anchor
+	})
+	return sorted
+}
+
+// writeEPUB writes an EPUB 3 container for the recipes to w, the mimetype
+// entry has to be first and uncompressed for readers to recognise the file
+func writeEPUB(w io.Writer, title string, recipes []*Recipe, modified time.Time) error {
+	book := buildEPUBBook(title, recipes, modified)
+
+	zw := zip.NewWriter(w)
+
+	mimetype, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return fmt.Errorf("unable to create mimetype entry: %w", err)
+	}
+	if _, err := io.WriteString(mimetype, "application/epub+zip"); err != nil {
+		return fmt.Errorf("unable to write mimetype entry: %w", err)
+	}
+
+	writeTemplate := func(name, tmpl string, data interface{}) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return fmt.Errorf("unable to create %s: %w", name, err)
+		}
+		// html/template escapes processing instructions so the declaration
+		// is written outside of it
+		if _, err := io.WriteString(f, xml.Header); err != nil {
+			return fmt.Errorf("unable to write %s: %w", name, err)
+		}
+		if err := epubTemplates.ExecuteTemplate(f, tmpl, data); err != nil {
+			return fmt.Errorf("unable to render %s: %w", name, err)
+		}
+		return nil
+	}
+
+	if err := writeTemplate("META-INF/container.xml", "container.xml", nil); err != nil {
+		return err
+	}
+	if err := writeTemplate("OEBPS/content.opf", "content.opf", book); err != nil {
+		return err
+	}
+	if err := writeTemplate("OEBPS/nav.xhtml", "nav.xhtml", book); err != nil {
+		return err
+	}
+	for _, r := range book.Recipes {
+		if err := writeTemplate("OEBPS/"+epubChapterFile(r), "recipe.xhtml", r); err != nil {
+			return err
+		}
+	}
+
+	type index struct {
+		Title   string
+		Entries []*epubIndexEntry
+	}
+	if err := writeTemplate("OEBPS/tags.xhtml", "index.xhtml", index{"Tag Index", book.Tags}); err != nil {
+		return err
+	}
+	if err := writeTemplate("OEBPS/ingredients.xhtml", "index.xhtml", index{"Ingredient Index", book.Ingredients}); err != nil {
+		return err
+	}
+
+	style, err := zw.Create("OEBPS/style.css")
+	if err != nil {
+		return fmt.Errorf("unable to create style.css: %w", err)
+	}
+	if _, err := io.WriteString(style, epubStylesheet); err != nil {
+		return fmt.Errorf("unable to write style.css: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("unable to finish epub: %w", err)
+	}
+
+	return nil
+}
+
+func exportEPUB(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		recipes, err := getAllRecipes(db, requestUser(r).HouseholdID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error fetching recipes: %v", err)
+			return
+		}
+
+		title := "Food Archive"
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			title = fmt.Sprintf("Food Archive: %s", tag)
+			filtered := []*Recipe{}
+			for _, recipe := range recipes {
+				for _, t := range recipe.Tags {
+					if strings.EqualFold(strings.TrimSpace(t), tag) {
+						filtered = append(filtered, recipe)
+						break
+					}
+				}
+			}
+			recipes = filtered
+		}
+
+		w.Header().Set("Content-Type", "application/epub+zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="cookbook.epub"`)
+		if err := writeEPUB(w, title, recipes, time.Now()); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_writeEPUB(t *testing.T) {
+	recipes := []*Recipe{
+		{
+			ID:   2,
+			Name: "Tuna pasta",
+			Tags: []string{"Pasta", "Seafood"},
+			Content: &RecipeContent{
+				Servings: 2,
+				Ingredients: map[string]*IngredientAmount{
+					"tuna":  {Amount: "1", Unit: "can"},
+					"pasta": {Amount: "200", Unit: "g"},
+					"Salt":  nil,
+					"salt":  {Amount: "1", Unit: "pinch"},
+				},
+				MethodLines: []string{"Cook the pasta & drain it."},
+			},
+		},
+		{
+			ID:   1,
+			Name: "Pepper halloumi shaksuka",
+			Tags: []string{"Vegetarian"},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeEPUB(buf, "Test Cookbook", recipes, time.Date(2023, 3, 10, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("unexpected error writing epub: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("epub is not a valid zip: %v", err)
+	}
+
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Errorf("expected first entry to be an uncompressed mimetype, got %s (method %d)", zr.File[0].Name, zr.File[0].Method)
+	}
+
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", f.Name, err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+
+	for _, name := range []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/nav.xhtml", "OEBPS/recipe-1.xhtml", "OEBPS/recipe-2.xhtml", "OEBPS/tags.xhtml", "OEBPS/ingredients.xhtml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected %s in epub", name)
+		}
+	}
+
+	if files["mimetype"] != "application/epub+zip" {
+		t.Errorf("unexpected mimetype %q", files["mimetype"])
+	}
+	if !strings.HasPrefix(files["OEBPS/nav.xhtml"], "<?xml") {
+		t.Errorf("expected nav.xhtml to start with an xml declaration, got %q", files["OEBPS/nav.xhtml"][:20])
+	}
+	if !strings.Contains(files["OEBPS/recipe-2.xhtml"], "Cook the pasta &amp; drain it.") {
+		t.Errorf("expected method line to be escaped in chapter, got %s", files["OEBPS/recipe-2.xhtml"])
+	}
+	if !strings.Contains(files["OEBPS/ingredients.xhtml"], `id="ingredient-tuna"`) {
+		t.Errorf("expected tuna in ingredient index, got %s", files["OEBPS/ingredients.xhtml"])
+	}
+	// tuna, pasta and salt once however many ways salt is written
+	if n := strings.Count(files["OEBPS/ingredients.xhtml"], `href="recipe-2.xhtml"`); n != 3 {
+		t.Errorf("expected the recipe under 3 index entries once each, got %d links in %s", n, files["OEBPS/ingredients.xhtml"])
+	}
+	if chapter := files["OEBPS/recipe-2.xhtml"]; strings.Count(chapter, `id="ingredient-salt"`) != 1 || !strings.Contains(chapter, `<li id="ingredient-salt-2">1 pinch <a href="ingredients.xhtml#ingredient-salt">salt</a>`) {
+		t.Errorf("expected both salts with their own ids linking to one index entry, got %s", chapter)
+	}
+	if !strings.Contains(files["OEBPS/recipe-2.xhtml"], `href="tags.xhtml#tag-seafood"`) {
+		t.Errorf("expected chapter to link to the tag index, got %s", files["OEBPS/recipe-2.xhtml"])
+	}
+}
+
+func Test_epubIngredients(t *testing.T) {
+	amount := &IngredientAmount{Amount: "1", Unit: "tsp"}
+	got := epubIngredients(map[string]*IngredientAmount{
+		"Salt":   amount,
+		"salt":   nil,
+		"salt 2": nil,
+		"!!!":    nil,
+		"???":    nil,
+		"tuna":   nil,
+	})
+
+	ids := map[string]bool{}
+	byName := map[string]*epubIngredient{}
+	for _, i := range got {
+		if ids[i.ID] {
+			t.Errorf("duplicate id %q", i.ID)
+		}
+		ids[i.ID] = true
+		byName[i.Name] = i
+		if i.ID == "ingredient-" || i.Anchor == "ingredient-" {
+			t.Errorf("empty id for %q", i.Name)
+		}
+	}
+	if len(got) != 6 {
+		t.Fatalf("expected 6 ingredients, got %d", len(got))
+	}
+
+	if byName["Salt"].ID != "ingredient-salt" || byName["salt"].ID != "ingredient-salt-2" {
+		t.Errorf("expected a counter on the second salt, got %q and %q", byName["Salt"].ID, byName["salt"].ID)
+	}
+	if byName["Salt"].Anchor != byName["salt"].Anchor {
+		t.Errorf("expected both salts to share an index entry")
+	}
+	if byName["salt 2"].ID == byName["salt"].ID {
+		t.Errorf("expected the counter not to clash with another ingredient")
+	}
+	if byName["!!!"].Anchor == byName["???"].Anchor {
+		t.Errorf("expected names with no letters not to share an index entry")
+	}
+	if byName["Salt"].Amount != amount || byName["tuna"].ID != "ingredient-tuna" {
+		t.Errorf("unexpected ingredients %+v", got)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GenerationKey is what a generated recipe depends on, the same key asked
+// for again gets the cached text rather than another paid call
+type GenerationKey struct {
+	Model         string
+	PromptVersion int
+	RecipeName    string
+	ServingSize   int
+	Dietary       string
+}
+
+// generationKey is the key for a recipe prompt, saving a new version of the
+// prompt means nothing cached for the old one is used
+func generationKey(prompt *RenderedPrompt) GenerationKey {
+	return GenerationKey{
+		Model:         recipeRequest(prompt).Model,
+		PromptVersion: prompt.Version,
+		// "Chicken  curry" and "chicken curry" are the same dish
+		RecipeName:  normalizeForKey(prompt.Data.Name),
+		ServingSize: prompt.Data.ServingSize,
+		Dietary:     normalizeForKey(prompt.Data.Dietary),
+	}
+}
+
+func normalizeForKey(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// Hash is the key the cache is stored under
+func (k GenerationKey) Hash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s\x00%d\x00%s", k.Model, k.PromptVersion, k.RecipeName, k.ServingSize, k.Dietary)))
+	return hex.EncodeToString(sum[:])
+}
+
+type CachedGeneration struct {
+	GenerationKey
+	Text      string
+	Usage     *LLMUsage
+	CreatedAt time.Time
+	Hits      int
+}
+
+func getCachedGeneration(db *sql.DB, key GenerationKey) (*CachedGeneration, error) {
+	c := &CachedGeneration{GenerationKey: key, Usage: &LLMUsage{Task: usageTaskRecipe}}
+	var createdAt string
+	err := db.QueryRow("SELECT text, model, prompt_tokens, completion_tokens, created_at, hits FROM generation_cache WHERE key = ?", key.Hash()).
+		Scan(&c.Text, &c.Usage.Model, &c.Usage.PromptTokens, &c.Usage.CompletionTokens, &createdAt, &c.Hits)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get cached generation: %w", err)
+	}
+	c.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return c, nil
+}
+
+// cacheGeneration stores the text of a generated recipe, replacing what was
+// cached for the key before so forcing a fresh one also refreshes the cache
+func cacheGeneration(db *sql.DB, recipe *Recipe, prompt *RenderedPrompt, usage *LLMUsage, now time.Time) error {
+	if recipe.RecipeText == "" {
+		return nil
+	}
+	if usage == nil {
+		usage = &LLMUsage{}
+	}
+	key := generationKey(prompt)
+	if _, err := db.Exec(`
+INSERT OR REPLACE INTO generation_cache(key, model, prompt_version, recipe_name, serving_size, dietary, text, prompt_tokens, completion_tokens, created_at)
+values(?,?,?,?,?,?,?,?,?,?)`, key.Hash(), key.Model, key.PromptVersion, key.RecipeName, key.ServingSize, key.Dietary, recipe.RecipeText,
+		usage.PromptTokens, usage.CompletionTokens, now.UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("unable to cache generation: %w", err)
+	}
+	return nil
+}
+
+// fromGenerationCache fills in the recipe from the cache and reports
+// whether it could. fresh skips the cache, every lookup is counted towards
+// the stats either way.
+func fromGenerationCache(db *sql.DB, recipe *Recipe, prompt *RenderedPrompt, fresh bool, now time.Time) (bool, error) {
+	if fresh {
+		return false, countCacheLookup(db, "fresh", 0, now)
+	}
+
+	key := generationKey(prompt)
+	cached, err := getCachedGeneration(db, key)
+	if err != nil {
+		return false, err
+	}
+	if cached == nil {
+		return false, countCacheLookup(db, "misses", 0, now)
+	}
+
+	if _, err := db.Exec("UPDATE generation_cache SET hits = hits + 1, last_hit_at = ? WHERE key = ?", now.UTC().Format(time.RFC3339), key.Hash()); err != nil {
+		return false, fmt.Errorf("unable to count cache hit: %w", err)
+	}
+	recipe.RecipeText = cached.Text
+	recipe.Model, recipe.PromptVersion = cached.Usage.Model, key.PromptVersion
+	parseRecipeText(recipe, key.ServingSize)
+	return true, countCacheLookup(db, "hits", cached.Usage.Cost(modelPrices), now)
+}
+
+// countCacheLookup adds to the day's hits, misses or fresh count, saved is
+// what the call a hit avoided would have cost
+func countCacheLookup(db *sql.DB, column string, saved Micros, now time.Time) error {
+	if _, err := db.Exec(fmt.Sprintf(`
+INSERT INTO generation_cache_stats(day, %[1]s, saved_micros) values(?, 1, ?)
+ON CONFLICT(day) DO UPDATE SET %[1]s = %[1]s + 1, saved_micros = saved_micros + excluded.saved_micros`, column),
+		now.UTC().Format("2006-01-02"), int64(saved)); err != nil {
+		return fmt.Errorf("unable to count cache lookup: %w", err)
+	}
+	return nil
+}
+
+type CacheStats struct {
+	Hits    int
+	Misses  int
+	Fresh   int
+	Saved   Micros
+	Entries int
+}
+
+// HitRate is the share of lookups that used the cache, fresh generations
+// didn't look so they aren't counted
+func (s CacheStats) HitRate() int {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return 100 * s.Hits / (s.Hits + s.Misses)
+}
+
+func getCacheStats(db *sql.DB, from time.Time) (CacheStats, error) {
+	var s CacheStats
+	var saved int64
+	if err := db.QueryRow("SELECT COALESCE(SUM(hits), 0), COALESCE(SUM(misses), 0), COALESCE(SUM(fresh), 0), COALESCE(SUM(saved_micros), 0) FROM generation_cache_stats WHERE day >= ?",
+		from.UTC().Format("2006-01-02")).Scan(&s.Hits, &s.Misses, &s.Fresh, &saved); err != nil {
+		return s, fmt.Errorf("unable to get cache stats: %w", err)
+	}
+	s.Saved = Micros(saved)
+	if err := db.QueryRow("SELECT COUNT(*) FROM generation_cache").Scan(&s.Entries); err != nil {
+		return s, fmt.Errorf("unable to count cache entries: %w", err)
+	}
+	return s, nil
+}
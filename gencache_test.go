@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func Test_generationKey(t *testing.T) {
+	key := func(name string, servingSize int, dietary string) string {
+		return generationKey(&RenderedPrompt{Version: 1, Data: PromptData{Name: name, ServingSize: servingSize, Dietary: dietary}}).Hash()
+	}
+	base := key("Chicken Curry", 4, "")
+	tests := []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{"case and spacing don't matter", key("  chicken   CURRY ", 4, ""), true},
+		{"serving size", key("Chicken Curry", 8, ""), false},
+		{"name", key("Chicken Korma", 4, ""), false},
+		{"dietary requirements", key("Chicken Curry", 4, "no nuts"), false},
+		{"prompt version", generationKey(&RenderedPrompt{Version: 2, Data: PromptData{Name: "Chicken Curry", ServingSize: 4}}).Hash(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key == base; got != tt.same {
+				t.Errorf("expected same key to be %v", tt.same)
+			}
+		})
+	}
+}
@@ -4,17 +4,19 @@ go 1.18
 
 require (
 	github.com/PullRequestInc/go-gpt3 v1.1.13
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/sashabaranov/go-openai v1.11.2
 	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.9.0
+	golang.org/x/term v0.10.0
 )
 
-require golang.org/x/net v0.7.0 // indirect
+require golang.org/x/net v0.10.0 // indirect
 
 require (
 	github.com/dlclark/regexp2 v1.8.1 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/lib/pq v1.10.9 // indirect
-	github.com/mattn/go-sqlite3 v1.14.17 // indirect
 	github.com/pkoukk/tiktoken-go v0.1.3 // indirect
-	github.com/sashabaranov/go-openai v1.11.2 // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
 )
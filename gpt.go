@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
 	"regexp"
 	"strings"
 	"time"
@@ -13,86 +14,186 @@ import (
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// client is replaced in main once the provider has been read from the
+// environment
 var (
-	client = openai.NewClient(os.Getenv("OPENAI_KEY"))
+	client = newLLMClient(llmProvider.ClientConfig())
 )
 
-func generateTags(recipe *Recipe, overrideTags bool) error {
-	resp, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
-		Model: openai.GPT3Dot5Turbo,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: "You are a data tagger for a global food entertainment brand. Your role is to read recipe titles/links and, using your exhaustive knowledge of food, provide ten tags for the recipe as a json string array. It can include cuisine, ingredients, cooking method, etc. For example, if you were given the recipe title “Chicken Tikka Masala”, you would return [“Indian”, “Chicken”, “Curry”]. Bias towrads ingredients making up the bulk of the tags, if the recipe is suitable for lunch then always include a lunch tag",
-			},
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: recipe.Name,
-			},
-		},
+// how long one attempt at each call can take before it's retried
+const (
+	tagsTimeout   = 20 * time.Second
+	recipeTimeout = 60 * time.Second
+)
+
+// LLMUsage is what one call to the API used, it's returned even when the
+// answer couldn't be used as the tokens were still paid for
+type LLMUsage struct {
+	Task             string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+func usageFrom(task string, resp openai.ChatCompletionResponse) *LLMUsage {
+	return &LLMUsage{
+		Task:             task,
+		Model:            resp.Model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}
+}
+
+// generateTags asks for tags for the recipe with a rendered tags prompt
+func generateTags(recipe *Recipe, prompt *RenderedPrompt, overrideTags bool) (*LLMUsage, error) {
+	resp, err := client.CreateChatCompletion(context.Background(), tagsTimeout, openai.ChatCompletionRequest{
+		Model:    llmProvider.Model(usageTaskTags),
+		Messages: prompt.Messages(),
 	})
 	if err != nil {
-		return fmt.Errorf("error calling openai: %w", err)
+		return nil, fmt.Errorf("error calling openai: %w", err)
 	}
+	usage := usageFrom(usageTaskTags, resp)
 
 	tagsString := resp.Choices[0].Message.Content
 
 	tags := []string{}
 	err = json.Unmarshal([]byte(tagsString), &tags)
 	if err != nil {
-		return fmt.Errorf("error unmarshalling tags '%s': %+v", tagsString, err)
+		return usage, fmt.Errorf("error unmarshalling tags '%s': %+v", tagsString, err)
+	}
+
+	// the model doesn't always stick to the vocabulary
+	tags, dropped := tagTaxonomy.Normalize(tags)
+	if len(dropped) > 0 {
+		fmt.Printf("dropped tags that aren't in the taxonomy for %s: %v\n", recipe.Name, dropped)
 	}
 
 	if overrideTags {
 		recipe.Tags = tags
 	} else {
-		recipe.Tags = append(recipe.Tags, tags...)
+		recipe.Tags = mergeTags(recipe.Tags, tags)
 	}
 
-	return nil
+	return usage, nil
 }
 
-func generateRecipe(recipe *Recipe, servingSize int) (*Recipe, error) {
-	ctx, cancelFunc := context.WithDeadline(context.Background(), time.Now().Add(60*time.Second))
-	defer cancelFunc()
-
-	resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-		Model: openai.GPT3Dot5Turbo,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role: openai.ChatMessageRoleSystem,
-				Content: `
-Think carefully about this.
-You are a personal chef with extensive experience in the home cooking space.
-You are tasked with creating a recipe for a new dish.
-You are given a title and a serving size. 
-You must create a recipe that is suitable for the given serving size.
-The output will be comprised of the following sections: Serving Size, Ingredients, Instructions, Serving/Presentation Suggestions, Modifications.
-Suggestions and Modifications will contain at least three entry lines each.
-Include line breaks in your recipe to separate the different sections/paragraphs/lines.
-Be careful with ingredient formatting, some examples: "1 cup : flour" is "250g : flour", "1tsp : salt" is "1tsp : salt" (no change), "1/2 cup : sugar" is "125g : sugar", "1/2 tsp : salt" is "1/2 tsp : salt" (no change).
-All units are in metric but tsp/tbsp is okay. Ingredients always have a name prefixed by a number and a unit. The unit is always singular. The number is always a whole number or a decimal to a maximum of 2 decimal places. The number and unit are separated by a space. The name is always lowercase. The number and unit are always lowercase. The number and unit are always separated by a space. If the ingredient has a quantity the name is always separated from the number and unit by an exclamation mark.
-When cooking large pieces of meat include temperature targets. For example, "cook until the internal temperature reaches 70C".
-				`,
-			},
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: fmt.Sprintf("%s %d", recipe.Name, servingSize),
-			},
-		},
+// generateIngredientClasses asks what ingredients the rule table doesn't
+// know contain, with a rendered allergens prompt. Ingredients the model
+// didn't answer for are left out.
+func generateIngredientClasses(names []string, prompt *RenderedPrompt) (map[string]IngredientClass, *LLMUsage, error) {
+	resp, err := client.CreateChatCompletion(context.Background(), tagsTimeout, openai.ChatCompletionRequest{
+		Model:    llmProvider.Model(usageTaskAllergens),
+		Messages: prompt.Messages(),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("error calling openai: %w", err)
+		return nil, nil, fmt.Errorf("error calling openai: %w", err)
+	}
+	usage := usageFrom(usageTaskAllergens, resp)
+
+	answer := resp.Choices[0].Message.Content
+	if start, end := strings.Index(answer, "{"), strings.LastIndex(answer, "}"); start >= 0 && end > start {
+		answer = answer[start : end+1]
+	}
+	given := map[string]IngredientClass{}
+	if err := json.Unmarshal([]byte(answer), &given); err != nil {
+		return nil, usage, fmt.Errorf("error unmarshalling allergens '%s': %+v", answer, err)
+	}
+
+	byKey := map[string]IngredientClass{}
+	for name, class := range given {
+		byKey[ingredientKey(name)] = class
+	}
+	classes := map[string]IngredientClass{}
+	for _, name := range names {
+		if class, ok := byKey[ingredientKey(name)]; ok {
+			classes[name] = cleanIngredientClass(class)
+		}
+	}
+	return classes, usage, nil
+}
+
+// Messages are the system and user messages of the prompt
+func (p *RenderedPrompt) Messages() []openai.ChatCompletionMessage {
+	return []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: p.System},
+		{Role: openai.ChatMessageRoleUser, Content: p.User},
+	}
+}
+
+// recipeRequest is the request recipes are generated with
+func recipeRequest(prompt *RenderedPrompt) openai.ChatCompletionRequest {
+	return openai.ChatCompletionRequest{
+		Model:    llmProvider.Model(usageTaskRecipe),
+		Messages: prompt.Messages(),
+	}
+}
+
+// generateRecipe fills in the recipe from a rendered recipe prompt, it
+// records the model and prompt version the text came from
+func generateRecipe(recipe *Recipe, servingSize int, prompt *RenderedPrompt) (*Recipe, *LLMUsage, error) {
+	resp, err := client.CreateChatCompletion(context.Background(), recipeTimeout, recipeRequest(prompt))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error calling openai: %w", err)
 	}
 
 	newRecipeVersion := recipe
 	newRecipeVersion.Version = recipe.Version
 	newRecipeVersion.RecipeText = resp.Choices[0].Message.Content
+	newRecipeVersion.Model, newRecipeVersion.PromptVersion = resp.Model, prompt.Version
 	parseRecipeText(newRecipeVersion, servingSize)
 
 	fmt.Printf("generated recipe content: %+v", newRecipeVersion.Content)
 
-	return newRecipeVersion, nil
+	return newRecipeVersion, usageFrom(usageTaskRecipe, resp), nil
+}
+
+// streamRecipe generates a recipe like generateRecipe but hands each piece
+// of text to onDelta as it arrives. Cancelling ctx stops the stream, the
+// usage so far is still returned with the error as it's still paid for.
+func streamRecipe(ctx context.Context, recipe *Recipe, servingSize int, prompt *RenderedPrompt, onDelta func(string) error) (*Recipe, *LLMUsage, error) {
+	req := recipeRequest(prompt)
+	stream, err := client.CreateChatCompletionStream(ctx, recipeTimeout, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error calling openai: %w", err)
+	}
+	defer stream.Close()
+
+	// streams don't report usage, each chunk is about a token and prompts
+	// are about four characters a token
+	usage := &LLMUsage{Task: usageTaskRecipe, Model: req.Model}
+	for _, m := range req.Messages {
+		usage.PromptTokens += (len(m.Content) + 3) / 4
+	}
+
+	var text strings.Builder
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, usage, fmt.Errorf("error reading from openai: %w", err)
+		}
+		if resp.Model != "" {
+			usage.Model = resp.Model
+		}
+		for _, choice := range resp.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			usage.CompletionTokens++
+			text.WriteString(choice.Delta.Content)
+			if err := onDelta(choice.Delta.Content); err != nil {
+				return nil, usage, err
+			}
+		}
+	}
+
+	recipe.RecipeText = text.String()
+	recipe.Model, recipe.PromptVersion = usage.Model, prompt.Version
+	parseRecipeText(recipe, servingSize)
+	return recipe, usage, nil
 }
 
 func parseRecipeText(recipe *Recipe, servingSize int) {
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultHouseholdID is the household everything from before households
+// existed belongs to, new users join it until an admin moves them
+const defaultHouseholdID = 1
+
+type Household struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func getHouseholds(db *sql.DB) ([]*Household, error) {
+	rows, err := db.Query("SELECT id, name FROM households ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query households: %w", err)
+	}
+	defer rows.Close()
+
+	households := []*Household{}
+	for rows.Next() {
+		h := &Household{}
+		if err := rows.Scan(&h.ID, &h.Name); err != nil {
+			return nil, fmt.Errorf("unable to scan household: %w", err)
+		}
+		households = append(households, h)
+	}
+	return households, rows.Err()
+}
+
+// getHouseholdByName returns the household or nil if there isn't one
+func getHouseholdByName(db *sql.DB, name string) (*Household, error) {
+	h := &Household{}
+	err := db.QueryRow("SELECT id, name FROM households WHERE name = ?", name).Scan(&h.ID, &h.Name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get household: %w", err)
+	}
+	return h, nil
+}
+
+func insertHousehold(db *sql.DB, name string) (*Household, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("household name must not be empty")
+	}
+	res, err := db.Exec("INSERT INTO households(name) values(?)", name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert household %s: %w", name, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read household id: %w", err)
+	}
+	return &Household{ID: int(id), Name: name}, nil
+}
+
+// setUserHousehold moves a user, they see the new household's recipes and
+// plans straight away since the household is read on every request
+func setUserHousehold(db *sql.DB, username string, householdID int) error {
+	res, err := db.Exec("UPDATE users SET household_id = ? WHERE username = ? AND EXISTS (SELECT 1 FROM households WHERE id = ?)", householdID, username, householdID)
+	if err != nil {
+		return fmt.Errorf("unable to update household for %s: %w", username, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user %s or household %d", username, householdID)
+	}
+	return nil
+}
+
+// getRecipeShares returns the households a recipe has been shared with
+func getRecipeShares(db *sql.DB, recipeID int) ([]*Household, error) {
+	rows, err := db.Query(`
+SELECT h.id, h.name FROM recipe_shares s JOIN households h ON h.id = s.household_id
+WHERE s.recipe_id = ? ORDER BY h.name`, recipeID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query recipe shares: %w", err)
+	}
+	defer rows.Close()
+
+	households := []*Household{}
+	for rows.Next() {
+		h := &Household{}
+		if err := rows.Scan(&h.ID, &h.Name); err != nil {
+			return nil, fmt.Errorf("unable to scan recipe share: %w", err)
+		}
+		households = append(households, h)
+	}
+	return households, rows.Err()
+}
+
+// recipeLineage selects the ID of every version of the recipe with the ID
+// given as its argument, walking up to the first version and back down
+const recipeLineage = `
+WITH RECURSIVE
+    up(id, parent_id) AS (
+        SELECT id, parent_id FROM recipes WHERE id = ?
+        UNION SELECT r.id, r.parent_id FROM recipes r JOIN up ON r.id = up.parent_id
+    ),
+    down(id) AS (
+        SELECT id FROM up WHERE parent_id IS NULL OR parent_id = 0
+        UNION SELECT r.id FROM recipes r JOIN down ON r.parent_id = down.id
+    )
+SELECT id FROM down`
+
+// shareRecipe lets another household view every version of a recipe, only
+// the household that owns it can share it and new versions stay shared
+func shareRecipe(db *sql.DB, ownerID, recipeID, householdID int) error {
+	if householdID == ownerID {
+		return fmt.Errorf("a recipe can't be shared with its own household")
+	}
+	res, err := db.Exec(`
+INSERT OR IGNORE INTO recipe_shares(recipe_id, household_id)
+SELECT r.id, h.id FROM recipes r, households h
+WHERE r.id IN (`+recipeLineage+`) AND r.household_id = ? AND h.id = ?`, recipeID, ownerID, householdID)
+	if err != nil {
+		return fmt.Errorf("unable to share recipe: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if shares, _ := getRecipeShares(db, recipeID); containsHousehold(shares, householdID) {
+			return nil
+		}
+		return fmt.Errorf("no such recipe %d or household %d", recipeID, householdID)
+	}
+	return nil
+}
+
+func unshareRecipe(db *sql.DB, ownerID, recipeID, householdID int) error {
+	if _, err := db.Exec(`
+DELETE FROM recipe_shares WHERE household_id = ?
+AND recipe_id IN (`+recipeLineage+`)
+AND recipe_id IN (SELECT id FROM recipes WHERE household_id = ?)`, householdID, recipeID, ownerID); err != nil {
+		return fmt.Errorf("unable to unshare recipe: %w", err)
+	}
+	return nil
+}
+
+func containsHousehold(households []*Household, id int) bool {
+	for _, h := range households {
+		if h.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// shareRecipeHandler handles the share form on recipe.html
+func shareRecipeHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error parsing form: %v", err)
+			return
+		}
+
+		user := requestUser(r)
+		recipeID, err := strconv.Atoi(r.PostFormValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: recipe ID must be an integer")
+			return
+		}
+		householdID, err := strconv.Atoi(r.PostFormValue("household_id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: household ID must be an integer")
+			return
+		}
+
+		recipe, err := getRecipeByID(db, user.HouseholdID, recipeID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if recipe == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: recipe not found")
+			return
+		}
+		if recipe.Shared {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "forbidden: this recipe was shared with your household, only its owners can share it")
+			return
+		}
+
+		switch r.PostFormValue("action") {
+		case "share":
+			err = shareRecipe(db, user.HouseholdID, recipeID, householdID)
+		case "unshare":
+			err = unshareRecipe(db, user.HouseholdID, recipeID, householdID)
+		default:
+			err = fmt.Errorf("unknown action %q", r.PostFormValue("action"))
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		servings := 2
+		if recipe.Content != nil && recipe.Content.Servings > 0 {
+			servings = recipe.Content.Servings
+		}
+		http.Redirect(w, r, fmt.Sprintf("/recipe?id=%d&serving_size=%d", recipeID, servings), http.StatusSeeOther)
+	}
+}
+
+const householdUsage = `usage:
+  household add <name>               create a household
+  household list                     list households and their members
+  household move <username> <name>   move a user into a household`
+
+// runHouseholdCommand handles `food-archive household ...`
+func runHouseholdCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(householdUsage)
+	}
+
+	switch {
+	case args[0] == "add" && len(args) == 2:
+		h, err := insertHousehold(db, args[1])
+		if err != nil {
+			return err
+		}
+		auditCommand(db, auditHouseholdAdded, "", h.Name)
+		fmt.Printf("added household %s\n", h.Name)
+	case args[0] == "list" && len(args) == 1:
+		households, err := getHouseholds(db)
+		if err != nil {
+			return err
+		}
+		users, err := getUsers(db)
+		if err != nil {
+			return err
+		}
+		for _, h := range households {
+			members := []string{}
+			for _, u := range users {
+				if u.HouseholdID == h.ID {
+					members = append(members, u.Username)
+				}
+			}
+			fmt.Printf("%s\t%s\n", h.Name, strings.Join(members, ", "))
+		}
+	case args[0] == "move" && len(args) == 3:
+		h, err := getHouseholdByName(db, args[2])
+		if err != nil {
+			return err
+		}
+		if h == nil {
+			return fmt.Errorf("no such household %s", args[2])
+		}
+		if err := setUserHousehold(db, args[1], h.ID); err != nil {
+			return err
+		}
+		auditCommand(db, auditHouseholdMoved, args[1], fmt.Sprintf("moved %s to %s", args[1], h.Name))
+		fmt.Printf("moved %s to %s\n", args[1], h.Name)
+	default:
+		return errors.New(householdUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func Test_recipeSharing(t *testing.T) {
+	db := newTestDB(t)
+
+	flat, err := insertHousehold(db, "Flat 2")
+	if err != nil {
+		t.Fatalf("unable to add household: %v", err)
+	}
+
+	soup, err := insertRecipeVersion(db, &Recipe{Name: "Soup", HouseholdID: defaultHouseholdID})
+	if err != nil {
+		t.Fatalf("unable to insert recipe: %v", err)
+	}
+	if _, err := insertRecipeVersion(db, &Recipe{Name: "Stew", HouseholdID: flat.ID}); err != nil {
+		t.Fatalf("unable to insert recipe: %v", err)
+	}
+
+	names := func(householdID int) map[string]bool {
+		recipes, err := getAllRecipeMeta(db, householdID)
+		if err != nil {
+			t.Fatalf("unable to get recipes: %v", err)
+		}
+		names := map[string]bool{}
+		for _, r := range recipes {
+			names[r.Name] = r.Shared
+		}
+		return names
+	}
+
+	if got := names(flat.ID); len(got) != 1 || !containsKey(got, "Stew") {
+		t.Errorf("expected flat 2 to only see its own recipe, got %v", got)
+	}
+	if r, _ := getRecipeByID(db, flat.ID, soup.ID); r != nil {
+		t.Errorf("expected soup to be hidden from flat 2")
+	}
+
+	if err := shareRecipe(db, flat.ID, soup.ID, flat.ID); err == nil {
+		t.Errorf("expected only the owning household to be able to share")
+	}
+	if err := shareRecipe(db, defaultHouseholdID, soup.ID, flat.ID); err != nil {
+		t.Fatalf("unable to share recipe: %v", err)
+	}
+
+	// new versions stay shared and replace the old one in the list
+	soup.Version = 1
+	soup2, err := insertRecipeVersion(db, soup)
+	if err != nil {
+		t.Fatalf("unable to insert new version: %v", err)
+	}
+	got := names(flat.ID)
+	if len(got) != 2 || !got["Soup"] || got["Stew"] {
+		t.Errorf("expected flat 2 to see stew and a shared soup, got %v", got)
+	}
+	r, err := getRecipeByID(db, flat.ID, soup2.ID)
+	if err != nil || r == nil || !r.Shared || r.HouseholdID != defaultHouseholdID {
+		t.Errorf("expected new soup version to be shared read only, got %+v %v", r, err)
+	}
+
+	if err := unshareRecipe(db, defaultHouseholdID, soup2.ID, flat.ID); err != nil {
+		t.Fatalf("unable to unshare recipe: %v", err)
+	}
+	if got := names(flat.ID); containsKey(got, "Soup") {
+		t.Errorf("expected every version of soup to be hidden again after unsharing, got %v", got)
+	}
+}
+
+func containsKey(m map[string]bool, k string) bool {
+	_, ok := m[k]
+	return ok
+}
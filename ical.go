@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mealTimes are when each meal shows up in a calendar, they are floating
+// times so the calendar app puts them in whatever zone the kitchen is in
+var mealTimes = map[string]struct{ Hour, Minute int }{
+	"breakfast": {8, 0},
+	"lunch":     {12, 30},
+	"dinner":    {18, 30},
+}
+
+const mealDuration = time.Hour
+
+// getCalendarToken returns the user's calendar feed token, creating one the
+// first time it's asked for
+func getCalendarToken(db *sql.DB, username string) (string, error) {
+	var token string
+	err := db.QueryRow("SELECT token FROM calendar_tokens WHERE username = ?", username).Scan(&token)
+	if err == nil {
+		return token, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", fmt.Errorf("unable to get calendar token: %w", err)
+	}
+	return resetCalendarToken(db, username)
+}
+
+// resetCalendarToken replaces the user's token, any calendar subscribed with
+// the old one stops updating
+func resetCalendarToken(db *sql.DB, username string) (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate calendar token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+
+	if _, err := db.Exec("INSERT OR REPLACE INTO calendar_tokens(username, token) values(?,?)", username, token); err != nil {
+		return "", fmt.Errorf("unable to store calendar token: %w", err)
+	}
+	return token, nil
+}
+
+// calendarTokenUser returns the user a calendar token belongs to, or nil if
+// it doesn't belong to anyone
+func calendarTokenUser(db *sql.DB, token string) (*User, error) {
+	if token == "" {
+		return nil, nil
+	}
+	var stored string
+	user, err := scanUser(db.QueryRow(`
+SELECT `+userColumns+`, c.token
+FROM calendar_tokens c JOIN users u ON u.username = c.username
+WHERE c.token = ?`, token), &stored)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to check calendar token: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(token)) != 1 {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// icsEscape escapes TEXT values as described in RFC 5545 section 3.3.11
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// writeICSLine writes a content line, folding it so no line is longer than
+// 75 octets without splitting a multi-byte character
+func writeICSLine(w io.Writer, line string) {
+	// continuation lines start with a space which counts towards the limit
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		fmt.Fprintf(w, "%s\r\n ", line[:cut])
+		line = line[cut:]
+		limit = 74
+	}
+	fmt.Fprintf(w, "%s\r\n", line)
+}
+
+// writeICS writes the plan as a calendar with one VEVENT per planned meal,
+// baseURL is used to link each event back to its recipe
+func writeICS(w io.Writer, plan *MealPlan, baseURL string, now time.Time) {
+	writeICSLine(w, "BEGIN:VCALENDAR")
+	writeICSLine(w, "VERSION:2.0")
+	writeICSLine(w, "PRODID:-//food-archive//meal plans//EN")
+	writeICSLine(w, "CALSCALE:GREGORIAN")
+	writeICSLine(w, "METHOD:PUBLISH")
+	writeICSLine(w, "X-WR-CALNAME:"+icsEscape(plan.Name))
+
+	host := strings.TrimPrefix(strings.TrimPrefix(baseURL, "https://"), "http://")
+	for _, slot := range plan.Slots {
+		day, err := time.Parse(planDateFormat, slot.Date)
+		if err != nil {
+			continue
+		}
+		t := mealTimes[slot.Meal]
+		start := time.Date(day.Year(), day.Month(), day.Day(), t.Hour, t.Minute, 0, 0, time.UTC)
+		link := fmt.Sprintf("%s/recipe?id=%d&serving_size=%d", baseURL, slot.RecipeID, slot.Servings)
+
+		writeICSLine(w, "BEGIN:VEVENT")
+		writeICSLine(w, fmt.Sprintf("UID:meal-slot-%d@%s", slot.ID, host))
+		writeICSLine(w, "DTSTAMP:"+now.UTC().Format("20060102T150405Z"))
+		writeICSLine(w, "DTSTART:"+start.Format("20060102T150405"))
+		writeICSLine(w, "DTEND:"+start.Add(mealDuration).Format("20060102T150405"))
+		writeICSLine(w, "SUMMARY:"+icsEscape(fmt.Sprintf("%s: %s", strings.ToUpper(slot.Meal[:1])+slot.Meal[1:], slot.RecipeName)))
+		writeICSLine(w, "DESCRIPTION:"+icsEscape(fmt.Sprintf("Serves %d\n%s", slot.Servings, link)))
+		writeICSLine(w, "URL:"+link)
+		writeICSLine(w, "END:VEVENT")
+	}
+
+	writeICSLine(w, "END:VCALENDAR")
+}
+
+// publicBaseURL is where the site is reached from outside, set from
+// BASE_URL in main. Links that leave the site are built on it rather than
+// whatever Host the request claims.
+var publicBaseURL string
+
+// parseBaseURL checks BASE_URL is just a scheme and host, trailing slash
+// optional
+func parseBaseURL(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("BASE_URL isn't a url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("BASE_URL should look like https://food.example.com, got %q", value)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// requestBaseURL is the scheme and host the site is reached on, BASE_URL
+// when it's set. Otherwise it's the host the request came in on and fly
+// terminates tls for us, so behind its proxy the forwarded header says
+// whether that was https.
+func requestBaseURL(r *http.Request) string {
+	if publicBaseURL != "" {
+		return publicBaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil || (behindFlyProxy && r.Header.Get("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// mealPlanICS serves a plan as an iCalendar feed. Calendar apps can't do
+// basic auth so this sits outside of it and checks the token in the URL.
+func mealPlanICS(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		user, err := calendarTokenUser(db, r.URL.Query().Get("token"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if user == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: calendar not found")
+			return
+		}
+
+		planID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: plan ID must be an integer")
+			return
+		}
+
+		plan, err := getMealPlan(db, user.HouseholdID, planID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error getting meal plan: %v", err)
+			return
+		}
+		if plan == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: calendar not found")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="plan-%d.ics"`, plan.ID))
+		writeICS(w, plan, requestBaseURL(r), time.Now())
+	}
+}
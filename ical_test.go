@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func Test_icsEscape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Toast", "Toast"},
+		{"Salt, pepper; oil", `Salt\, pepper\; oil`},
+		{`C:\recipes`, `C:\\recipes`},
+		{"one\ntwo\r\nthree", `one\ntwo\nthree`},
+		{`\,`, `\\\,`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := icsEscape(tt.in); got != tt.want {
+				t.Errorf("icsEscape(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_writeICSLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"short", "SUMMARY:Dinner"},
+		{"exactly 75", "SUMMARY:" + strings.Repeat("a", 67)},
+		{"76", "SUMMARY:" + strings.Repeat("a", 68)},
+		{"several folds", "DESCRIPTION:" + strings.Repeat("abcdefghij", 20)},
+		{"multi-byte", "SUMMARY:" + strings.Repeat("crème brûlée ", 12)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeICSLine(&buf, tt.line)
+			out := buf.String()
+
+			if !strings.HasSuffix(out, "\r\n") {
+				t.Fatalf("expected the line to end with CRLF, got %q", out)
+			}
+			lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+			for i, l := range lines {
+				if len(l) > 75 {
+					t.Errorf("line %d is %d octets: %q", i, len(l), l)
+				}
+				if i > 0 && !strings.HasPrefix(l, " ") {
+					t.Errorf("continuation line %d doesn't start with a space: %q", i, l)
+				}
+				if !utf8.ValidString(l) {
+					t.Errorf("line %d splits a character: %q", i, l)
+				}
+			}
+			if len(tt.line) <= 75 && len(lines) != 1 {
+				t.Errorf("expected %d octets not to be folded, got %d lines", len(tt.line), len(lines))
+			}
+			if got := strings.ReplaceAll(strings.TrimSuffix(out, "\r\n"), "\r\n ", ""); got != tt.line {
+				t.Errorf("unfolded = %q, want %q", got, tt.line)
+			}
+		})
+	}
+}
+
+func Test_writeICS(t *testing.T) {
+	plan := &MealPlan{Name: "Week, one", StartDate: "2024-03-04", Slots: []*MealSlot{
+		{ID: 7, Date: "2024-03-05", Meal: "dinner", RecipeID: 3, RecipeName: "Fish; chips, and peas", Servings: 2},
+		{ID: 8, Date: "not a date", Meal: "lunch", RecipeID: 4, RecipeName: "Skipped", Servings: 1},
+	}}
+	var buf bytes.Buffer
+	writeICS(&buf, plan, "https://food.example.com", time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	out := strings.ReplaceAll(buf.String(), "\r\n ", "")
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"X-WR-CALNAME:Week\\, one\r\n",
+		"UID:meal-slot-7@food.example.com\r\n",
+		"DTSTAMP:20240301T090000Z\r\n",
+		"DTSTART:20240305T183000\r\n",
+		"DTEND:20240305T193000\r\n",
+		"SUMMARY:Dinner: Fish\\; chips\\, and peas\r\n",
+		"DESCRIPTION:Serves 2\\nhttps://food.example.com/recipe?id=3&serving_size=2\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "BEGIN:VEVENT") != 1 {
+		t.Errorf("expected the slot with a bad date to be left out")
+	}
+}
+
+func Test_mealPlanICS_token(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "alice", "secret", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	plan := &MealPlan{HouseholdID: defaultHouseholdID, Name: "Week", StartDate: "2024-03-04"}
+	if err := insertMealPlan(db, plan); err != nil {
+		t.Fatal(err)
+	}
+	token, err := getCalendarToken(db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := getCalendarToken(db, "alice"); again != token {
+		t.Errorf("expected the same token until it's reset")
+	}
+
+	get := func(token string, planID int) int {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/plans/calendar.ics?id="+strconv.Itoa(planID)+"&token="+token, nil)
+		mealPlanICS(db).ServeHTTP(res, req)
+		return res.Code
+	}
+
+	if code := get(token, plan.ID); code != http.StatusOK {
+		t.Errorf("valid token = %d, want 200", code)
+	}
+	if code := get("", plan.ID); code != http.StatusNotFound {
+		t.Errorf("no token = %d, want 404", code)
+	}
+	if code := get(token[:len(token)-1]+"x", plan.ID); code != http.StatusNotFound {
+		t.Errorf("wrong token = %d, want 404", code)
+	}
+	if code := get(token, plan.ID+1); code != http.StatusNotFound {
+		t.Errorf("unknown plan = %d, want 404", code)
+	}
+
+	reset, err := resetCalendarToken(db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(token, plan.ID); code != http.StatusNotFound {
+		t.Errorf("old token after reset = %d, want 404", code)
+	}
+	if code := get(reset, plan.ID); code != http.StatusOK {
+		t.Errorf("new token after reset = %d, want 200", code)
+	}
+}
+
+func Test_requestBaseURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		onFly   bool
+		proto   string
+		want    string
+	}{
+		{"plain", "", false, "", "http://food.example.com"},
+		{"forwarded proto ignored off fly", "", false, "https", "http://food.example.com"},
+		{"forwarded proto on fly", "", true, "https", "https://food.example.com"},
+		{"base url", "https://recipes.example.org", false, "", "https://recipes.example.org"},
+		{"base url over the request", "http://localhost:8080", true, "https", "http://localhost:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(base string, onFly bool) { publicBaseURL, behindFlyProxy = base, onFly }(publicBaseURL, behindFlyProxy)
+			publicBaseURL, behindFlyProxy = tt.baseURL, tt.onFly
+
+			r := httptest.NewRequest(http.MethodGet, "http://food.example.com/plans", nil)
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if got := requestBaseURL(r); got != tt.want {
+				t.Errorf("requestBaseURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseBaseURL(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"https://food.example.com", "https://food.example.com", false},
+		{"https://food.example.com/", "https://food.example.com", false},
+		{"http://localhost:8080", "http://localhost:8080", false},
+		{"food.example.com", "", true},
+		{"ftp://food.example.com", "", true},
+		{"https://food.example.com/recipes", "", true},
+		{"https://food.example.com?x=1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseBaseURL(tt.value)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseBaseURL(%q) = %q, %v, want %q, error %v", tt.value, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Generation jobs go queued -> running -> done or failed. Jobs still
+// running when the process stops are queued again when it starts.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// jobPollInterval is how often idle workers look for jobs they weren't woken
+// for, and how often the status page refreshes
+const jobPollInterval = 2 * time.Second
+
+type GenerationJob struct {
+	ID          int    `json:"id"`
+	RecipeID    int    `json:"recipe_id"`
+	ServingSize int    `json:"serving_size"`
+	HouseholdID int    `json:"-"`
+	UserID      int    `json:"-"`
+	Status      string `json:"status"`
+	// Fresh skips the generation cache
+	Fresh bool `json:"fresh"`
+	// Dietary is passed to the prompt, it's empty for most jobs
+	Dietary string `json:"dietary,omitempty"`
+	// ResultID is the new recipe version once the job is done
+	ResultID   int       `json:"result_recipe_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+func (j *GenerationJob) Finished() bool {
+	return j.Status == jobDone || j.Status == jobFailed
+}
+
+const jobColumns = "id, recipe_id, serving_size, household_id, user_id, status, fresh, dietary, result_recipe_id, error, created_at, started_at, finished_at"
+
+func scanJob(row rowScanner) (*GenerationJob, error) {
+	job := &GenerationJob{}
+	var createdAt, startedAt, finishedAt string
+	if err := row.Scan(&job.ID, &job.RecipeID, &job.ServingSize, &job.HouseholdID, &job.UserID, &job.Status,
+		&job.Fresh, &job.Dietary, &job.ResultID, &job.Error, &createdAt, &startedAt, &finishedAt); err != nil {
+		return nil, err
+	}
+	job.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	job.StartedAt, _ = time.Parse(time.RFC3339, startedAt)
+	job.FinishedAt, _ = time.Parse(time.RFC3339, finishedAt)
+	return job, nil
+}
+
+// getJob returns a job the household can see, or nil
+func getJob(db *sql.DB, householdID, id int) (*GenerationJob, error) {
+	job, err := scanJob(db.QueryRow("SELECT "+jobColumns+" FROM generation_jobs WHERE id = ? AND household_id = ?", id, householdID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get job: %w", err)
+	}
+	return job, nil
+}
+
+// getInFlightJob returns the queued or running job for a recipe at any
+// serving size, or nil
+func getInFlightJob(db *sql.DB, recipeID int) (*GenerationJob, error) {
+	job, err := scanJob(db.QueryRow("SELECT "+jobColumns+" FROM generation_jobs WHERE recipe_id = ? AND status IN (?, ?) ORDER BY id LIMIT 1",
+		recipeID, jobQueued, jobRunning))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get job: %w", err)
+	}
+	return job, nil
+}
+
+// enqueueJob queues generating a recipe for a serving size and dietary
+// requirements. If that's already queued or running the existing job is
+// returned instead, so refreshing or double clicking doesn't pay for it
+// twice. A job with different dietary requirements is never reused as its
+// recipe wouldn't follow them. Asking for a fresh one turns the cache off
+// for a job that's still queued.
+func enqueueJob(db *sql.DB, user *User, recipe *Recipe, servingSize int, dietary string, fresh bool, now time.Time) (*GenerationJob, error) {
+	// the unique index on in flight jobs makes this a no-op for duplicates
+	if _, err := db.Exec(`
+INSERT OR IGNORE INTO generation_jobs(recipe_id, serving_size, household_id, user_id, status, fresh, dietary, created_at)
+values(?,?,?,?,?,?,?,?)`, recipe.ID, servingSize, recipe.HouseholdID, user.ID, jobQueued, fresh, dietary, now.UTC().Format(time.RFC3339)); err != nil {
+		return nil, fmt.Errorf("unable to queue job: %w", err)
+	}
+	if fresh {
+		if _, err := db.Exec("UPDATE generation_jobs SET fresh = 1 WHERE recipe_id = ? AND serving_size = ? AND dietary = ? AND status = ?",
+			recipe.ID, servingSize, dietary, jobQueued); err != nil {
+			return nil, fmt.Errorf("unable to queue job: %w", err)
+		}
+	}
+
+	job, err := scanJob(db.QueryRow("SELECT "+jobColumns+" FROM generation_jobs WHERE recipe_id = ? AND serving_size = ? AND dietary = ? AND status IN (?, ?)",
+		recipe.ID, servingSize, dietary, jobQueued, jobRunning))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queued job: %w", err)
+	}
+	return job, nil
+}
+
+// startJob is enqueueJob for generation done in the request rather than by
+// a worker, the job starts out running. created is false when there was
+// already a job in flight, which is returned instead.
+func startJob(db *sql.DB, user *User, recipe *Recipe, servingSize int, dietary string, fresh bool, now time.Time) (*GenerationJob, bool, error) {
+	res, err := db.Exec(`
+INSERT OR IGNORE INTO generation_jobs(recipe_id, serving_size, household_id, user_id, status, fresh, dietary, created_at, started_at)
+values(?,?,?,?,?,?,?,?,?)`, recipe.ID, servingSize, recipe.HouseholdID, user.ID, jobRunning, fresh, dietary,
+		now.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to start job: %w", err)
+	}
+	n, _ := res.RowsAffected()
+
+	job, err := scanJob(db.QueryRow("SELECT "+jobColumns+" FROM generation_jobs WHERE recipe_id = ? AND serving_size = ? AND dietary = ? AND status IN (?, ?)",
+		recipe.ID, servingSize, dietary, jobQueued, jobRunning))
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to get started job: %w", err)
+	}
+	return job, n == 1, nil
+}
+
+// claimJob marks the oldest queued job as running and returns it, or nil
+// when there's nothing to do. Workers race for jobs so the update only
+// counts if the job was still queued.
+func claimJob(db *sql.DB, now time.Time) (*GenerationJob, error) {
+	for {
+		var id int
+		err := db.QueryRow("SELECT id FROM generation_jobs WHERE status = ? ORDER BY id LIMIT 1", jobQueued).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to find a queued job: %w", err)
+		}
+
+		res, err := db.Exec("UPDATE generation_jobs SET status = ?, started_at = ? WHERE id = ? AND status = ?",
+			jobRunning, now.UTC().Format(time.RFC3339), id, jobQueued)
+		if err != nil {
+			return nil, fmt.Errorf("unable to claim job: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		job, err := scanJob(db.QueryRow("SELECT "+jobColumns+" FROM generation_jobs WHERE id = ?", id))
+		if err != nil {
+			return nil, fmt.Errorf("unable to get claimed job: %w", err)
+		}
+		return job, nil
+	}
+}
+
+func finishJob(db *sql.DB, job *GenerationJob, resultID int, jobErr error, now time.Time) error {
+	job.Status, job.ResultID, job.FinishedAt = jobDone, resultID, now
+	if jobErr != nil {
+		job.Status, job.Error = jobFailed, jobErr.Error()
+	}
+	if _, err := db.Exec("UPDATE generation_jobs SET status = ?, result_recipe_id = ?, error = ?, finished_at = ? WHERE id = ?",
+		job.Status, job.ResultID, job.Error, now.UTC().Format(time.RFC3339), job.ID); err != nil {
+		return fmt.Errorf("unable to finish job: %w", err)
+	}
+	return nil
+}
+
+// requeueRunningJobs puts jobs that were running when the process last
+// stopped back in the queue
+func requeueRunningJobs(db *sql.DB) (int, error) {
+	res, err := db.Exec("UPDATE generation_jobs SET status = ?, started_at = '' WHERE status = ?", jobQueued, jobRunning)
+	if err != nil {
+		return 0, fmt.Errorf("unable to requeue jobs: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func requeueJob(db *sql.DB, job *GenerationJob) error {
+	job.Status, job.StartedAt = jobQueued, time.Time{}
+	if _, err := db.Exec("UPDATE generation_jobs SET status = ?, started_at = '' WHERE id = ?", jobQueued, job.ID); err != nil {
+		return fmt.Errorf("unable to requeue job: %w", err)
+	}
+	return nil
+}
+
+// JobQueue runs generation jobs on a fixed number of worker goroutines so
+// requests don't wait on the LLM
+type JobQueue struct {
+	db   *sql.DB
+	wake chan struct{}
+	// generate and stream are generateRecipe and streamRecipe, tests swap
+	// them out
+	generate func(recipe *Recipe, servingSize int, prompt *RenderedPrompt) (*Recipe, *LLMUsage, error)
+	stream   func(ctx context.Context, recipe *Recipe, servingSize int, prompt *RenderedPrompt, onDelta func(string) error) (*Recipe, *LLMUsage, error)
+	// available is false while the provider is down, jobs stay queued
+	// until it's back rather than failing
+	available func() bool
+}
+
+func newJobQueue(db *sql.DB) *JobQueue {
+	return &JobQueue{db: db, wake: make(chan struct{}, 1), generate: generateRecipe, stream: streamRecipe, available: client.Available}
+}
+
+// Available reports whether generation can be tried at the moment
+func (q *JobQueue) Available() bool {
+	return q.available()
+}
+
+// Start requeues interrupted jobs and starts the workers
+func (q *JobQueue) Start(workers int) error {
+	n, err := requeueRunningJobs(q.db)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		fmt.Printf("resuming %d generation jobs\n", n)
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	q.Wake()
+	return nil
+}
+
+// Wake tells an idle worker there's a job, without waiting for the poll
+func (q *JobQueue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *JobQueue) work() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		for q.RunNext() {
+		}
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunNext runs the next queued job, returning false when there wasn't one
+func (q *JobQueue) RunNext() bool {
+	if !q.available() {
+		return false
+	}
+
+	job, err := claimJob(q.db, time.Now())
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	if job == nil {
+		return false
+	}
+
+	resultID, err := q.run(job)
+	if errors.Is(err, errGenerationUnavailable) {
+		// the provider went down while this was queued, it's picked up
+		// again once calls are let through
+		if err := requeueJob(q.db, job); err != nil {
+			fmt.Println(err)
+		}
+		return false
+	}
+	if err != nil {
+		fmt.Printf("generation job %d failed: %v\n", job.ID, err)
+	}
+	if err := finishJob(q.db, job, resultID, err, time.Now()); err != nil {
+		fmt.Println(err)
+	}
+	return true
+}
+
+func (q *JobQueue) run(job *GenerationJob) (int, error) {
+	user, err := getUserByID(q.db, job.UserID)
+	if err != nil {
+		return 0, err
+	}
+	if user == nil {
+		return 0, errors.New("the user that asked for this has been removed")
+	}
+
+	recipe, err := getRecipeByID(q.db, job.HouseholdID, job.RecipeID)
+	if err != nil {
+		return 0, err
+	}
+	if recipe == nil || recipe.Shared {
+		return 0, errors.New("recipe not found")
+	}
+
+	// cached recipes are free so only generating checks the budget, again
+	// as jobs queued together could use it up
+	prompt, err := renderPrompt(q.db, usageTaskRecipe, PromptData{Name: recipe.Name, ServingSize: job.ServingSize, Dietary: job.Dietary})
+	if err != nil {
+		return 0, err
+	}
+
+	var usage *LLMUsage
+	newRecipeVersion := recipe
+	cached, err := fromGenerationCache(q.db, recipe, prompt, job.Fresh, time.Now())
+	if err != nil {
+		fmt.Println(err)
+	}
+	if !cached {
+		if err := checkBudget(q.db, user, time.Now()); err != nil {
+			return 0, err
+		}
+		if newRecipeVersion, usage, err = q.generate(recipe, job.ServingSize, prompt); err != nil {
+			return 0, err
+		}
+		if err := cacheGeneration(q.db, newRecipeVersion, prompt, usage, time.Now()); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	newRecipe, err := insertRecipeVersion(q.db, newRecipeVersion)
+	if err != nil {
+		return 0, err
+	}
+	if err := recordUsage(q.db, user, newRecipe.ID, usage, time.Now()); err != nil {
+		fmt.Println(err)
+	}
+	return newRecipe.ID, nil
+}
+
+// generationJob shows how a job is getting on, the page refreshes itself
+// until it's finished and then goes to the new recipe. Clients asking for
+// json get the job.
+func generationJob(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: job ID must be an integer")
+			return
+		}
+
+		job, err := getJob(db, requestUser(r).HouseholdID, id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if job == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: job not found")
+			return
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+
+		recipe, err := getRecipeByID(db, job.HouseholdID, job.RecipeID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		page := jobPage{GenerationJob: job, Refresh: int(jobPollInterval / time.Second)}
+		if recipe != nil {
+			page.RecipeName = recipe.Name
+		}
+		if err := renderTemplate(w, r, "job.html", page); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error rendering job: %v", err)
+		}
+	}
+}
+
+type jobPage struct {
+	*GenerationJob
+	RecipeName string
+	Refresh    int
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_JobQueue(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "alice", "password1", roleEditor); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	alice, _ := getUser(db, "alice")
+	soup, err := insertRecipeVersion(db, &Recipe{Name: "Soup", HouseholdID: defaultHouseholdID})
+	if err != nil {
+		t.Fatalf("unable to insert recipe: %v", err)
+	}
+
+	now := time.Now()
+	first, err := enqueueJob(db, alice, soup, 2, "", false, now)
+	if err != nil {
+		t.Fatalf("unable to queue job: %v", err)
+	}
+	again, err := enqueueJob(db, alice, soup, 2, "", false, now)
+	if err != nil {
+		t.Fatalf("unable to queue job: %v", err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("expected the same recipe and serving size to share a job, got %d and %d", first.ID, again.ID)
+	}
+	four, err := enqueueJob(db, alice, soup, 4, "", false, now)
+	if err != nil {
+		t.Fatalf("unable to queue job: %v", err)
+	}
+	if four.ID == first.ID {
+		t.Errorf("expected another serving size to get its own job")
+	}
+
+	// a restart part way through the first job puts it back in the queue
+	if job, err := claimJob(db, now); err != nil || job.ID != first.ID {
+		t.Fatalf("claimJob() = %v, %v", job, err)
+	}
+	if again, _ := enqueueJob(db, alice, soup, 2, "", false, now); again.ID != first.ID {
+		t.Errorf("expected a running job to still be shared")
+	}
+	if n, err := requeueRunningJobs(db); err != nil || n != 1 {
+		t.Fatalf("requeueRunningJobs() = %d, %v", n, err)
+	}
+
+	q := newJobQueue(db)
+	calls := 0
+	q.generate = func(recipe *Recipe, servingSize int, prompt *RenderedPrompt) (*Recipe, *LLMUsage, error) {
+		calls++
+		if servingSize == 4 {
+			return nil, nil, errors.New("openai is down")
+		}
+		recipe.RecipeText = "Ingredients:\n- 1 onion"
+		return recipe, &LLMUsage{Task: usageTaskRecipe, Model: "gpt-3.5-turbo", PromptTokens: 10}, nil
+	}
+	for q.RunNext() {
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 generations, got %d", calls)
+	}
+
+	done, err := getJob(db, defaultHouseholdID, first.ID)
+	if err != nil {
+		t.Fatalf("unable to get job: %v", err)
+	}
+	if done.Status != jobDone || done.ResultID == 0 || done.ResultID == soup.ID {
+		t.Errorf("expected the job to be done with a new version, got %+v", done)
+	}
+	if spent, _ := monthSpend(db, budgetUser, alice.ID, time.Now()); spent == 0 {
+		t.Errorf("expected the job's usage to be recorded")
+	}
+
+	failed, _ := getJob(db, defaultHouseholdID, four.ID)
+	if failed.Status != jobFailed || failed.Error != "openai is down" {
+		t.Errorf("expected the job to fail, got %+v", failed)
+	}
+
+	// finished jobs don't stop the recipe being generated again
+	next, err := enqueueJob(db, alice, soup, 2, "", false, now)
+	if err != nil {
+		t.Fatalf("unable to queue job: %v", err)
+	}
+	if next.ID == first.ID || next.Status != jobQueued {
+		t.Errorf("expected a new job once the last one finished, got %+v", next)
+	}
+
+	if job, _ := getJob(db, defaultHouseholdID+1, first.ID); job != nil {
+		t.Errorf("expected jobs to be hidden from other households")
+	}
+
+	// the same recipe and serving size again comes from the cache
+	calls = 0
+	for q.RunNext() {
+	}
+	if fromCache, _ := getJob(db, defaultHouseholdID, next.ID); calls != 0 || fromCache.Status != jobDone {
+		t.Errorf("expected the job to be done from the cache, %d generations, got %+v", calls, fromCache)
+	}
+	stats, err := getCacheStats(db, now.AddDate(0, 0, -1))
+	if err != nil || stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 1 {
+		t.Errorf("getCacheStats() = %+v, %v", stats, err)
+	}
+
+	// jobs wait in the queue while the provider is down
+	next, err = enqueueJob(db, alice, soup, 2, "", true, now)
+	if err != nil || !next.Fresh {
+		t.Fatalf("unable to queue a fresh job: %+v, %v", next, err)
+	}
+	up := false
+	q.available = func() bool { return up }
+	if q.RunNext() {
+		t.Errorf("expected no job to run while generation is unavailable")
+	}
+	up = true
+	q.generate = func(recipe *Recipe, servingSize int, prompt *RenderedPrompt) (*Recipe, *LLMUsage, error) {
+		return nil, nil, fmt.Errorf("error calling openai: %w", errGenerationUnavailable)
+	}
+	q.RunNext()
+	if waiting, _ := getJob(db, defaultHouseholdID, next.ID); waiting.Status != jobQueued {
+		t.Errorf("expected the job to be requeued when the breaker opened, got %+v", waiting)
+	}
+}
+
+// Test_enqueueJob_dietary checks a request with dietary requirements isn't
+// sent to a job that's generating without them
+func Test_enqueueJob_dietary(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "alice", "password1", roleEditor); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	alice, _ := getUser(db, "alice")
+	soup, err := insertRecipeVersion(db, &Recipe{Name: "Soup", HouseholdID: defaultHouseholdID})
+	if err != nil {
+		t.Fatalf("unable to insert recipe: %v", err)
+	}
+
+	now := time.Now()
+	plain, created, err := startJob(db, alice, soup, 2, "", false, now)
+	if err != nil || !created {
+		t.Fatalf("startJob() = %v, %v, %v", plain, created, err)
+	}
+	noNuts, err := enqueueJob(db, alice, soup, 2, "no nuts", false, now)
+	if err != nil {
+		t.Fatalf("unable to queue job: %v", err)
+	}
+	if noNuts.ID == plain.ID || noNuts.Dietary != "no nuts" {
+		t.Errorf("expected dietary requirements to get their own job, got %+v", noNuts)
+	}
+	again, created, err := startJob(db, alice, soup, 2, "no nuts", false, now)
+	if err != nil || created || again.ID != noNuts.ID {
+		t.Errorf("expected the same requirements to share a job, got %+v, %v, %v", again, created, err)
+	}
+	if again, _ := enqueueJob(db, alice, soup, 2, "", false, now); again.ID != plain.ID {
+		t.Errorf("expected no requirements to share the running job, got %d", again.ID)
+	}
+}
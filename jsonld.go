@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// schemaDiets are the schema.org RestrictedDiet values for our diets, the
+// ones missing have no equivalent
+var schemaDiets = map[string]string{
+	dietVegan:      "https://schema.org/VeganDiet",
+	dietVegetarian: "https://schema.org/VegetarianDiet",
+	dietGlutenFree: "https://schema.org/GlutenFreeDiet",
+}
+
+func formatNutrient(value float64, unit string) string {
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + unit
+}
+
+// recipeJSONLD is the recipe as a schema.org Recipe, the nutrition is left
+// out when nothing could be matched and the diets when any ingredient is
+// unknown
+func recipeJSONLD(recipe *Recipe, nutrition *Nutrition, diet *DietInfo) map[string]interface{} {
+	ld := map[string]interface{}{
+		"@context": "https://schema.org",
+		"@type":    "Recipe",
+		"name":     recipe.Name,
+		"version":  recipe.Version,
+	}
+	if len(recipe.Tags) > 0 {
+		ld["keywords"] = strings.Join(recipe.Tags, ", ")
+	}
+	if recipe.Reference != "" {
+		ld["isBasedOn"] = recipe.Reference
+	}
+
+	if recipe.Content != nil {
+		ld["recipeYield"] = fmt.Sprintf("%d servings", recipe.Content.Servings)
+
+		ingredients := []string{}
+		for name, amount := range recipe.Content.Ingredients {
+			parts := []string{}
+			if amount != nil {
+				parts = append(parts, splitNonEmpty(amount.Amount+" "+amount.Unit, " ")...)
+			}
+			ingredients = append(ingredients, strings.Join(append(parts, name), " "))
+		}
+		sort.Strings(ingredients)
+		ld["recipeIngredient"] = ingredients
+
+		steps := []map[string]string{}
+		for _, line := range recipe.Content.MethodLines {
+			steps = append(steps, map[string]string{"@type": "HowToStep", "text": line})
+		}
+		ld["recipeInstructions"] = steps
+	}
+
+	if nutrition != nil && len(nutrition.Matched) > 0 {
+		n := nutrition.PerServing
+		ld["nutrition"] = map[string]string{
+			"@type":               "NutritionInformation",
+			"servingSize":         "1 serving",
+			"calories":            formatNutrient(n.Energy, "kcal"),
+			"proteinContent":      formatNutrient(n.Protein, "g"),
+			"fatContent":          formatNutrient(n.Fat, "g"),
+			"carbohydrateContent": formatNutrient(n.Carbs, "g"),
+			"fiberContent":        formatNutrient(n.Fibre, "g"),
+			"sodiumContent":       formatNutrient(n.Sodium(), "mg"),
+		}
+	}
+
+	if diet != nil && diet.Complete() {
+		suitable := []string{}
+		for _, d := range diet.Suitable {
+			if s, ok := schemaDiets[d]; ok {
+				suitable = append(suitable, s)
+			}
+		}
+		if len(suitable) > 0 {
+			ld["suitableForDiet"] = suitable
+		}
+	}
+	return ld
+}
+
+// exportJSONLD returns the household's recipes as schema.org JSON-LD, one
+// recipe with ?id= or all of them in a @graph
+func exportJSONLD(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		user := requestUser(r)
+		var recipes []*Recipe
+		if idStr := r.URL.Query().Get("id"); idStr != "" {
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: recipe ID must be an integer")
+				return
+			}
+			recipe, err := getRecipeByID(db, user.HouseholdID, id)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: unable to check DB for recipe")
+				log.Println(err.Error())
+				return
+			}
+			if recipe == nil {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, "error: recipe not found")
+				return
+			}
+			recipes = []*Recipe{recipe}
+		} else {
+			var err error
+			if recipes, err = getAllRecipes(db, user.HouseholdID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error fetching recipes: %v", err)
+				return
+			}
+		}
+
+		guessed, err := getIngredientClasses(db)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		graph := []map[string]interface{}{}
+		for _, recipe := range recipes {
+			graph = append(graph, recipeJSONLD(recipe, recipeNutrition(recipe), classifyRecipe(recipe, guessed)))
+		}
+		var doc interface{}
+		if r.URL.Query().Get("id") != "" {
+			doc = graph[0]
+		} else {
+			for _, ld := range graph {
+				delete(ld, "@context")
+			}
+			doc = map[string]interface{}{"@context": "https://schema.org", "@graph": graph}
+		}
+
+		body, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error marshalling recipes: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
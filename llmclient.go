@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Calls to the LLM that fail with a 429, a 5xx, a timeout or a network
+// error are retried with jittered exponential backoff, waiting at least as
+// long as the provider's Retry-After. Calls that still fail count towards
+// the circuit breaker, which fails every call straight away once the
+// provider looks down and lets one through to test it after a cooldown.
+const (
+	llmMaxAttempts      = 4
+	llmBackoffBase      = time.Second
+	llmBackoffMax       = 30 * time.Second
+	llmBreakerThreshold = 3
+	llmBreakerCooldown  = time.Minute
+)
+
+// errGenerationUnavailable is returned without calling the provider while
+// the circuit breaker is open
+var errGenerationUnavailable = errors.New("generation is unavailable, the LLM provider isn't responding")
+
+// errNoChoices is a completion that came back without an answer, it's
+// retried like a server error
+var errNoChoices = errors.New("the LLM provider answered with no choices")
+
+// LLMClient wraps the openai client with timeouts, retries and a circuit
+// breaker, every call to the provider goes through it
+type LLMClient struct {
+	client  *openai.Client
+	breaker *circuitBreaker
+	// sleep waits between attempts, tests replace it
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newLLMClient(config openai.ClientConfig) *LLMClient {
+	transport := config.HTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	config.HTTPClient = &http.Client{Transport: &retryAfterTransport{next: transport}}
+	return &LLMClient{
+		client:  openai.NewClientWithConfig(config),
+		breaker: &circuitBreaker{threshold: llmBreakerThreshold, cooldown: llmBreakerCooldown},
+		sleep:   sleepContext,
+	}
+}
+
+// Available is false while the breaker is open, callers use it to fail
+// fast before queueing work
+func (c *LLMClient) Available() bool {
+	return c.breaker.Ready(time.Now())
+}
+
+// RetryAt is when the breaker will next let a call through
+func (c *LLMClient) RetryAt() time.Time {
+	return c.breaker.RetryAt()
+}
+
+// CreateChatCompletion makes a chat completion, each attempt gets timeout
+func (c *LLMClient) CreateChatCompletion(ctx context.Context, timeout time.Duration, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	var resp openai.ChatCompletionResponse
+	err := c.do(ctx, timeout, func(ctx context.Context) error {
+		var err error
+		resp, err = c.client.CreateChatCompletion(ctx, req)
+		if err == nil && len(resp.Choices) == 0 {
+			return errNoChoices
+		}
+		return err
+	})
+	return resp, err
+}
+
+// CreateChatCompletionStream opens a streamed chat completion, only opening
+// the stream is retried and timed out, reading it is up to ctx
+func (c *LLMClient) CreateChatCompletionStream(ctx context.Context, timeout time.Duration, req openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error) {
+	var stream *openai.ChatCompletionStream
+	err := c.do(ctx, 0, func(attemptCtx context.Context) error {
+		// the stream is read after the attempt returns so the timeout
+		// only covers waiting for it to start, the retry-after value is
+		// carried over from the attempt's context
+		streamCtx, cancel := context.WithCancel(attemptCtx)
+		timer := time.AfterFunc(timeout, cancel)
+		s, err := c.client.CreateChatCompletionStream(streamCtx, req)
+		if !timer.Stop() {
+			if err == nil {
+				s.Close()
+			}
+			return fmt.Errorf("no response after %s: %w", timeout, context.DeadlineExceeded)
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		stream = s
+		return nil
+	})
+	return stream, err
+}
+
+func (c *LLMClient) do(ctx context.Context, timeout time.Duration, call func(ctx context.Context) error) error {
+	if !c.breaker.Allow(time.Now()) {
+		return errGenerationUnavailable
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		var retryAfter time.Duration
+		err = call(context.WithValue(attemptCtx, retryAfterKey{}, &retryAfter))
+		cancel()
+
+		if err == nil {
+			c.breaker.Success()
+			return nil
+		}
+		if ctx.Err() != nil {
+			// the caller gave up, that says nothing about the provider
+			c.breaker.Abandon()
+			return err
+		}
+		if !retryable(err) {
+			c.breaker.Success()
+			return err
+		}
+		if attempt == llmMaxAttempts {
+			break
+		}
+
+		wait := backoff(attempt, rand.Float64())
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > llmBackoffMax {
+			// the provider asked for longer than is worth waiting
+			break
+		}
+		fmt.Printf("llm call failed, attempt %d of %d, retrying in %s: %v\n", attempt, llmMaxAttempts, wait, err)
+		if err := c.sleep(ctx, wait); err != nil {
+			c.breaker.Abandon()
+			return err
+		}
+	}
+
+	c.breaker.Failure(time.Now())
+	return err
+}
+
+// backoff is the wait after the nth failed attempt, full jitter between
+// nothing and the exponential delay picked by r from [0, 1)
+func backoff(attempt int, r float64) time.Duration {
+	d := llmBackoffBase << (attempt - 1)
+	if d > llmBackoffMax || d <= 0 {
+		d = llmBackoffMax
+	}
+	return time.Duration(r * float64(d))
+}
+
+// retryable is true for errors worth trying again: rate limits, server
+// errors, empty answers, timeouts and the connection failing
+func retryable(err error) bool {
+	if errors.Is(err, errNoChoices) {
+		return true
+	}
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return retryableStatus(apiErr.HTTPStatusCode)
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return retryableStatus(reqErr.HTTPStatusCode)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+type retryAfterKey struct{}
+
+// retryAfterTransport hands the Retry-After header back to the attempt
+// that got it, the openai client doesn't expose response headers
+type retryAfterTransport struct {
+	next http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if into, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok {
+		*into = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return resp, nil
+}
+
+// parseRetryAfter reads seconds or an HTTP date, zero if it's missing
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// circuitBreaker opens after threshold calls in a row have failed. While
+// open every call is refused until the cooldown has passed, then one call
+// is let through: if it works the breaker closes, if not it opens again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	// trying is set while the call testing the provider is in flight
+	trying bool
+}
+
+func (b *circuitBreaker) open() bool {
+	return b.failures >= b.threshold
+}
+
+// Ready reports whether a call would be let through, without claiming the
+// test call
+func (b *circuitBreaker) Ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open() || (!b.trying && !now.Before(b.openedAt.Add(b.cooldown)))
+}
+
+// Allow reports whether a call can go ahead, once the cooldown is over the
+// first call to ask is the test call
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open() {
+		return true
+	}
+	if b.trying || now.Before(b.openedAt.Add(b.cooldown)) {
+		return false
+	}
+	b.trying = true
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures, b.trying = 0, false
+}
+
+func (b *circuitBreaker) Failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trying = false
+	if b.open() {
+		b.openedAt = now
+	}
+}
+
+// Abandon releases the test call without it counting either way
+func (b *circuitBreaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trying = false
+}
+
+// RetryAt is when an open breaker will let the next call through
+func (b *circuitBreaker) RetryAt() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open() {
+		return time.Time{}
+	}
+	return b.openedAt.Add(b.cooldown)
+}
+
+// retryAfterSeconds is the Retry-After value for a client to come back at
+// retryAt, rounded up so it never says to retry straight away
+func retryAfterSeconds(retryAt, now time.Time) string {
+	wait := retryAt.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	return strconv.Itoa(int(wait/time.Second) + 1)
+}
+
+type unavailablePage struct {
+	Wait string
+	Back string
+}
+
+// generationUnavailable tells people generation is down for now rather
+// than showing them the provider's error
+func generationUnavailable(w http.ResponseWriter, r *http.Request) {
+	retryAt, now := client.RetryAt(), time.Now()
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAt, now))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		fmt.Fprintf(w, "error: %v", errGenerationUnavailable)
+		return
+	}
+
+	page := unavailablePage{Wait: formatWait(retryAt.Sub(now)), Back: "/list"}
+	if id := r.FormValue("id"); id != "" {
+		page.Back = "/recipe?id=" + url.QueryEscape(id)
+	}
+	if err := renderTemplate(w, r, "unavailable.html", page); err != nil {
+		fmt.Fprintf(w, "error: %v", errGenerationUnavailable)
+	}
+}
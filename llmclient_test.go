@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// newTestLLMClient points a client at a stand-in server that answers with
+// statuses in turn, the last one repeating
+func newTestLLMClient(t *testing.T, statuses ...int) (*LLMClient, *int, *[]time.Duration) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "7")
+		}
+		if status != http.StatusOK {
+			writeJSON(w, status, map[string]interface{}{"error": map[string]string{"message": http.StatusText(status)}})
+			return
+		}
+		writeJSON(w, status, map[string]interface{}{
+			"model":   "gpt-3.5-turbo",
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": "[]"}}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	config := openai.DefaultConfig("test")
+	config.BaseURL = srv.URL + "/v1"
+	c := newLLMClient(config)
+	var waits []time.Duration
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	return c, &calls, &waits
+}
+
+func Test_LLMClient(t *testing.T) {
+	req := openai.ChatCompletionRequest{Model: openai.GPT3Dot5Turbo}
+
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		calls    int
+		// minWait is the least the client should have waited in total
+		minWait time.Duration
+	}{
+		{name: "success", statuses: []int{200}, calls: 1},
+		{name: "server errors are retried", statuses: []int{500, 502, 200}, calls: 3},
+		{name: "rate limits wait for retry-after", statuses: []int{429, 200}, calls: 2, minWait: 7 * time.Second},
+		{name: "bad requests aren't retried", statuses: []int{400}, wantErr: true, calls: 1},
+		{name: "attempts run out", statuses: []int{503}, wantErr: true, calls: llmMaxAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, calls, waits := newTestLLMClient(t, tt.statuses...)
+			_, err := c.CreateChatCompletion(context.Background(), time.Second, req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateChatCompletion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if *calls != tt.calls {
+				t.Errorf("expected %d calls, got %d", tt.calls, *calls)
+			}
+			var waited time.Duration
+			for _, w := range *waits {
+				waited += w
+			}
+			if waited < tt.minWait {
+				t.Errorf("expected to wait at least %s, waited %s", tt.minWait, waited)
+			}
+		})
+	}
+}
+
+func Test_LLMClient_noChoices(t *testing.T) {
+	// the provider answers properly from call answerOn
+	calls, answerOn := 0, 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		choices := []map[string]interface{}{}
+		if calls >= answerOn {
+			choices = append(choices, map[string]interface{}{"message": map[string]string{"role": "assistant", "content": "[]"}})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"model": "gpt-3.5-turbo", "choices": choices})
+	}))
+	defer srv.Close()
+
+	config := openai.DefaultConfig("test")
+	config.BaseURL = srv.URL + "/v1"
+	c := newLLMClient(config)
+	c.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+
+	resp, err := c.CreateChatCompletion(context.Background(), time.Second, openai.ChatCompletionRequest{Model: openai.GPT3Dot5Turbo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || len(resp.Choices) != 1 {
+		t.Errorf("expected an answer with no choices to be retried, got %d calls and %d choices", calls, len(resp.Choices))
+	}
+
+	calls, answerOn = 0, llmMaxAttempts+1
+	if _, err := c.CreateChatCompletion(context.Background(), time.Second, openai.ChatCompletionRequest{Model: openai.GPT3Dot5Turbo}); !errors.Is(err, errNoChoices) {
+		t.Errorf("expected an error once every attempt has no choices, got %v", err)
+	}
+}
+
+func Test_LLMClient_breaker(t *testing.T) {
+	c, calls, _ := newTestLLMClient(t, 503)
+	req := openai.ChatCompletionRequest{Model: openai.GPT3Dot5Turbo}
+
+	for i := 0; i < llmBreakerThreshold; i++ {
+		if _, err := c.CreateChatCompletion(context.Background(), time.Second, req); err == nil || errors.Is(err, errGenerationUnavailable) {
+			t.Fatalf("expected call %d to reach the provider and fail, got %v", i, err)
+		}
+	}
+	if c.Available() {
+		t.Errorf("expected the breaker to be open")
+	}
+
+	before := *calls
+	if _, err := c.CreateChatCompletion(context.Background(), time.Second, req); !errors.Is(err, errGenerationUnavailable) {
+		t.Errorf("expected to fail fast, got %v", err)
+	}
+	if *calls != before {
+		t.Errorf("expected no calls to the provider while the breaker is open")
+	}
+
+	// after the cooldown one call is let through to test the provider
+	now := c.RetryAt()
+	if !c.breaker.Allow(now) {
+		t.Fatalf("expected a test call to be allowed after the cooldown")
+	}
+	if c.breaker.Allow(now) {
+		t.Errorf("expected only one test call at a time")
+	}
+	c.breaker.Success()
+	if !c.Available() {
+		t.Errorf("expected a successful call to close the breaker")
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.value), func(t *testing.T) {
+			if got := parseRetryAfter(tt.value, now); got != tt.want {
+				t.Errorf("parseRetryAfter() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		max := backoff(attempt, 0.999)
+		if backoff(attempt, 0) != 0 || max > llmBackoffMax {
+			t.Errorf("backoff(%d) out of range, max %s", attempt, max)
+		}
+		if attempt > 1 && max < backoff(attempt-1, 0.999) {
+			t.Errorf("expected backoff to grow, attempt %d waited %s", attempt, max)
+		}
+	}
+}
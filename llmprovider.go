@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// LLMProvider is where generation is sent and which model each task uses.
+// Anything that speaks the OpenAI chat completions API works, like
+// llama.cpp's server, Ollama or vLLM as well as OpenAI itself.
+type LLMProvider struct {
+	// BaseURL is the API root including any /v1, it's OpenAI when empty
+	BaseURL string
+	// APIKey is sent as a bearer token, local servers often don't need one
+	APIKey string
+	Models map[string]string
+}
+
+var defaultLLMProvider = LLMProvider{
+	Models: map[string]string{
+		usageTaskRecipe:    openai.GPT3Dot5Turbo,
+		usageTaskTags:      openai.GPT3Dot5Turbo,
+		usageTaskAllergens: openai.GPT3Dot5Turbo,
+	},
+}
+
+var llmProvider = defaultLLMProvider
+
+// llmProviderFromEnv reads LLM_BASE_URL, LLM_API_KEY (OPENAI_KEY from
+// before there was a choice of provider still works), LLM_MODEL for every
+// task and LLM_RECIPE_MODEL, LLM_TAGS_MODEL and LLM_ALLERGENS_MODEL for one
+// task
+func llmProviderFromEnv(getenv func(string) string) (LLMProvider, error) {
+	p := LLMProvider{
+		BaseURL: strings.TrimRight(getenv("LLM_BASE_URL"), "/"),
+		APIKey:  getenv("LLM_API_KEY"),
+		Models:  map[string]string{},
+	}
+	if p.APIKey == "" {
+		p.APIKey = getenv("OPENAI_KEY")
+	}
+	if p.BaseURL != "" {
+		u, err := url.Parse(p.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return p, fmt.Errorf("LLM_BASE_URL must be an http or https url like http://localhost:11434/v1, got %q", p.BaseURL)
+		}
+	}
+
+	for task, model := range defaultLLMProvider.Models {
+		if all := getenv("LLM_MODEL"); all != "" {
+			model = all
+		}
+		if one := getenv("LLM_" + strings.ToUpper(task) + "_MODEL"); one != "" {
+			model = one
+		}
+		p.Models[task] = model
+	}
+	return p, nil
+}
+
+// Model is the model for a task
+func (p LLMProvider) Model(task string) string {
+	if model := p.Models[task]; model != "" {
+		return model
+	}
+	return defaultLLMProvider.Models[task]
+}
+
+// Name is the host generation goes to, for showing to admins
+func (p LLMProvider) Name() string {
+	if p.BaseURL == "" {
+		return "OpenAI"
+	}
+	if u, err := url.Parse(p.BaseURL); err == nil {
+		return u.Host
+	}
+	return p.BaseURL
+}
+
+func (p LLMProvider) ClientConfig() openai.ClientConfig {
+	config := openai.DefaultConfig(p.APIKey)
+	if p.BaseURL != "" {
+		config.BaseURL = p.BaseURL
+	}
+	return config
+}
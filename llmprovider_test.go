@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func Test_llmProviderFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    LLMProvider
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"OPENAI_KEY": "sk-old"},
+			want: LLMProvider{APIKey: "sk-old", Models: map[string]string{usageTaskRecipe: openai.GPT3Dot5Turbo, usageTaskTags: openai.GPT3Dot5Turbo, usageTaskAllergens: openai.GPT3Dot5Turbo}},
+		},
+		{
+			name: "one model for everything",
+			env:  map[string]string{"LLM_BASE_URL": "http://localhost:11434/v1/", "LLM_MODEL": "llama3"},
+			want: LLMProvider{BaseURL: "http://localhost:11434/v1", Models: map[string]string{usageTaskRecipe: "llama3", usageTaskTags: "llama3", usageTaskAllergens: "llama3"}},
+		},
+		{
+			name: "a model per task",
+			env:  map[string]string{"LLM_API_KEY": "sk-new", "OPENAI_KEY": "sk-old", "LLM_MODEL": "gpt-4o", "LLM_TAGS_MODEL": "gpt-4o-mini", "LLM_ALLERGENS_MODEL": "gpt-4o-mini"},
+			want: LLMProvider{APIKey: "sk-new", Models: map[string]string{usageTaskRecipe: "gpt-4o", usageTaskTags: "gpt-4o-mini", usageTaskAllergens: "gpt-4o-mini"}},
+		},
+		{
+			name:    "not a url",
+			env:     map[string]string{"LLM_BASE_URL": "localhost:8000"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := llmProviderFromEnv(func(key string) string { return tt.env[key] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("llmProviderFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("llmProviderFromEnv() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test_LLMProvider_server runs generation against a stand-in for a self
+// hosted server, checking each task asks for its own model
+func Test_LLMProvider_server(t *testing.T) {
+	asked := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer local" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		asked[req.Messages[1].Content] = req.Model
+
+		text := "Ingredients:\n- 2 g : salt\nInstructions:\n1. Stir"
+		if req.Model == "small" {
+			text = `["Soup", "Lunch"]`
+		}
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, delta := range []string{text[:12], text[12:]} {
+				chunk, _ := json.Marshal(map[string]interface{}{
+					"model":   req.Model,
+					"choices": []map[string]interface{}{{"delta": map[string]string{"content": delta}}},
+				})
+				fmt.Fprintf(w, "data: %s\n\n", chunk)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"model":   req.Model,
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": text}}},
+			"usage":   map[string]int{"prompt_tokens": 10, "completion_tokens": 5},
+		})
+	}))
+	defer srv.Close()
+
+	oldProvider, oldClient := llmProvider, client
+	defer func() { llmProvider, client = oldProvider, oldClient }()
+	llmProvider = LLMProvider{BaseURL: srv.URL + "/v1", APIKey: "local", Models: map[string]string{usageTaskRecipe: "big", usageTaskTags: "small"}}
+	client = newLLMClient(llmProvider.ClientConfig())
+
+	render := func(task, name string) *RenderedPrompt {
+		p := defaultPrompts[task]
+		rendered, err := (&p).Render(PromptData{Name: name, ServingSize: 2})
+		if err != nil {
+			t.Fatalf("unable to render %s prompt: %v", task, err)
+		}
+		return rendered
+	}
+
+	recipe := &Recipe{Name: "Soup"}
+	usage, err := generateTags(recipe, render(usageTaskTags, "Soup"), false)
+	if err != nil {
+		t.Fatalf("generateTags() error = %v", err)
+	}
+	if !reflect.DeepEqual(recipe.Tags, []string{"Lunch", "Soup"}) || usage.Model != "small" || usage.PromptTokens != 10 {
+		t.Errorf("unexpected tags %v and usage %+v", recipe.Tags, usage)
+	}
+
+	generated, _, err := generateRecipe(&Recipe{Name: "Stew"}, 2, render(usageTaskRecipe, "Stew"))
+	if err != nil {
+		t.Fatalf("generateRecipe() error = %v", err)
+	}
+	if generated.Model != "big" || generated.Content.MethodLines[0] != "Stir" {
+		t.Errorf("unexpected recipe %+v", generated)
+	}
+
+	deltas := 0
+	streamed, _, err := streamRecipe(context.Background(), &Recipe{Name: "Broth"}, 2, render(usageTaskRecipe, "Broth"), func(string) error {
+		deltas++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamRecipe() error = %v", err)
+	}
+	if deltas != 2 || streamed.Model != "big" || streamed.Content.MethodLines[0] != "Stir" {
+		t.Errorf("unexpected streamed recipe after %d deltas: %+v", deltas, streamed)
+	}
+
+	want := map[string]string{"Soup": "small", "Stew 2": "big", "Broth 2": "big"}
+	if !reflect.DeepEqual(asked, want) {
+		t.Errorf("models asked for = %v, want %v", asked, want)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -14,6 +16,17 @@ import (
 var (
 	templates *template.Template
 	dbFile    string = "recipes.db"
+
+	templateFuncs = template.FuncMap{
+		"inc": func(i int) int { return i + 1 },
+		"dec": func(i int) int { return i - 1 },
+		"add": func(a, b int) int { return a + b },
+
+		"formatQuantity": func(q *Quantity) string { return formatQuantity(*q) },
+
+		// replaced for each request by renderTemplate
+		"csrfField": func() template.HTML { return "" },
+	}
 )
 
 type Recipe struct {
@@ -24,6 +37,16 @@ type Recipe struct {
 	Tags       []string       `csv:"tags" json:"tags"`
 	RecipeText string         `csv:"recipe_text" json:"recipe_text"`
 	Content    *RecipeContent `csv:"-" json:"content"`
+
+	// Model and PromptVersion are what generated RecipeText, they're empty
+	// for recipes that were written or imported
+	Model         string `csv:"-" json:"model,omitempty"`
+	PromptVersion int    `csv:"-" json:"prompt_version,omitempty"`
+
+	// HouseholdID owns the recipe, Shared is set when it was read by a
+	// different household that can only view it
+	HouseholdID int  `csv:"-" json:"-"`
+	Shared      bool `csv:"-" json:"-"`
 }
 
 type RecipeContent struct {
@@ -58,18 +81,92 @@ func main() {
 		}
 	}
 
-	t, err := template.ParseGlob("templates/*")
+	if err := migrateDB(db); err != nil {
+		log.Fatalf("unable to migrate db, got err: %+v\n", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		if err := runUserCommand(db, os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "household" {
+		if err := runHouseholdCommand(db, os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if err := importEnvUsers(db, os.Environ()); err != nil {
+		log.Fatalf("unable to import users from the environment, got err: %+v\n", err)
+	}
+
+	if err := deleteStaleSessions(db, time.Now()); err != nil {
+		log.Fatalf("unable to clean up sessions, got err: %+v\n", err)
+	}
+	if err := deleteStaleLoginFailures(db, time.Now()); err != nil {
+		log.Fatalf("unable to clean up login failures, got err: %+v\n", err)
+	}
+	if err := deleteOldAuditEntries(db, time.Now()); err != nil {
+		log.Fatalf("unable to clean up the audit log, got err: %+v\n", err)
+	}
+
+	// fly sets FLY_APP_NAME on every machine it runs
+	behindFlyProxy = os.Getenv("FLY_APP_NAME") != ""
+	if publicBaseURL, err = parseBaseURL(os.Getenv("BASE_URL")); err != nil {
+		log.Fatalf("unable to read BASE_URL, got err: %+v\n", err)
+	}
+
+	if modelPrices, err = parseModelPrices(os.Getenv("LLM_PRICES")); err != nil {
+		log.Fatalf("unable to read LLM_PRICES, got err: %+v\n", err)
+	}
+	if llmProvider, err = llmProviderFromEnv(os.Getenv); err != nil {
+		log.Fatalf("unable to configure the llm provider, got err: %+v\n", err)
+	}
+	client = newLLMClient(llmProvider.ClientConfig())
+	fmt.Printf("generating recipes with %s, tags with %s and allergens with %s on %s\n", llmProvider.Model(usageTaskRecipe), llmProvider.Model(usageTaskTags), llmProvider.Model(usageTaskAllergens), llmProvider.Name())
+
+	oidcConfig, err := oidcConfigFromEnv(os.Getenv)
+	if err != nil {
+		log.Fatalf("unable to configure single sign on, got err: %+v\n", err)
+	}
+	var oidc *OIDCProvider
+	if oidcConfig != nil {
+		oidc = newOIDCProvider(oidcConfig)
+	}
+
+	csrfSecret, err := getAppSecret(db, "csrf")
+	if err != nil {
+		log.Fatalf("unable to set up csrf protection, got err: %+v\n", err)
+	}
+
+	t, err := template.New("").Funcs(templateFuncs).ParseGlob("templates/*")
 	if err != nil {
 		log.Fatal(err)
 	}
 	templates = t
 
+	workers := 2
+	if value := os.Getenv("GENERATION_WORKERS"); value != "" {
+		if workers, err = strconv.Atoi(value); err != nil || workers < 1 {
+			log.Fatalf("GENERATION_WORKERS must be a positive number, got %q\n", value)
+		}
+	}
+	jobs := newJobQueue(db)
+	if err := jobs.Start(workers); err != nil {
+		log.Fatalf("unable to start generation workers, got err: %+v\n", err)
+	}
+	if err := failInterruptedRetagRuns(db); err != nil {
+		log.Fatal(err)
+	}
+
 	mux := http.NewServeMux()
 
-	registerRoutes(mux, db)
+	registerRoutes(mux, db, oidc, jobs)
 
 	fmt.Println("Listening on port 8080")
-	if err := http.ListenAndServe(":8080", mux); err != nil {
+	if err := http.ListenAndServe(":8080", csrfProtect(csrfSecret, mux)); err != nil {
 		panic(err)
 	}
 }
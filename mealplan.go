@@ -0,0 +1,702 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const planDateFormat = "2006-01-02"
+
+// meals are the slot types a plan day is split into, in the order they are
+// shown on the calendar
+var meals = []string{"breakfast", "lunch", "dinner"}
+
+// mealTags are the recipe tags that make a recipe a suggestion for a slot,
+// generateTags is asked to always include lunch so those are the most common.
+// Main dish and the like are kept for recipes that haven't been re-tagged
+// with the taxonomy.
+var mealTags = map[string][]string{
+	"breakfast": {"breakfast", "brunch"},
+	"lunch":     {"lunch", "salad", "soup", "sandwich"},
+	"dinner":    {"dinner", "main", "main dish", "main course", "supper"},
+}
+
+type MealPlan struct {
+	ID          int         `json:"id"`
+	HouseholdID int         `json:"-"`
+	Name        string      `json:"name"`
+	StartDate   string      `json:"start_date"`
+	Slots       []*MealSlot `json:"slots,omitempty"`
+}
+
+type MealSlot struct {
+	ID         int    `json:"id"`
+	PlanID     int    `json:"plan_id"`
+	Date       string `json:"date"`
+	Meal       string `json:"meal"`
+	RecipeID   int    `json:"recipe_id"`
+	RecipeName string `json:"recipe_name,omitempty"`
+	Servings   int    `json:"servings"`
+}
+
+func validMeal(meal string) bool {
+	for _, m := range meals {
+		if m == meal {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *MealPlan) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("no plan name provided")
+	}
+	if _, err := time.Parse(planDateFormat, p.StartDate); err != nil {
+		return fmt.Errorf("start date must be formatted as YYYY-MM-DD")
+	}
+	return nil
+}
+
+func (s *MealSlot) validate() error {
+	if _, err := time.Parse(planDateFormat, s.Date); err != nil {
+		return fmt.Errorf("date must be formatted as YYYY-MM-DD")
+	}
+	if !validMeal(s.Meal) {
+		return fmt.Errorf("meal must be one of %s", strings.Join(meals, ", "))
+	}
+	if s.RecipeID <= 0 {
+		return fmt.Errorf("no recipe provided")
+	}
+	if s.Servings <= 0 {
+		return fmt.Errorf("invalid serving count provided")
+	}
+	return nil
+}
+
+func getMealPlans(db *sql.DB, householdID int) ([]*MealPlan, error) {
+	rows, err := db.Query("SELECT id, household_id, name, start_date FROM meal_plans WHERE household_id = ? ORDER BY start_date DESC, id DESC", householdID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query meal plans: %w", err)
+	}
+	defer rows.Close()
+
+	plans := []*MealPlan{}
+	for rows.Next() {
+		plan := &MealPlan{}
+		if err := rows.Scan(&plan.ID, &plan.HouseholdID, &plan.Name, &plan.StartDate); err != nil {
+			return nil, fmt.Errorf("unable to scan meal plan: %w", err)
+		}
+		plans = append(plans, plan)
+	}
+
+	return plans, rows.Err()
+}
+
+// getMealPlan returns the plan with all of its slots, or nil if the
+// household has no plan with that id. Slots are for the latest version of
+// their recipe so regenerating or editing one doesn't leave plans behind.
+func getMealPlan(db *sql.DB, householdID, id int) (*MealPlan, error) {
+	plan := &MealPlan{}
+	err := db.QueryRow("SELECT id, household_id, name, start_date FROM meal_plans WHERE id = ? AND household_id = ?", id, householdID).Scan(&plan.ID, &plan.HouseholdID, &plan.Name, &plan.StartDate)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get meal plan: %w", err)
+	}
+
+	// slots keep the version they were planned with, every new version is
+	// a child of the last so the newest is the highest ID below it
+	rows, err := db.Query(`
+WITH RECURSIVE
+    versions(slot_id, recipe_id) AS (
+        SELECT id, recipe_id FROM meal_plan_slots WHERE plan_id = ?
+        UNION SELECT v.slot_id, r.id FROM recipes r JOIN versions v ON r.parent_id = v.recipe_id
+    ),
+    latest(slot_id, recipe_id) AS (
+        SELECT slot_id, MAX(recipe_id) FROM versions GROUP BY slot_id
+    )
+SELECT s.id, s.plan_id, s.date, s.meal, l.recipe_id, r.name, s.servings
+FROM meal_plan_slots s JOIN latest l ON l.slot_id = s.id LEFT JOIN recipes r ON r.id = l.recipe_id
+WHERE s.plan_id = ?
+ORDER BY s.date, s.id`, id, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query meal plan slots: %w", err)
+	}
+	defer rows.Close()
+
+	plan.Slots = []*MealSlot{}
+	for rows.Next() {
+		slot := &MealSlot{}
+		var recipeNameN sql.NullString
+		if err := rows.Scan(&slot.ID, &slot.PlanID, &slot.Date, &slot.Meal, &slot.RecipeID, &recipeNameN, &slot.Servings); err != nil {
+			return nil, fmt.Errorf("unable to scan meal plan slot: %w", err)
+		}
+		slot.RecipeName = recipeNameN.String
+		plan.Slots = append(plan.Slots, slot)
+	}
+
+	return plan, rows.Err()
+}
+
+func insertMealPlan(db *sql.DB, plan *MealPlan) error {
+	res, err := db.Exec("INSERT INTO meal_plans(household_id, name, start_date) values(?,?,?)", plan.HouseholdID, plan.Name, plan.StartDate)
+	if err != nil {
+		return fmt.Errorf("unable to insert meal plan: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("unable to read meal plan id: %w", err)
+	}
+	plan.ID = int(id)
+	return nil
+}
+
+func updateMealPlan(db *sql.DB, plan *MealPlan) error {
+	if _, err := db.Exec("UPDATE meal_plans SET name = ?, start_date = ? WHERE id = ? AND household_id = ?", plan.Name, plan.StartDate, plan.ID, plan.HouseholdID); err != nil {
+		return fmt.Errorf("unable to update meal plan: %w", err)
+	}
+	return nil
+}
+
+func deleteMealPlan(db *sql.DB, householdID, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning db transaction for plan deletion: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM meal_plan_slots WHERE plan_id IN (SELECT id FROM meal_plans WHERE id = ? AND household_id = ?)", id, householdID); err != nil {
+		return fmt.Errorf("unable to delete meal plan slots: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM meal_plans WHERE id = ? AND household_id = ?", id, householdID); err != nil {
+		return fmt.Errorf("unable to delete meal plan: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit plan deletion: %w", err)
+	}
+	return nil
+}
+
+func insertMealSlot(db *sql.DB, slot *MealSlot) error {
+	res, err := db.Exec("INSERT INTO meal_plan_slots(plan_id, date, meal, recipe_id, servings) values(?,?,?,?,?)",
+		slot.PlanID, slot.Date, slot.Meal, slot.RecipeID, slot.Servings)
+	if err != nil {
+		return fmt.Errorf("unable to insert meal plan slot: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("unable to read meal plan slot id: %w", err)
+	}
+	slot.ID = int(id)
+	return nil
+}
+
+func updateMealSlot(db *sql.DB, slot *MealSlot) error {
+	if _, err := db.Exec("UPDATE meal_plan_slots SET date = ?, meal = ?, recipe_id = ?, servings = ? WHERE id = ? AND plan_id = ?",
+		slot.Date, slot.Meal, slot.RecipeID, slot.Servings, slot.ID, slot.PlanID); err != nil {
+		return fmt.Errorf("unable to update meal plan slot: %w", err)
+	}
+	return nil
+}
+
+func deleteMealSlot(db *sql.DB, planID, slotID int) error {
+	if _, err := db.Exec("DELETE FROM meal_plan_slots WHERE id = ? AND plan_id = ?", slotID, planID); err != nil {
+		return fmt.Errorf("unable to delete meal plan slot: %w", err)
+	}
+	return nil
+}
+
+// suggestRecipes returns the recipes tagged as suitable for the meal, sorted
+// so that anything not already in the plan comes first
+func suggestRecipes(recipes []*Recipe, meal string, plan *MealPlan) []*Recipe {
+	planned := map[int]bool{}
+	if plan != nil {
+		for _, s := range plan.Slots {
+			planned[s.RecipeID] = true
+		}
+	}
+
+	suggestions := []*Recipe{}
+	for _, r := range recipes {
+		if recipeHasAnyTag(r, mealTags[meal]) {
+			suggestions = append(suggestions, r)
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if planned[suggestions[i].ID] != planned[suggestions[j].ID] {
+			return !planned[suggestions[i].ID]
+		}
+		return strings.ToLower(suggestions[i].Name) < strings.ToLower(suggestions[j].Name)
+	})
+
+	return suggestions
+}
+
+func recipeHasAnyTag(r *Recipe, tags []string) bool {
+	for _, t := range r.Tags {
+		for _, want := range tags {
+			if strings.EqualFold(strings.TrimSpace(t), want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// planWeekDay is one column of the calendar, slots are keyed by meal
+type planWeekDay struct {
+	Date  string
+	Label string
+	Slots map[string][]*MealSlot
+}
+
+type planPage struct {
+	Plan        *MealPlan
+	Week        int
+	Days        []*planWeekDay
+	Meals       []string
+	Suggestions map[string][]*Recipe
+	Recipes     []*Recipe
+	CalendarURL string
+}
+
+func buildPlanWeek(plan *MealPlan, week int) []*planWeekDay {
+	start, _ := time.Parse(planDateFormat, plan.StartDate)
+	start = start.AddDate(0, 0, 7*week)
+
+	days := []*planWeekDay{}
+	byDate := map[string]*planWeekDay{}
+	for i := 0; i < 7; i++ {
+		d := start.AddDate(0, 0, i)
+		day := &planWeekDay{
+			Date:  d.Format(planDateFormat),
+			Label: d.Format("Mon 2 Jan"),
+			Slots: map[string][]*MealSlot{},
+		}
+		days = append(days, day)
+		byDate[day.Date] = day
+	}
+
+	for _, s := range plan.Slots {
+		if day, ok := byDate[s.Date]; ok {
+			day.Slots[s.Meal] = append(day.Slots[s.Meal], s)
+		}
+	}
+
+	return days
+}
+
+func mealPlans(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			plans, err := getMealPlans(db, requestUser(r).HouseholdID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error getting meal plans: %v", err)
+				return
+			}
+			if err := renderTemplate(w, r, "plans.html", plans); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error rendering plans: %v", err)
+			}
+			return
+		case http.MethodPost:
+			break
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error parsing form: %v", err)
+			return
+		}
+
+		plan := &MealPlan{
+			HouseholdID: requestUser(r).HouseholdID,
+			Name:        r.FormValue("name"),
+			StartDate:   r.FormValue("start_date"),
+		}
+		if err := plan.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		if err := insertMealPlan(db, plan); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to create meal plan: %v", err)
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/plan?id=%d", plan.ID), http.StatusFound)
+	}
+}
+
+func mealPlan(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		planID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: plan ID must be an integer")
+			return
+		}
+
+		plan, err := getMealPlan(db, requestUser(r).HouseholdID, planID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error getting meal plan: %v", err)
+			return
+		}
+		if plan == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: meal plan not found")
+			return
+		}
+
+		week := 0
+		if weekParam := r.URL.Query().Get("week"); weekParam != "" {
+			if week, err = strconv.Atoi(weekParam); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: week must be an integer")
+				return
+			}
+		}
+
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error parsing form: %v", err)
+				return
+			}
+
+			status, err := applyPlanFormAction(db, plan, r)
+			if err != nil {
+				w.WriteHeader(status)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+
+			if r.FormValue("action") == "delete" {
+				http.Redirect(w, r, "/plans", http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf("/plan?id=%d&week=%d", plan.ID, week), http.StatusFound)
+			return
+		}
+
+		recipes, err := getAllRecipes(db, plan.HouseholdID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error fetching recipes: %v", err)
+			return
+		}
+		sort.Slice(recipes, func(i, j int) bool {
+			return strings.ToLower(recipes[i].Name) < strings.ToLower(recipes[j].Name)
+		})
+
+		page := &planPage{
+			Plan:        plan,
+			Week:        week,
+			Days:        buildPlanWeek(plan, week),
+			Meals:       meals,
+			Suggestions: map[string][]*Recipe{},
+			Recipes:     recipes,
+		}
+		for _, meal := range meals {
+			page.Suggestions[meal] = suggestRecipes(recipes, meal, plan)
+		}
+
+		token, err := getCalendarToken(db, requestUsername(r))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		page.CalendarURL = fmt.Sprintf("%s/plan.ics?id=%d&token=%s", requestBaseURL(r), plan.ID, token)
+
+		if err := renderTemplate(w, r, "plan.html", page); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error rendering plan: %v", err)
+		}
+	}
+}
+
+// applyPlanFormAction handles the forms on plan.html, html forms can only
+// POST so the action field picks the change
+func applyPlanFormAction(db *sql.DB, plan *MealPlan, r *http.Request) (int, error) {
+	switch r.FormValue("action") {
+	case "add":
+		recipeID, _ := strconv.Atoi(r.FormValue("recipe_id"))
+		servings, _ := strconv.Atoi(r.FormValue("servings"))
+		slot := &MealSlot{
+			PlanID:   plan.ID,
+			Date:     r.FormValue("date"),
+			Meal:     r.FormValue("meal"),
+			RecipeID: recipeID,
+			Servings: servings,
+		}
+		if err := slot.validate(); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if recipe, err := getRecipeByID(db, plan.HouseholdID, recipeID); err != nil || recipe == nil {
+			return http.StatusBadRequest, fmt.Errorf("recipe %d not found", recipeID)
+		}
+		if err := insertMealSlot(db, slot); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "remove":
+		slotID, err := strconv.Atoi(r.FormValue("slot_id"))
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("slot ID must be an integer")
+		}
+		if err := deleteMealSlot(db, plan.ID, slotID); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "rename":
+		plan.Name = r.FormValue("name")
+		if startDate := r.FormValue("start_date"); startDate != "" {
+			plan.StartDate = startDate
+		}
+		if err := plan.validate(); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if err := updateMealPlan(db, plan); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "delete":
+		if err := deleteMealPlan(db, plan.HouseholdID, plan.ID); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "reset_calendar":
+		if _, err := resetCalendarToken(db, requestUsername(r)); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown action %q", r.FormValue("action"))
+	}
+
+	return http.StatusOK, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error marshalling response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// apiMealPlans serves the JSON API for plans:
+//
+//	/api/plans                     GET list, POST create
+//	/api/plans/{id}                GET, PUT, DELETE
+//	/api/plans/{id}/slots          POST add a slot
+//	/api/plans/{id}/slots/{slotID} PUT, DELETE
+func apiMealPlans(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/plans"), "/"), "/")
+		if parts[0] == "" {
+			parts = nil
+		}
+
+		if len(parts) == 0 {
+			switch r.Method {
+			case http.MethodGet:
+				plans, err := getMealPlans(db, requestUser(r).HouseholdID)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintf(w, "error getting meal plans: %v", err)
+					return
+				}
+				writeJSON(w, http.StatusOK, plans)
+			case http.MethodPost:
+				plan := &MealPlan{}
+				if err := json.NewDecoder(r.Body).Decode(plan); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "error decoding plan: %v", err)
+					return
+				}
+				if err := plan.validate(); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "error: %v", err)
+					return
+				}
+				plan.Slots = nil
+				plan.HouseholdID = requestUser(r).HouseholdID
+				if err := insertMealPlan(db, plan); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintf(w, "error: %v", err)
+					return
+				}
+				writeJSON(w, http.StatusCreated, plan)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				fmt.Fprintf(w, "error: method not allowed")
+			}
+			return
+		}
+
+		planID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: plan ID must be an integer")
+			return
+		}
+		plan, err := getMealPlan(db, requestUser(r).HouseholdID, planID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error getting meal plan: %v", err)
+			return
+		}
+		if plan == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: meal plan not found")
+			return
+		}
+
+		switch {
+		case len(parts) == 1:
+			apiMealPlan(db, plan, w, r)
+		case len(parts) >= 2 && parts[1] == "slots" && len(parts) <= 3:
+			slotID := 0
+			if len(parts) == 3 {
+				if slotID, err = strconv.Atoi(parts[2]); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "error: slot ID must be an integer")
+					return
+				}
+			}
+			apiMealSlot(db, plan, slotID, w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: not found")
+		}
+	}
+}
+
+func apiMealPlan(db *sql.DB, plan *MealPlan, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, plan)
+	case http.MethodPut:
+		update := &MealPlan{}
+		if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error decoding plan: %v", err)
+			return
+		}
+		plan.Name, plan.StartDate = update.Name, update.StartDate
+		if err := plan.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if err := updateMealPlan(db, plan); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, plan)
+	case http.MethodDelete:
+		if err := deleteMealPlan(db, plan.HouseholdID, plan.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "error: method not allowed")
+	}
+}
+
+func apiMealSlot(db *sql.DB, plan *MealPlan, slotID int, w http.ResponseWriter, r *http.Request) {
+	var existing *MealSlot
+	if slotID != 0 {
+		for _, s := range plan.Slots {
+			if s.ID == slotID {
+				existing = s
+			}
+		}
+		if existing == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: slot not found")
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodPost && existing == nil, r.Method == http.MethodPut && existing != nil:
+		slot := &MealSlot{}
+		if err := json.NewDecoder(r.Body).Decode(slot); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error decoding slot: %v", err)
+			return
+		}
+		slot.PlanID = plan.ID
+		if err := slot.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		recipe, err := getRecipeByID(db, plan.HouseholdID, slot.RecipeID)
+		if err != nil || recipe == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: recipe %d not found", slot.RecipeID)
+			return
+		}
+		slot.RecipeName = recipe.Name
+
+		if existing == nil {
+			if err := insertMealSlot(db, slot); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, slot)
+			return
+		}
+
+		slot.ID = existing.ID
+		if err := updateMealSlot(db, slot); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, slot)
+	case r.Method == http.MethodDelete && existing != nil:
+		if err := deleteMealSlot(db, plan.ID, existing.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "error: method not allowed")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func Test_mealPlan_crud(t *testing.T) {
+	db := newTestDB(t)
+
+	plan := &MealPlan{HouseholdID: defaultHouseholdID, Name: "Week one", StartDate: "2024-03-04"}
+	if err := insertMealPlan(db, plan); err != nil {
+		t.Fatal(err)
+	}
+	recipe, err := insertRecipeVersion(db, &Recipe{Name: "Curry", HouseholdID: defaultHouseholdID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slot := &MealSlot{PlanID: plan.ID, Date: "2024-03-05", Meal: "dinner", RecipeID: recipe.ID, Servings: 2}
+	if err := insertMealSlot(db, slot); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := getMealPlan(db, defaultHouseholdID, plan.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*MealSlot{{ID: slot.ID, PlanID: plan.ID, Date: "2024-03-05", Meal: "dinner", RecipeID: recipe.ID, RecipeName: "Curry", Servings: 2}}
+	if got == nil || got.Name != "Week one" || !reflect.DeepEqual(got.Slots, want) {
+		t.Fatalf("getMealPlan() = %+v, want slots %+v", got, want)
+	}
+
+	if other, err := getMealPlan(db, defaultHouseholdID+1, plan.ID); err != nil || other != nil {
+		t.Errorf("expected other households not to see the plan, got %+v, %v", other, err)
+	}
+
+	plan.Name, plan.StartDate = "Week two", "2024-03-11"
+	if err := updateMealPlan(db, plan); err != nil {
+		t.Fatal(err)
+	}
+	slot.Date, slot.Meal, slot.Servings = "2024-03-12", "lunch", 4
+	if err := updateMealSlot(db, slot); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = getMealPlan(db, defaultHouseholdID, plan.ID)
+	if got.Name != "Week two" || got.StartDate != "2024-03-11" {
+		t.Errorf("plan wasn't updated, got %+v", got)
+	}
+	if s := got.Slots[0]; s.Date != "2024-03-12" || s.Meal != "lunch" || s.Servings != 4 {
+		t.Errorf("slot wasn't updated, got %+v", s)
+	}
+
+	if err := deleteMealSlot(db, plan.ID, slot.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = getMealPlan(db, defaultHouseholdID, plan.ID); len(got.Slots) != 0 {
+		t.Errorf("expected slot to be deleted, got %+v", got.Slots)
+	}
+
+	if err := deleteMealPlan(db, defaultHouseholdID, plan.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = getMealPlan(db, defaultHouseholdID, plan.ID); got != nil {
+		t.Errorf("expected plan to be deleted, got %+v", got)
+	}
+}
+
+func Test_getMealPlan_latestVersion(t *testing.T) {
+	db := newTestDB(t)
+
+	v1, err := insertRecipeVersion(db, &Recipe{Name: "Curry", HouseholdID: defaultHouseholdID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := insertRecipeVersion(db, &Recipe{Name: "Soup", HouseholdID: defaultHouseholdID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := &MealPlan{HouseholdID: defaultHouseholdID, Name: "Week", StartDate: "2024-03-04"}
+	if err := insertMealPlan(db, plan); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{v1.ID, other.ID} {
+		if err := insertMealSlot(db, &MealSlot{PlanID: plan.ID, Date: "2024-03-04", Meal: "dinner", RecipeID: id, Servings: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// regenerating and then renaming leaves the slot two versions behind
+	v1.Content = &RecipeContent{Servings: 2, Ingredients: map[string]*IngredientAmount{"rice": {"150", "g"}}}
+	v2, err := insertRecipeVersion(db, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2.Name = "Chicken curry"
+	v3, err := insertRecipeVersion(db, v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := getMealPlan(db, defaultHouseholdID, plan.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := got.Slots[0]; s.RecipeID != v3.ID || s.RecipeName != "Chicken curry" {
+		t.Errorf("slot = %d %q, want the latest version %d %q", s.RecipeID, s.RecipeName, v3.ID, "Chicken curry")
+	}
+	if s := got.Slots[1]; s.RecipeID != other.ID || s.RecipeName != "Soup" {
+		t.Errorf("slot = %d %q, want the unchanged recipe %d", s.RecipeID, s.RecipeName, other.ID)
+	}
+
+	selections, _, _, err := shoppingSelectionFromQuery(db, defaultHouseholdID, url.Values{"plan": {strconv.Itoa(plan.ID)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selections) != 2 || selections[0].Recipe.ID != v3.ID || selections[0].Recipe.Content == nil {
+		t.Errorf("expected the shopping list to use the latest version, got %+v", selections)
+	}
+}
+
+func Test_suggestRecipes(t *testing.T) {
+	recipes := []*Recipe{
+		{ID: 1, Name: "porridge", Tags: []string{"Breakfast"}},
+		{ID: 2, Name: "Curry", Tags: []string{"Dinner", "Spicy"}},
+		{ID: 3, Name: "Bolognese", Tags: []string{" main course "}},
+		{ID: 4, Name: "Soup", Tags: []string{"Soup"}},
+		{ID: 5, Name: "Apple pie", Tags: []string{"Supper"}},
+	}
+	plan := &MealPlan{Slots: []*MealSlot{{RecipeID: 3}}}
+
+	names := func(list []*Recipe) []string {
+		out := []string{}
+		for _, r := range list {
+			out = append(out, r.Name)
+		}
+		return out
+	}
+
+	tests := []struct {
+		meal string
+		plan *MealPlan
+		want []string
+	}{
+		{"dinner", nil, []string{"Apple pie", "Bolognese", "Curry"}},
+		{"dinner", plan, []string{"Apple pie", "Curry", "Bolognese"}},
+		{"breakfast", plan, []string{"porridge"}},
+		{"lunch", plan, []string{"Soup"}},
+		{"snack", plan, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.meal, func(t *testing.T) {
+			if got := names(suggestRecipes(recipes, tt.meal, tt.plan)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("suggestRecipes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_shoppingSelectionFromQuery_plan(t *testing.T) {
+	db := newTestDB(t)
+
+	curry, err := insertRecipeVersion(db, &Recipe{Name: "Curry", HouseholdID: defaultHouseholdID, Content: &RecipeContent{
+		Servings:    2,
+		Ingredients: map[string]*IngredientAmount{"onion": {"200", "g"}, "rice": {"150", "g"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := &MealPlan{HouseholdID: defaultHouseholdID, Name: "Week", StartDate: "2024-03-04"}
+	if err := insertMealPlan(db, plan); err != nil {
+		t.Fatal(err)
+	}
+	// twice in the first week and once in the second
+	for _, date := range []string{"2024-03-04", "2024-03-06", "2024-03-12"} {
+		if err := insertMealSlot(db, &MealSlot{PlanID: plan.ID, Date: date, Meal: "dinner", RecipeID: curry.ID, Servings: 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	selections, key, title, err := shoppingSelectionFromQuery(db, defaultHouseholdID, url.Values{"plan": {strconv.Itoa(plan.ID)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "plan:"+strconv.Itoa(plan.ID)+":0" || title != "Shopping for Week (week of 4 Mar)" {
+		t.Errorf("key, title = %q, %q", key, title)
+	}
+
+	items := map[string]string{}
+	for _, aisle := range buildShoppingList(selections).Aisles {
+		for _, item := range aisle.Items {
+			items[item.Name] = item.Quantity
+		}
+	}
+	if want := map[string]string{"onion": "800 g", "rice": "600 g"}; !reflect.DeepEqual(items, want) {
+		t.Errorf("shopping list = %v, want %v", items, want)
+	}
+
+	if _, _, _, err := shoppingSelectionFromQuery(db, defaultHouseholdID+1, url.Values{"plan": {strconv.Itoa(plan.ID)}}); err == nil {
+		t.Errorf("expected another household's plan not to be found")
+	}
+}
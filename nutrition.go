@@ -0,0 +1,297 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// nutritionCSV is the food composition table, see the comment at the top of
+// the file for what the columns mean
+//
+//go:embed nutrition.csv
+var nutritionCSV string
+
+// Nutrients are energy in kcal and everything else in grams
+type Nutrients struct {
+	Energy  float64 `json:"kcal"`
+	Protein float64 `json:"protein_g"`
+	Fat     float64 `json:"fat_g"`
+	Carbs   float64 `json:"carbohydrate_g"`
+	Fibre   float64 `json:"fibre_g"`
+	Salt    float64 `json:"salt_g"`
+}
+
+func (n Nutrients) scale(f float64) Nutrients {
+	return Nutrients{n.Energy * f, n.Protein * f, n.Fat * f, n.Carbs * f, n.Fibre * f, n.Salt * f}
+}
+
+func (n Nutrients) add(o Nutrients) Nutrients {
+	return Nutrients{n.Energy + o.Energy, n.Protein + o.Protein, n.Fat + o.Fat, n.Carbs + o.Carbs, n.Fibre + o.Fibre, n.Salt + o.Salt}
+}
+
+// Sodium is in milligrams, labels outside the UK give sodium not salt
+func (n Nutrients) Sodium() float64 {
+	return n.Salt / 2.5 * 1000
+}
+
+// Food is a row of the composition table
+type Food struct {
+	Name    string
+	Per100g Nutrients
+	// Density is grams per millilitre
+	Density float64
+	// ItemWeight is the weight of one whole one, 0 when it's not something
+	// you'd count
+	ItemWeight float64
+	// UnitWeights are grams per count unit such as clove or can
+	UnitWeights map[string]float64
+}
+
+type foodKeyword struct {
+	words []string
+	food  *Food
+}
+
+// genericUnitWeights are used when a food doesn't have its own weight for
+// a unit, they're rough but better than leaving the ingredient out
+var genericUnitWeights = map[string]float64{
+	"can":     400,
+	"jar":     350,
+	"handful": 30,
+	"pinch":   0.3,
+	"sprig":   1,
+	"slice":   30,
+	"bunch":   30,
+	"rasher":  25,
+	"fillet":  140,
+}
+
+// foodKeywords are the names and aliases of every food by their first word
+var foodKeywords = mustParseFoods(nutritionCSV)
+
+func mustParseFoods(text string) map[string][]foodKeyword {
+	keywords, err := parseFoods(text)
+	if err != nil {
+		panic(fmt.Sprintf("nutrition.csv: %v", err))
+	}
+	return keywords
+}
+
+// parseFoods reads the composition table into an index of the names and
+// aliases of its foods by first word
+func parseFoods(text string) (map[string][]foodKeyword, error) {
+	r := csv.NewReader(strings.NewReader(text))
+	r.Comment = '#'
+	r.FieldsPerRecord = 11
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || records[0][0] != "name" {
+		return nil, fmt.Errorf("missing header")
+	}
+
+	keywords := map[string][]foodKeyword{}
+	for i, rec := range records[1:] {
+		line := i + 2
+		values := make([]float64, 6)
+		for j := range values {
+			if values[j], err = strconv.ParseFloat(rec[2+j], 64); err != nil {
+				return nil, fmt.Errorf("row %d: %v", line, err)
+			}
+		}
+		food := &Food{
+			Name:        rec[0],
+			Per100g:     Nutrients{values[0], values[1], values[2], values[3], values[4], values[5]},
+			Density:     1,
+			UnitWeights: map[string]float64{},
+		}
+		if rec[8] != "" {
+			if food.Density, err = strconv.ParseFloat(rec[8], 64); err != nil {
+				return nil, fmt.Errorf("row %d: bad density: %v", line, err)
+			}
+		}
+		if rec[9] != "" {
+			if food.ItemWeight, err = strconv.ParseFloat(rec[9], 64); err != nil {
+				return nil, fmt.Errorf("row %d: bad item weight: %v", line, err)
+			}
+		}
+		for _, uw := range splitNonEmpty(rec[10], ";") {
+			unit, weight, _ := strings.Cut(uw, "=")
+			g, err := strconv.ParseFloat(weight, 64)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: bad weight for %q: %v", line, unit, err)
+			}
+			canonical, _ := normalizeUnit(unit)
+			food.UnitWeights[canonical] = g
+		}
+
+		for _, name := range append([]string{rec[0]}, splitNonEmpty(rec[1], ";")...) {
+			words := ingredientWords(name)
+			if len(words) == 0 {
+				return nil, fmt.Errorf("row %d: empty name", line)
+			}
+			keywords[words[0]] = append(keywords[words[0]], foodKeyword{words, food})
+		}
+	}
+	return keywords, nil
+}
+
+func splitNonEmpty(s, sep string) []string {
+	parts := []string{}
+	for _, p := range strings.Split(s, sep) {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// matchFood finds the food an ingredient is. The longest name or alias in
+// it wins so "coconut milk" isn't milk, between two the same length the
+// later one wins as that's usually the noun ("chicken stock").
+func matchFood(name string) *Food {
+	words := ingredientWords(name)
+	var best *Food
+	bestLen, bestEnd := 0, 0
+	for i, w := range words {
+		for _, k := range foodKeywords[w] {
+			end := i + len(k.words)
+			if end > len(words) || !equalWords(words[i:end], k.words) {
+				continue
+			}
+			if len(k.words) > bestLen || (len(k.words) == bestLen && end > bestEnd) {
+				best, bestLen, bestEnd = k.food, len(k.words), end
+			}
+		}
+	}
+	return best
+}
+
+func equalWords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// grams converts a quantity of the food to a weight, using the density for
+// volumes and item or unit weights for counts
+func (f *Food) grams(name string, q Quantity) (float64, bool) {
+	switch q.Unit {
+	case "g":
+		return q.Value, true
+	case "ml":
+		return q.Value * f.Density, true
+	case "":
+		if f.ItemWeight > 0 {
+			return q.Value * f.ItemWeight, true
+		}
+		if w, ok := itemWeights[name]; ok {
+			return q.Value * w, true
+		}
+		return 0, false
+	}
+	if w, ok := f.UnitWeights[q.Unit]; ok {
+		return q.Value * w, true
+	}
+	if w, ok := genericUnitWeights[q.Unit]; ok {
+		return q.Value * w, true
+	}
+	return 0, false
+}
+
+// Reasons an ingredient isn't counted in the nutrition
+const (
+	nutritionNotInTable   = "not in the food table"
+	nutritionNoAmount     = "no amount given"
+	nutritionUnknownUnits = "can't convert its units to a weight"
+)
+
+// NutritionIngredient is one ingredient of the recipe and how much it
+// counted for, Reason is set when it wasn't counted
+type NutritionIngredient struct {
+	Name   string  `json:"name"`
+	Food   string  `json:"food,omitempty"`
+	Grams  float64 `json:"grams,omitempty"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// Nutrition is an estimate of what's in a recipe. It's an underestimate
+// when anything is Unmatched, those ingredients aren't counted at all.
+type Nutrition struct {
+	// Servings is how many the recipe makes, Total is divided by it
+	Servings   int                    `json:"servings"`
+	Total      Nutrients              `json:"total"`
+	PerServing Nutrients              `json:"per_serving"`
+	Matched    []*NutritionIngredient `json:"matched"`
+	Unmatched  []*NutritionIngredient `json:"unmatched"`
+}
+
+// Complete is true when every ingredient was counted
+func (n *Nutrition) Complete() bool {
+	return len(n.Unmatched) == 0
+}
+
+// For is the nutrition of the given number of servings
+func (n *Nutrition) For(servings int) Nutrients {
+	return n.PerServing.scale(float64(servings))
+}
+
+// recipeNutrition estimates the nutrition of a recipe from the composition
+// table, it's nil for recipes that haven't been generated
+func recipeNutrition(recipe *Recipe) *Nutrition {
+	if recipe.Content == nil || len(recipe.Content.Ingredients) == 0 {
+		return nil
+	}
+
+	n := &Nutrition{Servings: recipe.Content.Servings, Matched: []*NutritionIngredient{}, Unmatched: []*NutritionIngredient{}}
+	if n.Servings < 1 {
+		n.Servings = 1
+	}
+
+	names := []string{}
+	for name := range recipe.Content.Ingredients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		normalized, q, ok := parseIngredientQuantity(name, recipe.Content.Ingredients[name])
+		ingredient := &NutritionIngredient{Name: name}
+		food := matchFood(normalized)
+		switch {
+		case food == nil:
+			ingredient.Reason = nutritionNotInTable
+		case !ok:
+			ingredient.Reason = nutritionNoAmount
+		default:
+			ingredient.Food = food.Name
+			grams, ok := food.grams(normalized, q)
+			if !ok {
+				ingredient.Reason = nutritionUnknownUnits
+				break
+			}
+			ingredient.Grams = math.Round(grams*10) / 10
+			n.Total = n.Total.add(food.Per100g.scale(grams / 100))
+		}
+		if ingredient.Reason != "" {
+			n.Unmatched = append(n.Unmatched, ingredient)
+		} else {
+			n.Matched = append(n.Matched, ingredient)
+		}
+	}
+
+	n.PerServing = n.Total.scale(1 / float64(n.Servings))
+	return n
+}
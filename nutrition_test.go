@@ -0,0 +1,178 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func Test_matchFood(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"onion", "onion"},
+		{"red onions", "onion"},
+		{"coconut milk", "coconut milk"},
+		{"milk", "milk"},
+		{"chicken stock", "stock"},
+		{"chicken thighs", "chicken thigh"},
+		{"egg noodles", "egg noodle"},
+		{"peanut butter", "peanut butter"},
+		{"bay leaves", "bay leaf"},
+		{"salt and black pepper", "black pepper"},
+		{"caesar salad dressing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if food := matchFood(tt.name); food != nil {
+				got = food.Name
+			}
+			if got != tt.want {
+				t.Errorf("matchFood() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Food_grams(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount *IngredientAmount
+		want   float64
+		wantOK bool
+	}{
+		{"butter", &IngredientAmount{"50", "g"}, 50, true},
+		{"olive oil", &IngredientAmount{"2", "tbsp"}, 27.3, true},
+		{"honey", &IngredientAmount{"1", "tbsp"}, 21.3, true},
+		{"onions", &IngredientAmount{"2", ""}, 300, true},
+		{"garlic", &IngredientAmount{"3", "cloves"}, 15, true},
+		{"chopped tomatoes", &IngredientAmount{"1", "tin"}, 400, true},
+		{"chickpeas", &IngredientAmount{"1", "can"}, 240, true},
+		{"3 rashers of bacon", nil, 75, true},
+		{"rice", &IngredientAmount{"1", "cup"}, 212.5, true},
+		{"spinach", &IngredientAmount{"1", ""}, 0, false},
+		{"mince", &IngredientAmount{"1", "punnet"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, q, ok := parseIngredientQuantity(tt.name, tt.amount)
+			if !ok {
+				t.Fatalf("parseIngredientQuantity(%q) failed", tt.name)
+			}
+			food := matchFood(name)
+			if food == nil {
+				t.Fatalf("no food for %q", name)
+			}
+			got, ok := food.grams(name, q)
+			if ok != tt.wantOK || math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("grams() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_recipeNutrition(t *testing.T) {
+	if recipeNutrition(&Recipe{Name: "Not generated"}) != nil {
+		t.Errorf("recipeNutrition() should be nil without content")
+	}
+
+	recipe := &Recipe{Content: &RecipeContent{
+		Servings: 2,
+		Ingredients: map[string]*IngredientAmount{
+			"butter":                {"100", "g"},
+			"sugar":                 {"100", "g"},
+			"salt and pepper":       {"", ""},
+			"gochujang":             {"1", "tbsp"},
+			"spinach":               {"1", ""},
+			"plain flour, sifted":   {"200", "g"},
+			"Salted caramel sauce ": nil,
+		},
+	}}
+	got := recipeNutrition(recipe)
+
+	want := Nutrients{Energy: 740 + 400 + 682, Protein: 0.6 + 18.8, Fat: 82 + 2.6, Carbs: 0.6 + 100 + 154, Fibre: 6.2, Salt: 1.5}
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"energy", got.Total.Energy, want.Energy},
+		{"protein", got.Total.Protein, want.Protein},
+		{"fat", got.Total.Fat, want.Fat},
+		{"carbs", got.Total.Carbs, want.Carbs},
+		{"fibre", got.Total.Fibre, want.Fibre},
+		{"salt", got.Total.Salt, want.Salt},
+		{"energy per serving", got.PerServing.Energy, want.Energy / 2},
+		{"energy for 3", got.For(3).Energy, want.Energy / 2 * 3},
+	} {
+		if math.Abs(c.got-c.want) > 0.01 {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+
+	reasons := map[string]string{}
+	for _, i := range got.Unmatched {
+		reasons[i.Name] = i.Reason
+	}
+	wantReasons := map[string]string{
+		"salt and pepper":       nutritionNoAmount,
+		"gochujang":             nutritionNotInTable,
+		"spinach":               nutritionUnknownUnits,
+		"Salted caramel sauce ": nutritionNotInTable,
+	}
+	if !reflect.DeepEqual(reasons, wantReasons) || len(got.Matched) != 3 || got.Complete() {
+		t.Errorf("unmatched = %v, want %v with 3 matched", reasons, wantReasons)
+	}
+}
+
+func Test_parseFoods(t *testing.T) {
+	header := "name,aliases,kcal,protein,fat,carbs,fibre,salt,density,item_weight,unit_weights\n"
+	tests := []struct {
+		name    string
+		text    string
+		wantErr bool
+	}{
+		{"embedded table", nutritionCSV, false},
+		{"comments", "# a comment\n" + header + "tofu,,126,12.6,7.6,0.8,0.3,0.01,,,block=280\n", false},
+		{"no header", "tofu,,126,12.6,7.6,0.8,0.3,0.01,,,\n", true},
+		{"bad number", header + "tofu,,lots,12.6,7.6,0.8,0.3,0.01,,,\n", true},
+		{"bad unit weight", header + "tofu,,126,12.6,7.6,0.8,0.3,0.01,,,block\n", true},
+		{"missing column", header + "tofu,,126,12.6,7.6,0.8,0.3,0.01,,\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseFoods(tt.text); (err != nil) != tt.wantErr {
+				t.Errorf("parseFoods() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_recipeJSONLD(t *testing.T) {
+	recipe := &Recipe{Name: "Greens", Tags: []string{"Vegan", "Quick"}, Content: &RecipeContent{
+		Servings:    1,
+		Ingredients: map[string]*IngredientAmount{"spinach": {"100", "g"}, "olive oil": {"1", "tbsp"}},
+		MethodLines: []string{"Wilt the spinach in the oil"},
+	}}
+	ld := recipeJSONLD(recipe, recipeNutrition(recipe), classifyRecipe(recipe, nil))
+
+	if !reflect.DeepEqual(ld["recipeIngredient"], []string{"1 tbsp olive oil", "100 g spinach"}) {
+		t.Errorf("recipeIngredient = %v", ld["recipeIngredient"])
+	}
+	nutrition, _ := ld["nutrition"].(map[string]string)
+	if nutrition["calories"] != "143.7 kcal" || nutrition["sodiumContent"] != "80.0 mg" {
+		t.Errorf("nutrition = %v", nutrition)
+	}
+	if !reflect.DeepEqual(ld["suitableForDiet"], []string{"https://schema.org/VegetarianDiet", "https://schema.org/VeganDiet", "https://schema.org/GlutenFreeDiet"}) {
+		t.Errorf("suitableForDiet = %v", ld["suitableForDiet"])
+	}
+
+	bare := recipeJSONLD(&Recipe{Name: "Not generated"}, nil, classifyRecipe(&Recipe{}, nil))
+	if _, ok := bare["nutrition"]; ok {
+		t.Errorf("nutrition given for a recipe that hasn't been generated")
+	}
+	if _, ok := bare["suitableForDiet"]; ok {
+		t.Errorf("diets given for a recipe that hasn't been generated")
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcCookieName   = "oidc_login"
+	oidcLoginPath    = "/login/oidc"
+	oidcCallbackPath = "/login/oidc/callback"
+
+	// oidcLockedPassword is stored for users created by single sign on, no
+	// password ever matches it so they can only log in through the provider
+	// until someone runs `user passwd`
+	oidcLockedPassword = "!"
+)
+
+// OIDCConfig is read from the environment, single sign on is turned off
+// unless OIDC_ISSUER is set
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL defaults to the callback on whatever host the login
+	// request came in on
+	RedirectURL    string
+	AllowedDomains []string
+
+	// RolesClaim names a claim holding a list of groups. When admin or
+	// editor groups are set the user's role follows the provider on every
+	// login, otherwise new users get DefaultRole and keep whatever role an
+	// admin gives them.
+	RolesClaim   string
+	AdminGroups  []string
+	EditorGroups []string
+	DefaultRole  Role
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func oidcConfigFromEnv(getenv func(string) string) (*OIDCConfig, error) {
+	issuer := getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	config := &OIDCConfig{
+		Issuer:         strings.TrimRight(issuer, "/"),
+		ClientID:       getenv("OIDC_CLIENT_ID"),
+		ClientSecret:   getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:    getenv("OIDC_REDIRECT_URL"),
+		AllowedDomains: splitList(strings.ToLower(getenv("OIDC_ALLOWED_DOMAINS"))),
+		RolesClaim:     getenv("OIDC_ROLES_CLAIM"),
+		AdminGroups:    splitList(getenv("OIDC_ADMIN_GROUPS")),
+		EditorGroups:   splitList(getenv("OIDC_EDITOR_GROUPS")),
+	}
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID must be set when OIDC_ISSUER is")
+	}
+	if len(config.AllowedDomains) == 0 {
+		return nil, fmt.Errorf("OIDC_ALLOWED_DOMAINS must be set when OIDC_ISSUER is, otherwise anyone with an account at the provider could log in")
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = "groups"
+	}
+	if role := getenv("OIDC_DEFAULT_ROLE"); role != "" {
+		var err error
+		if config.DefaultRole, err = parseRole(role); err != nil {
+			return nil, fmt.Errorf("OIDC_DEFAULT_ROLE: %w", err)
+		}
+	}
+	return config, nil
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider does the authorization code flow with PKCE against the
+// configured issuer. Discovery is done on the first login rather than at
+// start up so the app still comes up when the provider is down.
+type OIDCProvider struct {
+	config *OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+func newOIDCProvider(config *OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	res, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := &oidcDiscovery{}
+	if err := p.getJSON(p.config.Issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("unable to discover oidc provider: %w", err)
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("oidc provider says its issuer is %q, expected %q", d.Issuer, p.config.Issuer)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// signingKey returns the provider's key with the given ID, keys are fetched
+// again when an unknown one turns up since providers rotate them
+func (p *OIDCProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("unable to fetch oidc signing keys: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown oidc signing key %q", kid)
+}
+
+// audience is a string or a list of strings in a jwt
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+
+	raw map[string]json.RawMessage
+}
+
+// groups returns the list held in the configured roles claim
+func (c *idTokenClaims) groups(claim string) []string {
+	var groups []string
+	if raw, ok := c.raw[claim]; ok {
+		json.Unmarshal(raw, &groups)
+	}
+	return groups
+}
+
+// verifyIDToken checks the token's RS256 signature against the provider's
+// keys and that it was issued to us for this login
+func (p *OIDCProvider) verifyIDToken(token, nonce string, now time.Time) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token is not a jwt")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeBase64JSON(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("unable to decode id token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("id token is signed with %s, only RS256 is supported", header.Alg)
+	}
+
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode id token signature: %w", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("id token signature is invalid")
+	}
+
+	claims := &idTokenClaims{}
+	if err := decodeBase64JSON(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("unable to decode id token claims: %w", err)
+	}
+	if err := decodeBase64JSON(parts[1], &claims.raw); err != nil {
+		return nil, fmt.Errorf("unable to decode id token claims: %w", err)
+	}
+
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.config.Issuer:
+		return nil, fmt.Errorf("id token was issued by %q", claims.Issuer)
+	case !containsString(claims.Audience, p.config.ClientID):
+		return nil, errors.New("id token is for a different client")
+	case !now.Before(time.Unix(claims.Expiry, 0)):
+		return nil, errors.New("id token has expired")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("id token nonce doesn't match this login")
+	case claims.Subject == "":
+		return nil, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeBase64JSON(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// exchangeCode swaps the authorization code for tokens, the verifier proves
+// we're the ones who started the login
+func (p *OIDCProvider) exchangeCode(code, verifier, redirectURL string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	res, err := p.client.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("unable to exchange oidc code: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("unable to read oidc token response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token endpoint returned %s: %s", res.Status, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("unable to decode oidc token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("oidc token response has no id token")
+	}
+	return tokens.IDToken, nil
+}
+
+func (p *OIDCProvider) redirectURL(r *http.Request) string {
+	if p.config.RedirectURL != "" {
+		return p.config.RedirectURL
+	}
+	return requestBaseURL(r) + oidcCallbackPath
+}
+
+// emailAllowed checks the email's domain is one of the allowed ones, the
+// provider has to say it has verified the address. A missing
+// email_verified claim is treated as unverified.
+func (p *OIDCProvider) emailAllowed(claims *idTokenClaims) error {
+	if claims.Email == "" {
+		return errors.New("the provider didn't share an email address")
+	}
+	if claims.EmailVerified == nil || !*claims.EmailVerified {
+		return fmt.Errorf("%s hasn't been verified with the provider", claims.Email)
+	}
+	at := strings.LastIndex(claims.Email, "@")
+	if at < 0 || !containsString(p.config.AllowedDomains, strings.ToLower(claims.Email[at+1:])) {
+		return fmt.Errorf("%s isn't allowed to log in here", claims.Email)
+	}
+	return nil
+}
+
+// roleFromClaims returns the role the provider's groups give the user, ok is
+// false when no groups are configured and roles are managed locally
+func (p *OIDCProvider) roleFromClaims(claims *idTokenClaims) (role Role, ok bool) {
+	if len(p.config.AdminGroups) == 0 && len(p.config.EditorGroups) == 0 {
+		return p.config.DefaultRole, false
+	}
+	role = p.config.DefaultRole
+	for _, group := range claims.groups(p.config.RolesClaim) {
+		if containsString(p.config.AdminGroups, group) {
+			return roleAdmin, true
+		}
+		if containsString(p.config.EditorGroups, group) {
+			role = roleEditor
+		}
+	}
+	return role, true
+}
+
+// errOIDCUnlinked is returned when a local user already has the username a
+// new single sign on user would get. They're never linked automatically as
+// anyone who can get the provider to vouch for the email would take over the
+// account, an admin links them with `user link`.
+var errOIDCUnlinked = errors.New("a user with that name already exists and isn't linked to the provider")
+
+// oidcUser finds or creates the local user for the provider's claims. Users
+// are found by subject, a new user is created with their email as the
+// username unless that's already taken.
+func oidcUser(db *sql.DB, p *OIDCProvider, claims *idTokenClaims) (*User, error) {
+	role, managed := p.roleFromClaims(claims)
+	username := strings.ToLower(claims.Email)
+
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users u WHERE u.oidc_subject = ?", claims.Subject))
+	if err == sql.ErrNoRows {
+		existing, err := getUser(db, username)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, errOIDCUnlinked
+		}
+		if err := insertUserHash(db, username, oidcLockedPassword, role); err != nil {
+			return nil, err
+		}
+		if err := linkOIDCSubject(db, username, claims.Subject); err != nil {
+			return nil, err
+		}
+		if user, err = getUser(db, username); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to get oidc user: %w", err)
+	}
+
+	if managed && user.Role != role {
+		if err := setUserRole(db, user.Username, role); err != nil {
+			return nil, err
+		}
+		user.Role = role
+	}
+	return user, nil
+}
+
+// linkOIDCSubject makes the provider's subject log in as the user, any
+// user it was linked to before is unlinked
+func linkOIDCSubject(db *sql.DB, username, subject string) error {
+	user, err := getUser(db, username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("no such user %s", username)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to link %s to the oidc provider: %w", username, err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET oidc_subject = NULL WHERE oidc_subject = ?", subject); err != nil {
+		return fmt.Errorf("unable to link %s to the oidc provider: %w", username, err)
+	}
+	if _, err := tx.Exec("UPDATE users SET oidc_subject = ? WHERE id = ?", subject, user.ID); err != nil {
+		return fmt.Errorf("unable to link %s to the oidc provider: %w", username, err)
+	}
+	return tx.Commit()
+}
+
+// oidcLoginState is kept in a short lived cookie between sending the user to
+// the provider and them coming back
+type oidcLoginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func oidcLogin(p *OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		d, err := p.discover()
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "error: single sign on is unavailable right now")
+			fmt.Println(err)
+			return
+		}
+
+		state := oidcLoginState{Next: safeRedirectTarget(r.URL.Query().Get("next"))}
+		for _, s := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+			if *s, err = randomString(); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: unable to start login")
+				return
+			}
+		}
+		stateJSON, _ := json.Marshal(state)
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookieName,
+			Value:    base64.RawURLEncoding.EncodeToString(stateJSON),
+			Path:     oidcLoginPath,
+			MaxAge:   int((10 * time.Minute).Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(requestBaseURL(r), "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		challenge := sha256.Sum256([]byte(state.Verifier))
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {p.config.ClientID},
+			"redirect_uri":          {p.redirectURL(r)},
+			"scope":                 {"openid email profile"},
+			"state":                 {state.State},
+			"nonce":                 {state.Nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		sep := "?"
+		if strings.Contains(d.AuthorizationEndpoint, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, d.AuthorizationEndpoint+sep+query.Encode(), http.StatusFound)
+	}
+}
+
+func oidcLoginCallback(db *sql.DB, p *OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		var state oidcLoginState
+		cookie, err := r.Cookie(oidcCookieName)
+		if err == nil {
+			err = decodeBase64JSON(cookie.Value, &state)
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: oidcLoginPath, MaxAge: -1})
+		query := r.URL.Query()
+		if err != nil || state.State == "" || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: this login has expired, try logging in again")
+			return
+		}
+		if e := query.Get("error"); e != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "error: the provider refused the login: %s %s", e, query.Get("error_description"))
+			return
+		}
+
+		idToken, err := p.exchangeCode(query.Get("code"), state.Verifier, p.redirectURL(r))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "error: unable to complete login with the provider")
+			fmt.Println(err)
+			return
+		}
+
+		now := time.Now()
+		claims, err := p.verifyIDToken(idToken, state.Nonce, now)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "error: unable to verify login: %v", err)
+			return
+		}
+		if err := p.emailAllowed(claims); err != nil {
+			audit(db, r, auditLoginFailed, claims.Email, "single sign on: "+err.Error())
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "forbidden: %v", err)
+			return
+		}
+
+		user, err := oidcUser(db, p, claims)
+		if errors.Is(err, errOIDCUnlinked) {
+			audit(db, r, auditLoginFailed, claims.Email, fmt.Sprintf("single sign on: %v, subject %s", err, claims.Subject))
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "forbidden: %s already has an account here, ask an admin to link it to single sign on", claims.Email)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to set up user")
+			fmt.Println(err)
+			return
+		}
+
+		token, session, err := createSession(db, user, now)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to start session")
+			fmt.Println(err)
+			return
+		}
+
+		audit(db, r, auditLogin, user.Username, "single sign on as "+user.Role.String())
+		setSessionCookie(w, r, token, session.ExpiresAt)
+		http.Redirect(w, r, state.Next, http.StatusSeeOther)
+	}
+}
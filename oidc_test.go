@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is a stand in oidc provider that logs in whoever Claims says
+type testIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	Claims map[string]interface{}
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	issuer := &testIssuer{key: key, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		issuer.mu.Lock()
+		issuer.codes["code-"+q.Get("state")] = q
+		issuer.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=code-"+q.Get("state")+"&state="+q.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		issuer.mu.Lock()
+		auth, ok := issuer.codes[r.PostFormValue("code")]
+		delete(issuer.codes, r.PostFormValue("code"))
+		issuer.mu.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.Get("code_challenge") || r.PostFormValue("redirect_uri") != auth.Get("redirect_uri") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":   issuer.URL,
+			"aud":   auth.Get("client_id"),
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": auth.Get("nonce"),
+		}
+		for k, v := range issuer.Claims {
+			claims[k] = v
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id_token": issuer.sign(t, claims)})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("unable to sign id token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// oidcLoginFlow goes from /login/oidc through the issuer and back to the
+// callback, returning the callback's response
+func oidcLoginFlow(t *testing.T, db *sql.DB, p *OIDCProvider, tamperState bool) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	oidcLogin(p)(w, httptest.NewRequest(http.MethodGet, "/login/oidc?next=/plans", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to the issuer, got %d: %s", w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("unable to authorize: %v", err)
+	}
+	res.Body.Close()
+
+	callback := res.Header.Get("Location")
+	if tamperState {
+		callback += "x"
+	}
+	r := httptest.NewRequest(http.MethodGet, callback, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	oidcLoginCallback(db, p)(w, r)
+	return w
+}
+
+func Test_oidcLogin(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "erin@example.com", "hunter2", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestIssuer(t)
+	p := newOIDCProvider(&OIDCConfig{
+		Issuer:         issuer.URL,
+		ClientID:       "food-archive",
+		AllowedDomains: []string{"example.com"},
+		RolesClaim:     "groups",
+		AdminGroups:    []string{"kitchen-admins"},
+		EditorGroups:   []string{"cooks"},
+	})
+
+	tests := []struct {
+		name        string
+		claims      map[string]interface{}
+		tamperState bool
+		wantCode    int
+		wantRole    Role
+	}{
+		{
+			name:     "editor from groups",
+			claims:   map[string]interface{}{"sub": "1", "email": "Alice@example.com", "email_verified": true, "groups": []string{"cooks"}},
+			wantCode: http.StatusSeeOther,
+			wantRole: roleEditor,
+		},
+		{
+			name:     "same subject promoted",
+			claims:   map[string]interface{}{"sub": "1", "email": "alice@example.com", "email_verified": true, "groups": []string{"cooks", "kitchen-admins"}},
+			wantCode: http.StatusSeeOther,
+			wantRole: roleAdmin,
+		},
+		{
+			name:     "no groups is a viewer",
+			claims:   map[string]interface{}{"sub": "2", "email": "bob@example.com", "email_verified": true},
+			wantCode: http.StatusSeeOther,
+			wantRole: roleViewer,
+		},
+		{
+			name:     "other domain",
+			claims:   map[string]interface{}{"sub": "3", "email": "mallory@example.org", "email_verified": true},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "unverified email",
+			claims:   map[string]interface{}{"sub": "4", "email": "carol@example.com", "email_verified": false},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "email_verified missing",
+			claims:   map[string]interface{}{"sub": "5", "email": "dave@example.com"},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "existing password user isn't taken over",
+			claims:   map[string]interface{}{"sub": "6", "email": "Erin@example.com", "email_verified": true, "groups": []string{"kitchen-admins"}},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:        "state mismatch",
+			claims:      map[string]interface{}{"sub": "1", "email": "alice@example.com"},
+			tamperState: true,
+			wantCode:    http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer.Claims = tt.claims
+			w := oidcLoginFlow(t, db, p, tt.tamperState)
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusSeeOther {
+				return
+			}
+			if w.Header().Get("Location") != "/plans" {
+				t.Errorf("expected to be sent back to /plans, got %s", w.Header().Get("Location"))
+			}
+
+			var token string
+			for _, c := range w.Result().Cookies() {
+				if c.Name == sessionCookieName {
+					token = c.Value
+				}
+			}
+			user, err := getSessionUser(db, token, time.Now())
+			if err != nil || user == nil {
+				t.Fatalf("expected a session, got %v", err)
+			}
+			if user.Role != tt.wantRole {
+				t.Errorf("expected %s, got %s", tt.wantRole, user.Role)
+			}
+		})
+	}
+
+	if users, _ := getUsers(db); len(users) != 3 {
+		t.Errorf("expected 2 users to be created, got %d", len(users)-1)
+	}
+	erin, _ := getUser(db, "erin@example.com")
+	if erin == nil || erin.Role != roleViewer {
+		t.Errorf("expected erin to be left alone, got %+v", erin)
+	}
+	var linked int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE oidc_subject = '6'").Scan(&linked); err != nil || linked != 0 {
+		t.Errorf("expected erin not to be linked to the provider, got %d %v", linked, err)
+	}
+
+	// once an admin links them it's the same account
+	if err := linkOIDCSubject(db, "erin@example.com", "6"); err != nil {
+		t.Fatal(err)
+	}
+	issuer.Claims = map[string]interface{}{"sub": "6", "email": "erin@example.com", "email_verified": true}
+	if w := oidcLoginFlow(t, db, p, false); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected a linked user to log in, got %d: %s", w.Code, w.Body.String())
+	}
+	if user, _ := authenticateUser(db, "erin@example.com", "hunter2"); user == nil {
+		t.Errorf("expected erin to keep their password")
+	}
+	if user, _ := authenticateUser(db, "alice@example.com", oidcLockedPassword); user != nil {
+		t.Errorf("expected single sign on users to have no password")
+	}
+}
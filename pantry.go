@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expiringWithin is how close to its expiry date a pantry item has to be
+// before cook-now starts flagging it
+const expiringWithin = 3 * 24 * time.Hour
+
+// pantryStaples are assumed to always be in the kitchen, no one wants to
+// log water in the pantry
+var pantryStaples = map[string]bool{
+	"water":                    true,
+	"salt":                     true,
+	"black pepper":             true,
+	"salt and pepper":          true,
+	"salt and pepper to taste": true,
+}
+
+type PantryItem struct {
+	ID         int       `json:"id"`
+	Ingredient string    `json:"ingredient"`
+	Quantity   *Quantity `json:"quantity,omitempty"`
+	Expires    string    `json:"expires,omitempty"`
+	Expiring   bool      `json:"expiring"`
+	Expired    bool      `json:"expired"`
+}
+
+func (p *PantryItem) Display() string {
+	if p.Quantity == nil {
+		return p.Ingredient
+	}
+	return formatQuantity(*p.Quantity) + " " + p.Ingredient
+}
+
+func getPantryItems(db *sql.DB, householdID int, now time.Time) ([]*PantryItem, error) {
+	rows, err := db.Query("SELECT id, ingredient, quantity, unit, expires FROM pantry_items WHERE household_id = ? ORDER BY ingredient", householdID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query pantry: %w", err)
+	}
+	defer rows.Close()
+
+	items := []*PantryItem{}
+	for rows.Next() {
+		var (
+			item      = &PantryItem{}
+			quantityN sql.NullFloat64
+			unitN     sql.NullString
+			expiresN  sql.NullString
+		)
+		if err := rows.Scan(&item.ID, &item.Ingredient, &quantityN, &unitN, &expiresN); err != nil {
+			return nil, fmt.Errorf("unable to scan pantry item: %w", err)
+		}
+		if quantityN.Valid {
+			item.Quantity = &Quantity{Value: quantityN.Float64, Unit: unitN.String}
+		}
+		if expiresN.Valid && expiresN.String != "" {
+			item.Expires = expiresN.String
+			if expires, err := time.Parse(planDateFormat, item.Expires); err == nil {
+				// an item is good until the end of the day it expires
+				endOfDay := expires.Add(24 * time.Hour)
+				item.Expired = now.After(endOfDay)
+				item.Expiring = !item.Expired && endOfDay.Sub(now) <= expiringWithin
+			}
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func insertPantryItem(db *sql.DB, householdID int, item *PantryItem) error {
+	var (
+		quantity interface{}
+		unit     interface{}
+		expires  interface{}
+	)
+	if item.Quantity != nil {
+		quantity, unit = item.Quantity.Value, item.Quantity.Unit
+	}
+	if item.Expires != "" {
+		expires = item.Expires
+	}
+
+	res, err := db.Exec("INSERT INTO pantry_items(household_id, ingredient, quantity, unit, expires) values(?,?,?,?,?)", householdID, item.Ingredient, quantity, unit, expires)
+	if err != nil {
+		return fmt.Errorf("unable to insert pantry item: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("unable to read pantry item id: %w", err)
+	}
+	item.ID = int(id)
+	return nil
+}
+
+func deletePantryItem(db *sql.DB, householdID, id int) error {
+	if _, err := db.Exec("DELETE FROM pantry_items WHERE id = ? AND household_id = ?", id, householdID); err != nil {
+		return fmt.Errorf("unable to delete pantry item: %w", err)
+	}
+	return nil
+}
+
+// pantryItemFromForm builds an item from the add form, the quantity is
+// optional and goes through the same unit normalisation as recipes
+func pantryItemFromForm(r *http.Request) (*PantryItem, error) {
+	ingredient := normalizeIngredientName(r.FormValue("ingredient"))
+	if ingredient == "" {
+		return nil, fmt.Errorf("no ingredient provided")
+	}
+	item := &PantryItem{Ingredient: ingredient}
+
+	if quantity := r.FormValue("quantity"); quantity != "" {
+		value, ok := parseAmount(quantity)
+		if !ok || value < 0 {
+			return nil, fmt.Errorf("invalid quantity provided")
+		}
+		unit, factor := normalizeUnit(r.FormValue("unit"))
+		item.Quantity = &Quantity{Value: value * factor, Unit: unit}
+	}
+
+	if expires := r.FormValue("expires"); expires != "" {
+		if _, err := time.Parse(planDateFormat, expires); err != nil {
+			return nil, fmt.Errorf("expiry must be formatted as YYYY-MM-DD")
+		}
+		item.Expires = expires
+	}
+
+	return item, nil
+}
+
+// ingredientNamesMatch is true when what we have is the ingredient or a
+// more specific one, "red onion" in the pantry covers "onion". It only
+// goes that way, "butter" doesn't cover "peanut butter" and "oil" doesn't
+// cover "olive oil".
+func ingredientNamesMatch(have, need string) bool {
+	return have == need || strings.HasSuffix(have, " "+need)
+}
+
+type CookNowIngredient struct {
+	Name     string `json:"name"`
+	Need     string `json:"need,omitempty"`
+	Have     string `json:"have,omitempty"`
+	Expiring bool   `json:"expiring"`
+}
+
+type CookNowMatch struct {
+	Recipe       *Recipe              `json:"-"`
+	RecipeID     int                  `json:"recipe_id"`
+	RecipeName   string               `json:"recipe_name"`
+	InStock      []*CookNowIngredient `json:"in_stock"`
+	Missing      []*CookNowIngredient `json:"missing"`
+	UsesExpiring bool                 `json:"uses_expiring"`
+	Score        float64              `json:"score"`
+}
+
+// matchPantry checks every ingredient of a recipe scaled to servings against
+// the pantry, an ingredient we have too little of counts as missing
+func matchPantry(recipe *Recipe, servings int, pantry []*PantryItem) *CookNowMatch {
+	match := &CookNowMatch{
+		Recipe:     recipe,
+		RecipeID:   recipe.ID,
+		RecipeName: recipe.Name,
+		InStock:    []*CookNowIngredient{},
+		Missing:    []*CookNowIngredient{},
+	}
+
+	scale := 1.0
+	if recipe.Content.Servings > 0 && servings > 0 {
+		scale = float64(servings) / float64(recipe.Content.Servings)
+	}
+
+	names := []string{}
+	for name := range recipe.Content.Ingredients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counted := 0
+	for _, rawName := range names {
+		name, q, hasQuantity := parseIngredientQuantity(rawName, recipe.Content.Ingredients[rawName])
+		if name == "" || pantryStaples[name] {
+			continue
+		}
+		counted++
+
+		ingredient := &CookNowIngredient{Name: name}
+		if hasQuantity {
+			q.Value *= scale
+			ingredient.Need = formatQuantity(q)
+		}
+
+		var found *PantryItem
+		for _, item := range pantry {
+			if item.Expired || !ingredientNamesMatch(item.Ingredient, name) {
+				continue
+			}
+			found = item
+			break
+		}
+
+		if found == nil {
+			match.Missing = append(match.Missing, ingredient)
+			continue
+		}
+
+		ingredient.Expiring = found.Expiring
+		if found.Quantity != nil {
+			ingredient.Have = formatQuantity(*found.Quantity)
+			if hasQuantity && found.Quantity.Unit == q.Unit && found.Quantity.Value < q.Value {
+				match.Missing = append(match.Missing, ingredient)
+				continue
+			}
+		}
+		if found.Expiring {
+			match.UsesExpiring = true
+		}
+		match.InStock = append(match.InStock, ingredient)
+	}
+
+	if counted > 0 {
+		match.Score = float64(len(match.InStock)) / float64(counted)
+	}
+
+	return match
+}
+
+// rankCookNow orders recipes by how much of them is in stock, then by fewest
+// missing ingredients, preferring recipes that use up food about to expire
+func rankCookNow(recipes []*Recipe, servings int, pantry []*PantryItem) []*CookNowMatch {
+	matches := []*CookNowMatch{}
+	for _, r := range recipes {
+		if r.Content == nil || len(r.Content.Ingredients) == 0 {
+			continue
+		}
+		m := matchPantry(r, servings, pantry)
+		if len(m.InStock) == 0 {
+			continue
+		}
+		matches = append(matches, m)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if len(a.Missing) != len(b.Missing) {
+			return len(a.Missing) < len(b.Missing)
+		}
+		if a.UsesExpiring != b.UsesExpiring {
+			return a.UsesExpiring
+		}
+		return strings.ToLower(a.RecipeName) < strings.ToLower(b.RecipeName)
+	})
+
+	return matches
+}
+
+func pantry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			items, err := getPantryItems(db, requestUser(r).HouseholdID, time.Now())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error getting pantry: %v", err)
+				return
+			}
+			if r.URL.Query().Get("format") == "json" {
+				writeJSON(w, http.StatusOK, items)
+				return
+			}
+			if err := renderTemplate(w, r, "pantry.html", items); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error rendering pantry: %v", err)
+			}
+			return
+		case http.MethodPost:
+			break
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error parsing form: %v", err)
+			return
+		}
+
+		switch r.FormValue("action") {
+		case "add":
+			item, err := pantryItemFromForm(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+			if err := insertPantryItem(db, requestUser(r).HouseholdID, item); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+		case "remove":
+			id, err := strconv.Atoi(r.FormValue("id"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: pantry item ID must be an integer")
+				return
+			}
+			if err := deletePantryItem(db, requestUser(r).HouseholdID, id); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: unknown action %q", r.FormValue("action"))
+			return
+		}
+
+		http.Redirect(w, r, "/pantry", http.StatusSeeOther)
+	}
+}
+
+func cookNow(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		servings := 2
+		if servingSize := r.URL.Query().Get("serving_size"); servingSize != "" {
+			i, err := strconv.Atoi(servingSize)
+			if err != nil || i <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: invalid serving size provided")
+				return
+			}
+			servings = i
+		}
+
+		items, err := getPantryItems(db, requestUser(r).HouseholdID, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error getting pantry: %v", err)
+			return
+		}
+
+		recipes, err := getAllRecipes(db, requestUser(r).HouseholdID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error fetching recipes: %v", err)
+			return
+		}
+
+		expiring := []*PantryItem{}
+		for _, item := range items {
+			if item.Expiring || item.Expired {
+				expiring = append(expiring, item)
+			}
+		}
+
+		page := struct {
+			Servings int             `json:"servings"`
+			Expiring []*PantryItem   `json:"expiring"`
+			Matches  []*CookNowMatch `json:"matches"`
+		}{servings, expiring, rankCookNow(recipes, servings, items)}
+
+		if r.URL.Query().Get("format") == "json" {
+			writeJSON(w, http.StatusOK, page)
+			return
+		}
+		if err := renderTemplate(w, r, "cooknow.html", page); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error rendering cook now: %v", err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ingredientNamesMatch(t *testing.T) {
+	tests := []struct {
+		have, need string
+		want       bool
+	}{
+		{"onion", "onion", true},
+		{"red onion", "onion", true},
+		{"onion", "red onion", false},
+		{"butter", "peanut butter", false},
+		{"milk", "coconut milk", false},
+		{"oil", "olive oil", false},
+		{"extra virgin olive oil", "olive oil", true},
+		{"scallion", "onion", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.have+" for "+tt.need, func(t *testing.T) {
+			if got := ingredientNamesMatch(tt.have, tt.need); got != tt.want {
+				t.Errorf("ingredientNamesMatch(%q, %q) = %v, want %v", tt.have, tt.need, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getPantryItems_expiry(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	for _, item := range []*PantryItem{
+		{Ingredient: "milk", Expires: "2024-03-09"},
+		{Ingredient: "cream", Expires: "2024-03-10"},
+		{Ingredient: "cheese", Expires: "2024-03-12"},
+		{Ingredient: "rice", Expires: "2024-06-01"},
+		{Ingredient: "onion"},
+	} {
+		if err := insertPantryItem(db, defaultHouseholdID, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := getPantryItems(db, defaultHouseholdID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][2]bool{}
+	for _, item := range items {
+		got[item.Ingredient] = [2]bool{item.Expired, item.Expiring}
+	}
+	want := map[string][2]bool{
+		"milk":   {true, false},
+		"cream":  {false, true},
+		"cheese": {false, true},
+		"rice":   {false, false},
+		"onion":  {false, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expired, expiring = %v, want %v", got, want)
+	}
+
+	if other, _ := getPantryItems(db, defaultHouseholdID+1, now); len(other) != 0 {
+		t.Errorf("expected other households not to see the pantry, got %d items", len(other))
+	}
+}
+
+func pantryRecipe(id int, name string, servings int, ingredients map[string]*IngredientAmount) *Recipe {
+	return &Recipe{ID: id, Name: name, Content: &RecipeContent{Servings: servings, Ingredients: ingredients}}
+}
+
+func Test_matchPantry(t *testing.T) {
+	recipe := pantryRecipe(1, "Satay", 2, map[string]*IngredientAmount{
+		"peanut butter":    {"100", "g"},
+		"onions, diced":    {"2", ""},
+		"coconut milk":     {"400", "ml"},
+		"salt and pepper":  {"", ""},
+		"rice":             {"200", "g"},
+		"chicken breasts":  {"2", ""},
+		"Water, as needed": nil,
+	})
+	pantry := []*PantryItem{
+		{Ingredient: "butter"},
+		{Ingredient: "milk"},
+		{Ingredient: "red onion", Quantity: &Quantity{Value: 3}},
+		{Ingredient: "rice", Quantity: &Quantity{Value: 300, Unit: "g"}},
+		{Ingredient: "chicken breast", Expired: true},
+	}
+
+	names := func(list []*CookNowIngredient) []string {
+		out := []string{}
+		for _, i := range list {
+			out = append(out, i.Name)
+		}
+		return out
+	}
+
+	m := matchPantry(recipe, 2, pantry)
+	if !reflect.DeepEqual(names(m.InStock), []string{"onion", "rice"}) {
+		t.Errorf("in stock = %v", names(m.InStock))
+	}
+	if !reflect.DeepEqual(names(m.Missing), []string{"chicken breast", "coconut milk", "peanut butter"}) {
+		t.Errorf("missing = %v, expired chicken and less specific butter and milk shouldn't count", names(m.Missing))
+	}
+	if m.Score != 0.4 {
+		t.Errorf("score = %v, want 0.4", m.Score)
+	}
+
+	// for 4 there isn't enough rice or onion
+	m = matchPantry(recipe, 4, pantry)
+	if len(m.InStock) != 0 || len(m.Missing) != 5 {
+		t.Errorf("expected too little of everything for 4, got %v in stock", names(m.InStock))
+	}
+}
+
+func Test_rankCookNow(t *testing.T) {
+	pantry := []*PantryItem{
+		{Ingredient: "egg"},
+		{Ingredient: "bread"},
+		{Ingredient: "spinach", Expiring: true},
+		{Ingredient: "cheese"},
+	}
+	recipes := []*Recipe{
+		pantryRecipe(1, "Toast", 1, map[string]*IngredientAmount{"bread": nil, "butter": nil}),
+		pantryRecipe(2, "Omelette", 1, map[string]*IngredientAmount{"eggs": nil, "cheese": nil}),
+		pantryRecipe(3, "Florentine", 1, map[string]*IngredientAmount{"eggs": nil, "spinach": nil}),
+		pantryRecipe(4, "Soup", 1, map[string]*IngredientAmount{"leek": nil, "potato": nil}),
+		pantryRecipe(5, "Cheese toastie", 1, map[string]*IngredientAmount{"bread": nil, "cheese": nil, "butter": nil, "ham": nil}),
+		{ID: 6, Name: "Not generated"},
+	}
+
+	got := []string{}
+	for _, m := range rankCookNow(recipes, 1, pantry) {
+		got = append(got, m.RecipeName)
+	}
+	// everything in stock first with the one using expiring spinach ahead,
+	// then half in stock with fewer missing ahead, nothing in stock is left
+	// out
+	want := []string{"Florentine", "Omelette", "Toast", "Cheese toastie"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rankCookNow() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PromptTemplate is one version of the prompt for a task. System and User
+// are text/template templates executed with PromptData, the newest version
+// of each task is the one used.
+type PromptTemplate struct {
+	ID        int
+	Task      string
+	Version   int
+	System    string
+	User      string
+	CreatedAt time.Time
+	// CreatedBy is empty for the built in prompts
+	CreatedBy string
+}
+
+// PromptData is what prompt templates can use
+type PromptData struct {
+	Name        string
+	ServingSize int
+	// Dietary is whatever was typed in when asking for the recipe, like
+	// "vegetarian, no nuts", it's often empty
+	Dietary string
+	// Vocabulary is the tags recipes can have, a category per line. It's
+	// only filled in for the tags prompt.
+	Vocabulary string
+	// Ingredients are the ones to check for allergens, one per line. It's
+	// only filled in for the allergens prompt.
+	Ingredients string
+}
+
+// RenderedPrompt is a prompt template filled in for one call
+type RenderedPrompt struct {
+	Task    string
+	Version int
+	System  string
+	User    string
+	Data    PromptData
+}
+
+// promptTasks are the tasks with prompts, in the order they're shown
+var promptTasks = []string{usageTaskRecipe, usageTaskTags, usageTaskAllergens}
+
+// defaultPrompts are stored as version 1 of each task the first time the
+// app starts
+var defaultPrompts = map[string]PromptTemplate{
+	usageTaskRecipe: {
+		System: `Think carefully about this.
+You are a personal chef with extensive experience in the home cooking space.
+You are tasked with creating a recipe for a new dish.
+You are given a title and a serving size. 
+You must create a recipe that is suitable for the given serving size.
+The output will be comprised of the following sections: Serving Size, Ingredients, Instructions, Serving/Presentation Suggestions, Modifications.
+Suggestions and Modifications will contain at least three entry lines each.
+Include line breaks in your recipe to separate the different sections/paragraphs/lines.
+Be careful with ingredient formatting, some examples: "1 cup : flour" is "250g : flour", "1tsp : salt" is "1tsp : salt" (no change), "1/2 cup : sugar" is "125g : sugar", "1/2 tsp : salt" is "1/2 tsp : salt" (no change).
+All units are in metric but tsp/tbsp is okay. Ingredients always have a name prefixed by a number and a unit. The unit is always singular. The number is always a whole number or a decimal to a maximum of 2 decimal places. The number and unit are separated by a space. The name is always lowercase. The number and unit are always lowercase. The number and unit are always separated by a space. If the ingredient has a quantity the name is always separated from the number and unit by an exclamation mark.
+When cooking large pieces of meat include temperature targets. For example, "cook until the internal temperature reaches 70C".
+{{ if .Dietary }}The recipe must suit these dietary requirements: {{ .Dietary }}.
+{{ end }}`,
+		User: "{{ .Name }} {{ .ServingSize }}",
+	},
+	usageTaskTags: {
+		System: `You are a data tagger for a recipe collection. Read the recipe title and, using your exhaustive knowledge of food, return up to ten tags for the recipe as a json string array. Only use tags from this list, picking whichever fit from each category:
+{{ .Vocabulary }}
+For example, if you were given the recipe title "Chicken Tikka Masala", you would return ["Indian", "Main", "Dinner", "Chicken", "Stewed"]. Bias towards the main ingredients, if the recipe is suitable for lunch then always include Lunch.`,
+		User: "{{ .Name }}",
+	},
+	usageTaskAllergens: {
+		System: `You check recipe ingredients for allergens. You are given ingredients one per line. Return a json object with each ingredient exactly as it was written as a key and an object as its value with "allergens", the allergens the ingredient usually contains from this list: Celery, Gluten, Crustaceans, Eggs, Fish, Lupin, Milk, Molluscs, Mustard, Tree nuts, Peanuts, Sesame, Soya, Sulphites, and "not_for", the diets it isn't suitable for from this list: Vegetarian, Vegan, Pescatarian, Gluten-free, Dairy-free.
+For example, for "worcestershire sauce" you would return {"worcestershire sauce": {"allergens": ["Fish", "Gluten", "Sulphites"], "not_for": ["Vegetarian", "Vegan", "Gluten-free"]}}.
+Someone with an allergy relies on this, so if an ingredient might contain an allergen, include it.`,
+		User: "{{ .Ingredients }}",
+	},
+}
+
+// examplePromptData checks templates can be executed before they're saved
+var examplePromptData = PromptData{Name: "Chicken Tikka Masala", ServingSize: 4, Dietary: "no nuts", Vocabulary: tagTaxonomy.Vocabulary(), Ingredients: "chicken thigh\ngaram masala\nnatural yoghurt"}
+
+const promptColumns = "id, task, version, system, user, created_at, created_by"
+
+func scanPromptTemplate(row rowScanner) (*PromptTemplate, error) {
+	p := &PromptTemplate{}
+	var createdAt string
+	if err := row.Scan(&p.ID, &p.Task, &p.Version, &p.System, &p.User, &createdAt, &p.CreatedBy); err != nil {
+		return nil, err
+	}
+	p.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return p, nil
+}
+
+// seedPromptTemplates stores the built in prompts for tasks that don't have
+// any yet. Built in prompts nobody has changed follow the code, when the
+// default changes it's stored as a new version.
+func seedPromptTemplates(db *sql.DB, now time.Time) error {
+	for _, task := range promptTasks {
+		p := defaultPrompts[task]
+		if _, err := db.Exec(`
+INSERT INTO prompt_templates(task, version, system, user, created_at, created_by)
+SELECT ?, 1, ?, ?, ?, '' WHERE NOT EXISTS (SELECT 1 FROM prompt_templates WHERE task = ?)`,
+			task, p.System, p.User, now.UTC().Format(time.RFC3339), task); err != nil {
+			return fmt.Errorf("unable to seed %s prompt: %w", task, err)
+		}
+
+		current, err := getPromptTemplate(db, task)
+		if err != nil {
+			return err
+		}
+		if current.CreatedBy != "" || (current.System == p.System && current.User == p.User) {
+			continue
+		}
+		if _, err := db.Exec("INSERT INTO prompt_templates(task, version, system, user, created_at, created_by) values(?,?,?,?,?,'')",
+			task, current.Version+1, p.System, p.User, now.UTC().Format(time.RFC3339)); err != nil {
+			return fmt.Errorf("unable to update built in %s prompt: %w", task, err)
+		}
+	}
+	return nil
+}
+
+// getPromptTemplate returns the newest version of a task's prompt
+func getPromptTemplate(db *sql.DB, task string) (*PromptTemplate, error) {
+	p, err := scanPromptTemplate(db.QueryRow("SELECT "+promptColumns+" FROM prompt_templates WHERE task = ? ORDER BY version DESC LIMIT 1", task))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("there's no %s prompt", task)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s prompt: %w", task, err)
+	}
+	return p, nil
+}
+
+// getPromptHistory returns every version of a task's prompt, newest first
+func getPromptHistory(db *sql.DB, task string) ([]*PromptTemplate, error) {
+	rows, err := db.Query("SELECT "+promptColumns+" FROM prompt_templates WHERE task = ? ORDER BY version DESC", task)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s prompts: %w", task, err)
+	}
+	defer rows.Close()
+
+	prompts := []*PromptTemplate{}
+	for rows.Next() {
+		p, err := scanPromptTemplate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan prompt: %w", err)
+		}
+		prompts = append(prompts, p)
+	}
+	return prompts, rows.Err()
+}
+
+// savePromptTemplate stores a new version of a task's prompt once it's
+// checked the templates work, saving what's already there does nothing
+func savePromptTemplate(db *sql.DB, task, system, user, by string, now time.Time) (*PromptTemplate, error) {
+	if _, ok := defaultPrompts[task]; !ok {
+		return nil, fmt.Errorf("unknown prompt task %q", task)
+	}
+	system = strings.ReplaceAll(system, "\r\n", "\n")
+	user = strings.ReplaceAll(user, "\r\n", "\n")
+
+	p := &PromptTemplate{Task: task, System: system, User: user, CreatedAt: now, CreatedBy: by}
+	rendered, err := p.Render(examplePromptData)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rendered.User) == "" {
+		return nil, fmt.Errorf("the user message can't be empty")
+	}
+
+	current, err := getPromptTemplate(db, task)
+	if err != nil {
+		return nil, err
+	}
+	if current.System == system && current.User == user {
+		return current, nil
+	}
+
+	p.Version = current.Version + 1
+	res, err := db.Exec("INSERT INTO prompt_templates(task, version, system, user, created_at, created_by) values(?,?,?,?,?,?)",
+		p.Task, p.Version, p.System, p.User, now.UTC().Format(time.RFC3339), p.CreatedBy)
+	if err != nil {
+		return nil, fmt.Errorf("unable to save %s prompt: %w", task, err)
+	}
+	id, _ := res.LastInsertId()
+	p.ID = int(id)
+	return p, nil
+}
+
+func (p *PromptTemplate) Render(data PromptData) (*RenderedPrompt, error) {
+	rendered := &RenderedPrompt{Task: p.Task, Version: p.Version, Data: data}
+	for _, part := range []struct {
+		name string
+		text string
+		into *string
+	}{
+		{"system", p.System, &rendered.System},
+		{"user", p.User, &rendered.User},
+	} {
+		tmpl, err := template.New(part.name).Option("missingkey=error").Parse(part.text)
+		if err != nil {
+			return nil, fmt.Errorf("the %s message isn't a valid template: %w", part.name, err)
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("the %s message can't be filled in: %w", part.name, err)
+		}
+		*part.into = b.String()
+	}
+	return rendered, nil
+}
+
+// renderPrompt fills in the newest prompt for a task
+func renderPrompt(db *sql.DB, task string, data PromptData) (*RenderedPrompt, error) {
+	p, err := getPromptTemplate(db, task)
+	if err != nil {
+		return nil, err
+	}
+	return p.Render(data)
+}
+
+type promptsPage struct {
+	Tasks    []*promptTask
+	Provider string
+	Error    string
+}
+
+type promptTask struct {
+	Task    string
+	Current *PromptTemplate
+	History []*PromptTemplate
+	// Example is the current prompt filled in with examplePromptData
+	Example *RenderedPrompt
+	Model   string
+}
+
+// adminPrompts edits the prompts, every save or restore is a new version
+// so recipes can say which one they came from
+func adminPrompts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := promptsPage{Provider: llmProvider.Name()}
+		now := time.Now()
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error parsing form: %v", err)
+				return
+			}
+
+			task := r.PostFormValue("task")
+			system, user := r.PostFormValue("system"), r.PostFormValue("user")
+			switch r.PostFormValue("action") {
+			case "save":
+			case "restore":
+				version, _ := strconv.Atoi(r.PostFormValue("version"))
+				old, err := scanPromptTemplate(db.QueryRow("SELECT "+promptColumns+" FROM prompt_templates WHERE task = ? AND version = ?", task, version))
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "error: there's no version %d of the %s prompt", version, task)
+					return
+				}
+				system, user = old.System, old.User
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: unknown action %q", r.PostFormValue("action"))
+				return
+			}
+
+			saved, err := savePromptTemplate(db, task, system, user, requestUsername(r), now)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				page.Error = err.Error()
+				break
+			}
+			audit(db, r, auditPromptChanged, "", fmt.Sprintf("%s prompt is now version %d", task, saved.Version))
+			http.Redirect(w, r, "/admin/prompts#"+task, http.StatusSeeOther)
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		for _, task := range promptTasks {
+			history, err := getPromptHistory(db, task)
+			if err != nil || len(history) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: unable to get the %s prompt: %v", task, err)
+				return
+			}
+			t := &promptTask{Task: task, Current: history[0], History: history[1:], Model: llmProvider.Model(task)}
+			t.Example, _ = t.Current.Render(examplePromptData)
+			page.Tasks = append(page.Tasks, t)
+		}
+
+		if err := renderTemplate(w, r, "prompts.html", page); err != nil {
+			fmt.Fprintf(w, "error rendering prompts: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_savePromptTemplate(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+
+	seeded, err := getPromptTemplate(db, usageTaskRecipe)
+	if err != nil || seeded.Version != 1 || seeded.CreatedBy != "" {
+		t.Fatalf("expected the built in prompt as version 1, got %+v, %v", seeded, err)
+	}
+
+	tests := []struct {
+		name        string
+		task        string
+		system      string
+		user        string
+		wantErr     string
+		wantVersion int
+	}{
+		{"unchanged", usageTaskRecipe, seeded.System, seeded.User, "", 1},
+		{"new version", usageTaskRecipe, "Cook {{ .Name }}.", "{{ .Name }} for {{ .ServingSize }}", "", 2},
+		{"windows line endings", usageTaskRecipe, "Cook {{ .Name }}.\r\n", "{{ .Name }}", "", 3},
+		{"unknown task", "poems", "", "{{ .Name }}", "unknown prompt task", 0},
+		{"bad template", usageTaskRecipe, "{{ .Name ", "{{ .Name }}", "isn't a valid template", 0},
+		{"unknown variable", usageTaskRecipe, "{{ .Cuisine }}", "{{ .Name }}", "can't be filled in", 0},
+		{"empty user message", usageTaskTags, "Tag it", " ", "can't be empty", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := savePromptTemplate(db, tt.task, tt.system, tt.user, "admin", now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("savePromptTemplate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("savePromptTemplate() error = %v", err)
+			}
+			if p.Version != tt.wantVersion {
+				t.Errorf("expected version %d, got %d", tt.wantVersion, p.Version)
+			}
+		})
+	}
+
+	rendered, err := renderPrompt(db, usageTaskRecipe, PromptData{Name: "Soup", ServingSize: 2})
+	if err != nil {
+		t.Fatalf("renderPrompt() error = %v", err)
+	}
+	if rendered.Version != 3 || rendered.System != "Cook Soup.\n" || rendered.User != "Soup" {
+		t.Errorf("unexpected rendered prompt %+v", rendered)
+	}
+
+	// the built in recipe prompt only mentions dietary requirements when
+	// there are some
+	p := &PromptTemplate{System: defaultPrompts[usageTaskRecipe].System, User: defaultPrompts[usageTaskRecipe].User}
+	for _, dietary := range []string{"", "vegan"} {
+		rendered, err := p.Render(PromptData{Name: "Soup", ServingSize: 2, Dietary: dietary})
+		if err != nil {
+			t.Fatalf("Render() error = %v", err)
+		}
+		if got := strings.Contains(rendered.System, "dietary requirements: vegan."); got != (dietary != "") {
+			t.Errorf("dietary %q in prompt = %v", dietary, got)
+		}
+		if rendered.User != "Soup 2" {
+			t.Errorf("User = %q", rendered.User)
+		}
+	}
+}
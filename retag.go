@@ -0,0 +1,494 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A retag run goes running -> ready, then applied or discarded once it's
+// been reviewed. Runs interrupted by a restart are failed.
+const (
+	retagRunning   = "running"
+	retagReady     = "ready"
+	retagApplied   = "applied"
+	retagDiscarded = "discarded"
+	retagFailed    = "failed"
+)
+
+// Proposals start pending and are applied, skipped when they weren't picked
+// or stale when the recipe changed after the run
+const (
+	proposalPending = "pending"
+	proposalApplied = "applied"
+	proposalSkipped = "skipped"
+	proposalStale   = "stale"
+)
+
+// RetagRun proposes new tags for every recipe, nothing changes until the
+// proposals are reviewed and applied
+type RetagRun struct {
+	ID        int
+	CreatedAt time.Time
+	CreatedBy string
+	// UseLLM asks the model for tags as well as normalizing the ones
+	// recipes already have
+	UseLLM     bool
+	Status     string
+	Total      int
+	Done       int
+	Error      string
+	FinishedAt time.Time
+}
+
+type RetagProposal struct {
+	ID          int
+	RunID       int
+	RecipeID    int
+	HouseholdID int
+	RecipeName  string
+	OldTags     []string
+	NewTags     []string
+	Status      string
+	// ResultID is the new recipe version once it's applied
+	ResultID int
+}
+
+// Removed are the old tags that aren't in the new ones as they're written
+func (p *RetagProposal) Removed() []string {
+	return tagsNotIn(p.OldTags, p.NewTags)
+}
+
+// Added are the new tags that weren't there before as they're written
+func (p *RetagProposal) Added() []string {
+	return tagsNotIn(p.NewTags, p.OldTags)
+}
+
+func tagsNotIn(tags, other []string) []string {
+	in := map[string]bool{}
+	for _, t := range other {
+		in[t] = true
+	}
+	missing := []string{}
+	for _, t := range tags {
+		if !in[t] {
+			missing = append(missing, t)
+		}
+	}
+	return missing
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const retagRunColumns = "id, created_at, created_by, use_llm, status, total, done, error, finished_at"
+
+func scanRetagRun(row rowScanner) (*RetagRun, error) {
+	run := &RetagRun{}
+	var createdAt, finishedAt string
+	if err := row.Scan(&run.ID, &createdAt, &run.CreatedBy, &run.UseLLM, &run.Status, &run.Total, &run.Done, &run.Error, &finishedAt); err != nil {
+		return nil, err
+	}
+	run.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	run.FinishedAt, _ = time.Parse(time.RFC3339, finishedAt)
+	return run, nil
+}
+
+// getRetagRun returns a run, or the latest one when id is zero, or nil
+func getRetagRun(db *sql.DB, id int) (*RetagRun, error) {
+	query, args := "SELECT "+retagRunColumns+" FROM retag_runs ORDER BY id DESC LIMIT 1", []interface{}{}
+	if id != 0 {
+		query, args = "SELECT "+retagRunColumns+" FROM retag_runs WHERE id = ?", []interface{}{id}
+	}
+	run, err := scanRetagRun(db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get retag run: %w", err)
+	}
+	return run, nil
+}
+
+// startRetagRun stores a new run, any run still waiting for review is
+// discarded as this one replaces it
+func startRetagRun(db *sql.DB, user *User, useLLM bool, now time.Time) (*RetagRun, error) {
+	var running int
+	if err := db.QueryRow("SELECT COUNT(*) FROM retag_runs WHERE status = ?", retagRunning).Scan(&running); err != nil {
+		return nil, fmt.Errorf("unable to check for retag runs: %w", err)
+	}
+	if running > 0 {
+		return nil, errors.New("a retag run is already going, wait for it to finish")
+	}
+	if _, err := db.Exec("UPDATE retag_runs SET status = ? WHERE status = ?", retagDiscarded, retagReady); err != nil {
+		return nil, fmt.Errorf("unable to discard old retag runs: %w", err)
+	}
+
+	res, err := db.Exec("INSERT INTO retag_runs(created_at, created_by, use_llm, status) values(?,?,?,?)",
+		now.UTC().Format(time.RFC3339), user.Username, useLLM, retagRunning)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start retag run: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	return getRetagRun(db, int(id))
+}
+
+func finishRetagRun(db *sql.DB, run *RetagRun, runErr error, now time.Time) error {
+	run.Status, run.FinishedAt = retagReady, now
+	if runErr != nil {
+		run.Status, run.Error = retagFailed, runErr.Error()
+	}
+	if _, err := db.Exec("UPDATE retag_runs SET status = ?, error = ?, finished_at = ? WHERE id = ?",
+		run.Status, run.Error, now.UTC().Format(time.RFC3339), run.ID); err != nil {
+		return fmt.Errorf("unable to finish retag run: %w", err)
+	}
+	return nil
+}
+
+// failInterruptedRetagRuns fails runs that were going when the process last
+// stopped, what they proposed so far can't be trusted to be complete
+func failInterruptedRetagRuns(db *sql.DB) error {
+	if _, err := db.Exec("UPDATE retag_runs SET status = ?, error = 'interrupted by a restart' WHERE status = ?", retagFailed, retagRunning); err != nil {
+		return fmt.Errorf("unable to fail interrupted retag runs: %w", err)
+	}
+	return nil
+}
+
+const retagProposalColumns = "id, run_id, recipe_id, household_id, recipe_name, old_tags, new_tags, status, result_recipe_id"
+
+func getRetagProposals(db *sql.DB, runID int) ([]*RetagProposal, error) {
+	rows, err := db.Query("SELECT "+retagProposalColumns+" FROM retag_proposals WHERE run_id = ? ORDER BY recipe_name, id", runID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get retag proposals: %w", err)
+	}
+	defer rows.Close()
+
+	proposals := []*RetagProposal{}
+	for rows.Next() {
+		p := &RetagProposal{}
+		var oldTags, newTags string
+		if err := rows.Scan(&p.ID, &p.RunID, &p.RecipeID, &p.HouseholdID, &p.RecipeName, &oldTags, &newTags, &p.Status, &p.ResultID); err != nil {
+			return nil, fmt.Errorf("unable to scan retag proposal: %w", err)
+		}
+		if err := json.Unmarshal([]byte(oldTags), &p.OldTags); err != nil {
+			return nil, fmt.Errorf("unable to read old tags: %w", err)
+		}
+		if err := json.Unmarshal([]byte(newTags), &p.NewTags); err != nil {
+			return nil, fmt.Errorf("unable to read new tags: %w", err)
+		}
+		proposals = append(proposals, p)
+	}
+	return proposals, rows.Err()
+}
+
+func insertRetagProposal(db *sql.DB, p *RetagProposal) error {
+	oldTags, _ := json.Marshal(p.OldTags)
+	newTags, _ := json.Marshal(p.NewTags)
+	if _, err := db.Exec("INSERT INTO retag_proposals(run_id, recipe_id, household_id, recipe_name, old_tags, new_tags, status) values(?,?,?,?,?,?,?)",
+		p.RunID, p.RecipeID, p.HouseholdID, p.RecipeName, oldTags, newTags, proposalPending); err != nil {
+		return fmt.Errorf("unable to store retag proposal: %w", err)
+	}
+	return nil
+}
+
+// latestRecipes returns the newest version of every recipe in every
+// household
+func latestRecipes(db *sql.DB) ([]*Recipe, error) {
+	households, err := getHouseholds(db)
+	if err != nil {
+		return nil, err
+	}
+	recipes := []*Recipe{}
+	for _, h := range households {
+		metas, err := getAllRecipeMeta(db, h.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, meta := range metas {
+			if meta.Shared {
+				continue
+			}
+			recipe, err := getRecipeByID(db, h.ID, meta.ID)
+			if err != nil {
+				return nil, err
+			}
+			if recipe != nil {
+				recipes = append(recipes, recipe)
+			}
+		}
+	}
+	return recipes, nil
+}
+
+// retagger asks for tags for a recipe on top of the ones it has
+type retagger func(recipe *Recipe) ([]string, error)
+
+// llmRetagger asks the model for tags, charged to the user who started the
+// run
+func llmRetagger(db *sql.DB, user *User) retagger {
+	return func(recipe *Recipe) ([]string, error) {
+		if err := checkBudget(db, user, time.Now()); err != nil {
+			return nil, err
+		}
+		prompt, err := renderPrompt(db, usageTaskTags, tagPromptData(recipe.Name))
+		if err != nil {
+			return nil, err
+		}
+		tagged := &Recipe{Name: recipe.Name}
+		usage, err := generateTags(tagged, prompt, true)
+		if err := recordUsage(db, user, recipe.ID, usage, time.Now()); err != nil {
+			fmt.Println(err)
+		}
+		return tagged.Tags, err
+	}
+}
+
+// runRetag works out new tags for every recipe and stores a proposal for
+// each one that would change. tagger is nil to only normalize.
+func runRetag(db *sql.DB, run *RetagRun, tagger retagger) error {
+	recipes, err := latestRecipes(db)
+	if err != nil {
+		return err
+	}
+	run.Total = len(recipes)
+	if _, err := db.Exec("UPDATE retag_runs SET total = ? WHERE id = ?", run.Total, run.ID); err != nil {
+		return fmt.Errorf("unable to update retag run: %w", err)
+	}
+
+	for _, recipe := range recipes {
+		tags := recipe.Tags
+		if tagger != nil {
+			generated, err := tagger(recipe)
+			if errors.Is(err, errBudgetExceeded) || errors.Is(err, errGenerationUnavailable) {
+				return fmt.Errorf("stopped at %s: %w", recipe.Name, err)
+			}
+			if err != nil {
+				fmt.Printf("unable to generate tags for %s, only normalizing them: %v\n", recipe.Name, err)
+			}
+			tags = append(append([]string{}, tags...), generated...)
+		}
+		normalized, _ := tagTaxonomy.Normalize(tags)
+
+		if !sameTags(recipe.Tags, normalized) {
+			if err := insertRetagProposal(db, &RetagProposal{
+				RunID:       run.ID,
+				RecipeID:    recipe.ID,
+				HouseholdID: recipe.HouseholdID,
+				RecipeName:  recipe.Name,
+				OldTags:     append([]string{}, recipe.Tags...),
+				NewTags:     normalized,
+			}); err != nil {
+				return err
+			}
+		}
+
+		run.Done++
+		if _, err := db.Exec("UPDATE retag_runs SET done = ? WHERE id = ?", run.Done, run.ID); err != nil {
+			return fmt.Errorf("unable to update retag run: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyRetagRun saves the picked proposals as new recipe versions. A
+// proposal is stale, and left alone, if the recipe has had a new version or
+// its tags changed since the run.
+func applyRetagRun(db *sql.DB, run *RetagRun, picked map[int]bool, now time.Time) (applied, stale int, err error) {
+	if run.Status != retagReady {
+		return 0, 0, fmt.Errorf("this run is %s, only finished runs can be applied", run.Status)
+	}
+	proposals, err := getRetagProposals(db, run.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, p := range proposals {
+		if p.Status != proposalPending {
+			continue
+		}
+		status := proposalSkipped
+		if picked[p.ID] {
+			if p.ResultID, err = applyRetagProposal(db, p); err != nil {
+				return applied, stale, err
+			}
+			status = proposalApplied
+			if p.ResultID == 0 {
+				status = proposalStale
+				stale++
+			} else {
+				applied++
+			}
+		}
+		if _, err := db.Exec("UPDATE retag_proposals SET status = ?, result_recipe_id = ? WHERE id = ?", status, p.ResultID, p.ID); err != nil {
+			return applied, stale, fmt.Errorf("unable to update retag proposal: %w", err)
+		}
+	}
+
+	run.Status = retagApplied
+	if _, err := db.Exec("UPDATE retag_runs SET status = ? WHERE id = ?", run.Status, run.ID); err != nil {
+		return applied, stale, fmt.Errorf("unable to update retag run: %w", err)
+	}
+	return applied, stale, nil
+}
+
+// applyRetagProposal returns the new version's id, or zero if it's stale
+func applyRetagProposal(db *sql.DB, p *RetagProposal) (int, error) {
+	var newer int
+	if err := db.QueryRow("SELECT COUNT(*) FROM recipes WHERE parent_id = ?", p.RecipeID).Scan(&newer); err != nil {
+		return 0, fmt.Errorf("unable to check for newer versions: %w", err)
+	}
+	recipe, err := getRecipeByID(db, p.HouseholdID, p.RecipeID)
+	if err != nil {
+		return 0, err
+	}
+	if newer > 0 || recipe == nil || !sameTags(recipe.Tags, p.OldTags) {
+		return 0, nil
+	}
+
+	recipe.Tags = p.NewTags
+	newRecipe, err := insertRecipeVersion(db, recipe)
+	if err != nil {
+		return 0, err
+	}
+	return newRecipe.ID, nil
+}
+
+type retagPage struct {
+	Run       *RetagRun
+	Proposals []*RetagProposal
+	Refresh   int
+	Error     string
+}
+
+// adminRetag starts retag runs and shows what they'd change so it can be
+// reviewed before anything is saved
+func adminRetag(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := retagPage{}
+		now := time.Now()
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error parsing form: %v", err)
+				return
+			}
+
+			user := requestUser(r)
+			switch r.PostFormValue("action") {
+			case "start":
+				useLLM := r.PostFormValue("use_llm") == "true"
+				if useLLM {
+					if err := checkBudget(db, user, now); err != nil {
+						if !budgetExceeded(w, err) {
+							w.WriteHeader(http.StatusInternalServerError)
+							fmt.Fprintf(w, "error: %v", err)
+						}
+						return
+					}
+				}
+				run, err := startRetagRun(db, user, useLLM, now)
+				if err != nil {
+					w.WriteHeader(http.StatusConflict)
+					page.Error = err.Error()
+					break
+				}
+				var tagger retagger
+				if useLLM {
+					tagger = llmRetagger(db, user)
+				}
+				go func() {
+					err := runRetag(db, run, tagger)
+					if err != nil {
+						fmt.Printf("retag run %d failed: %v\n", run.ID, err)
+					}
+					if err := finishRetagRun(db, run, err, time.Now()); err != nil {
+						fmt.Println(err)
+					}
+				}()
+				http.Redirect(w, r, fmt.Sprintf("/admin/retag?id=%d", run.ID), http.StatusSeeOther)
+				return
+			case "apply", "discard":
+				id, _ := strconv.Atoi(r.PostFormValue("run"))
+				run, err := getRetagRun(db, id)
+				if err != nil || run == nil {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprintf(w, "error: retag run not found")
+					return
+				}
+				picked := map[int]bool{}
+				if r.PostFormValue("action") == "apply" {
+					for _, value := range r.PostForm["proposal"] {
+						if id, err := strconv.Atoi(value); err == nil {
+							picked[id] = true
+						}
+					}
+				}
+				applied, stale, err := applyRetagRun(db, run, picked, now)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "error: %v", err)
+					return
+				}
+				if r.PostFormValue("action") == "discard" {
+					if _, err := db.Exec("UPDATE retag_runs SET status = ? WHERE id = ?", retagDiscarded, run.ID); err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						fmt.Fprintf(w, "error: %v", err)
+						return
+					}
+				} else {
+					audit(db, r, auditRetagApplied, "", fmt.Sprintf("run %d, %d recipes retagged, %d stale", run.ID, applied, stale))
+				}
+				http.Redirect(w, r, fmt.Sprintf("/admin/retag?id=%d", run.ID), http.StatusSeeOther)
+				return
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: unknown action %q", r.PostFormValue("action"))
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		run, err := getRetagRun(db, id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		page.Run = run
+		if run != nil {
+			if run.Status == retagRunning {
+				page.Refresh = int(jobPollInterval / time.Second)
+			}
+			if page.Proposals, err = getRetagProposals(db, run.ID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+		}
+
+		if err := renderTemplate(w, r, "retag.html", page); err != nil {
+			fmt.Fprintf(w, "error rendering retag: %v", err)
+			return
+		}
+	}
+}
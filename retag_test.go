@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_runRetag(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "admin", "password1", roleAdmin); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	admin, _ := getUser(db, "admin")
+	other, err := insertHousehold(db, "Other")
+	if err != nil {
+		t.Fatalf("unable to add household: %v", err)
+	}
+
+	insert := func(household int, name string, tags ...string) *Recipe {
+		recipe, err := insertRecipeVersion(db, &Recipe{Name: name, HouseholdID: household, Tags: tags})
+		if err != nil {
+			t.Fatalf("unable to insert recipe: %v", err)
+		}
+		return recipe
+	}
+	soup := insert(defaultHouseholdID, "Tomato Soup", "Tomatoes", "soup", "Comfort Food")
+	insert(defaultHouseholdID, "Carbonara", "Italian", "Pasta")
+	curry := insert(other.ID, "Dal", "Dhal", "Indian")
+	shareRecipe(db, defaultHouseholdID, soup.ID, other.ID)
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	run, err := startRetagRun(db, admin, false, now)
+	if err != nil {
+		t.Fatalf("unable to start run: %v", err)
+	}
+	if _, err := startRetagRun(db, admin, false, now); err == nil {
+		t.Errorf("expected a second run to be refused while one is going")
+	}
+	if err := runRetag(db, run, nil); err != nil {
+		t.Fatalf("unable to run retag: %v", err)
+	}
+	if err := finishRetagRun(db, run, nil, now); err != nil {
+		t.Fatalf("unable to finish run: %v", err)
+	}
+
+	run, _ = getRetagRun(db, 0)
+	if run.Status != retagReady || run.Total != 3 || run.Done != 3 {
+		t.Errorf("expected every recipe to be looked at once, got %+v", run)
+	}
+	proposals, err := getRetagProposals(db, run.ID)
+	if err != nil {
+		t.Fatalf("unable to get proposals: %v", err)
+	}
+	if len(proposals) != 2 {
+		t.Fatalf("expected proposals for the two recipes that change, got %d", len(proposals))
+	}
+	dal, tomato := proposals[0], proposals[1]
+	if !reflect.DeepEqual(tomato.NewTags, []string{"Soup", "Tomato"}) {
+		t.Errorf("expected the soup's tags normalized, got %v", tomato.NewTags)
+	}
+	if !reflect.DeepEqual(tomato.Removed(), []string{"Tomatoes", "soup", "Comfort Food"}) || !reflect.DeepEqual(tomato.Added(), []string{"Soup", "Tomato"}) {
+		t.Errorf("unexpected diff, removed %v added %v", tomato.Removed(), tomato.Added())
+	}
+
+	// the soup is edited after the run so its proposal is stale
+	edited := *soup
+	edited.Tags = []string{"Soup"}
+	if _, err := insertRecipeVersion(db, &edited); err != nil {
+		t.Fatalf("unable to edit recipe: %v", err)
+	}
+
+	applied, stale, err := applyRetagRun(db, run, map[int]bool{dal.ID: true, tomato.ID: true}, now)
+	if err != nil {
+		t.Fatalf("unable to apply run: %v", err)
+	}
+	if applied != 1 || stale != 1 {
+		t.Errorf("expected 1 applied and 1 stale, got %d and %d", applied, stale)
+	}
+	proposals, _ = getRetagProposals(db, run.ID)
+	if proposals[0].Status != proposalApplied || proposals[1].Status != proposalStale {
+		t.Errorf("unexpected statuses %s and %s", proposals[0].Status, proposals[1].Status)
+	}
+	retagged, _ := getRecipeByID(db, other.ID, proposals[0].ResultID)
+	if retagged == nil || retagged.ID == curry.ID || !reflect.DeepEqual(retagged.Tags, []string{"Indian", "Lentils"}) {
+		t.Errorf("expected a new version with the new tags, got %+v", retagged)
+	}
+	if _, _, err := applyRetagRun(db, run, nil, now); err == nil {
+		t.Errorf("expected a run to only be applied once")
+	}
+}
+
+func Test_runRetag_tagger(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "admin", "password1", roleAdmin); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	admin, _ := getUser(db, "admin")
+	for _, name := range []string{"Pancakes", "Waffles"} {
+		if _, err := insertRecipeVersion(db, &Recipe{Name: name, HouseholdID: defaultHouseholdID, Tags: []string{"Breakfast"}}); err != nil {
+			t.Fatalf("unable to insert recipe: %v", err)
+		}
+	}
+
+	run, _ := startRetagRun(db, admin, true, time.Now())
+	calls := 0
+	err := runRetag(db, run, func(recipe *Recipe) ([]string, error) {
+		calls++
+		if calls > 1 {
+			return nil, errBudgetExceeded
+		}
+		return []string{"Vegetarian", "Fluffy"}, nil
+	})
+	if !errors.Is(err, errBudgetExceeded) {
+		t.Fatalf("expected running out of budget to stop the run, got %v", err)
+	}
+	finishRetagRun(db, run, err, time.Now())
+
+	run, _ = getRetagRun(db, run.ID)
+	if run.Status != retagFailed || run.Done != 1 {
+		t.Errorf("expected the run to fail after one recipe, got %+v", run)
+	}
+	proposals, _ := getRetagProposals(db, run.ID)
+	if len(proposals) != 1 || !reflect.DeepEqual(proposals[0].NewTags, []string{"Breakfast", "Vegetarian"}) {
+		t.Errorf("expected generated tags added to the existing ones, got %+v", proposals)
+	}
+
+	// a failed run can't be applied, and a run left going by a restart fails
+	if _, _, err := applyRetagRun(db, run, nil, time.Now()); err == nil {
+		t.Errorf("expected a failed run not to be applied")
+	}
+	interrupted, _ := startRetagRun(db, admin, false, time.Now())
+	if err := failInterruptedRetagRuns(db); err != nil {
+		t.Fatalf("unable to fail interrupted runs: %v", err)
+	}
+	if interrupted, _ = getRetagRun(db, interrupted.ID); interrupted.Status != retagFailed {
+		t.Errorf("expected the interrupted run to fail, got %s", interrupted.Status)
+	}
+}
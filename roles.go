@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Role is what a user is allowed to do, each role can do everything the
+// ones before it can
+type Role int
+
+const (
+	roleViewer Role = iota
+	roleEditor
+	roleAdmin
+)
+
+var roleNames = []string{"viewer", "editor", "admin"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return "unknown"
+	}
+	return roleNames[r]
+}
+
+func parseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if s == name {
+			return Role(i), nil
+		}
+	}
+	return roleViewer, fmt.Errorf("unknown role %q, must be one of viewer, editor or admin", s)
+}
+
+// canDo reports whether the request's user has at least the given role
+func canDo(r *http.Request, role Role) bool {
+	user := requestUser(r)
+	return user != nil && user.Role >= role
+}
+
+// forbidden tells the user which role they'd need, so it's obvious who to
+// ask rather than looking like something broke
+func forbidden(w http.ResponseWriter, r *http.Request, role Role) {
+	w.WriteHeader(http.StatusForbidden)
+	if user := requestUser(r); user != nil {
+		fmt.Fprintf(w, "forbidden: %s is a %s, this needs the %s role", user.Username, user.Role, role)
+		return
+	}
+	fmt.Fprintf(w, "forbidden: this needs the %s role", role)
+}
+
+// forbiddenScope is forbidden for api tokens that the user's role would
+// allow but the token wasn't given the scope for
+func forbiddenScope(w http.ResponseWriter, scope string) {
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "forbidden: this api token doesn't have the %s scope", scope)
+}
+
+// authorize sits inside requireAuth and checks the user's role, reads (GET
+// and HEAD) need the read role and anything else needs the write role. Api
+// tokens also need the matching scope.
+func authorize(read, write Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, scope := write, "write"
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			role, scope = read, "read"
+		}
+		if role == roleAdmin {
+			scope = "admin"
+		}
+		if !canDo(r, role) {
+			forbidden(w, r, role)
+			return
+		}
+		if !tokenAllows(r, scope) {
+			forbiddenScope(w, scope)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+type adminUsersPage struct {
+	Users      []*User
+	Roles      []string
+	Households []*Household
+	Current    string
+}
+
+// adminUsers lists users so an admin can change their role or remove them,
+// adding users and setting passwords is still done with the user command
+func adminUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error parsing form: %v", err)
+				return
+			}
+
+			if r.PostFormValue("action") == "add_household" {
+				h, err := insertHousehold(db, r.PostFormValue("household_name"))
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "error: %v", err)
+					return
+				}
+				audit(db, r, auditHouseholdAdded, "", h.Name)
+				http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+				return
+			}
+
+			username := r.PostFormValue("username")
+			if username == requestUsername(r) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: you can't change your own account here, use the user command")
+				return
+			}
+
+			var err error
+			var event, detail string
+			switch r.PostFormValue("action") {
+			case "role":
+				var role Role
+				if role, err = parseRole(r.PostFormValue("role")); err == nil {
+					err = setUserRole(db, username, role)
+				}
+				event, detail = auditRoleChanged, fmt.Sprintf("%s is now %s", username, role)
+			case "household":
+				var householdID int
+				if householdID, err = strconv.Atoi(r.PostFormValue("household_id")); err == nil {
+					err = setUserHousehold(db, username, householdID)
+				}
+				event, detail = auditHouseholdMoved, fmt.Sprintf("moved %s to household %d", username, householdID)
+			case "remove":
+				err = removeUser(db, username)
+				event, detail = auditUserRemoved, "removed "+username
+			default:
+				err = fmt.Errorf("unknown action %q", r.PostFormValue("action"))
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+			audit(db, r, event, username, detail)
+
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		users, err := getUsers(db)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		households, err := getHouseholds(db)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		page := adminUsersPage{Users: users, Roles: roleNames, Households: households, Current: requestUsername(r)}
+		if err := renderTemplate(w, r, "users.html", page); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error rendering users: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_authorize(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	handler := authorize(roleViewer, roleEditor, ok)
+
+	tests := []struct {
+		name   string
+		role   Role
+		method string
+		want   int
+	}{
+		{name: "viewer reads", role: roleViewer, method: http.MethodGet, want: http.StatusOK},
+		{name: "viewer writes", role: roleViewer, method: http.MethodPost, want: http.StatusForbidden},
+		{name: "editor writes", role: roleEditor, method: http.MethodPost, want: http.StatusOK},
+		{name: "admin deletes", role: roleAdmin, method: http.MethodDelete, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/plans", nil)
+			r = withUser(r, &User{Username: "alice", Role: tt.role})
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_adminUsers_audit(t *testing.T) {
+	db := newTestDB(t)
+	for _, name := range []string{"alice", "bob"} {
+		if err := addUser(db, name, "secret", roleViewer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	form := url.Values{"action": {"role"}, "username": {"bob"}, "role": {"editor"}}
+	r := httptest.NewRequest(http.MethodPost, "/admin/users", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = withUser(r, &User{Username: "alice", Role: roleAdmin})
+	w := httptest.NewRecorder()
+	adminUsers(db)(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the change is about bob and made by alice, the same as the user
+	// command records it about bob
+	entries, err := getAuditEntries(db, AuditFilter{Event: auditRoleChanged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Username != "bob" || entries[0].Actor != "alice" {
+		t.Errorf("expected the entry to be about bob by alice, got %+v", entries)
+	}
+	if byAlice, _ := getAuditEntries(db, AuditFilter{Username: "alice"}); len(byAlice) != 1 {
+		t.Errorf("expected filtering by alice to find the change she made, got %d", len(byAlice))
+	}
+}
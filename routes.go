@@ -7,15 +7,80 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func registerRoutes(mux *http.ServeMux, db *sql.DB) {
-	mux.HandleFunc("/list", basicAuth(list(db)))
-	mux.HandleFunc("/recipe", basicAuth(recipe(db)))
-	mux.HandleFunc("/extract", basicAuth(extractRecipes(db)))
-	mux.HandleFunc("/edit", basicAuth(edit(db)))
+func registerRoutes(mux *http.ServeMux, db *sql.DB, oidc *OIDCProvider, jobs *JobQueue) {
+	mux.HandleFunc("/login", login(db, oidc))
+	if oidc != nil {
+		mux.HandleFunc(oidcLoginPath, oidcLogin(oidc))
+		mux.HandleFunc(oidcCallbackPath, oidcLoginCallback(db, oidc))
+	}
+	mux.HandleFunc("/logout", logout(db))
+	mux.HandleFunc("/list", requireAuth(db, authorize(roleViewer, roleEditor, list(db))))
+	mux.HandleFunc("/recipe", requireAuth(db, authorize(roleViewer, roleEditor, recipe(db))))
+	mux.HandleFunc("/generate", requireAuth(db, generate(db, jobs)))
+	mux.HandleFunc("/generate/stream", requireAuth(db, generateStream(db, jobs)))
+	mux.HandleFunc("/classify", requireAuth(db, classifyAllergens(db)))
+	mux.HandleFunc("/job", requireAuth(db, authorize(roleViewer, roleEditor, generationJob(db))))
+	mux.HandleFunc("/extract", requireAuth(db, authorize(roleViewer, roleEditor, extractRecipes(db))))
+	mux.HandleFunc("/tags", optionalAuth(db, browseTags(db)))
+	mux.HandleFunc("/tags/", optionalAuth(db, browseTags(db)))
+	mux.HandleFunc("/share", requireAuth(db, authorize(roleEditor, roleEditor, shareRecipeHandler(db))))
+	mux.HandleFunc("/share-link", requireAuth(db, authorize(roleEditor, roleEditor, createShareLink(db))))
+	mux.HandleFunc("/shared", sharedRecipe(db))
+	mux.HandleFunc("/edit", requireAuth(db, authorize(roleEditor, roleEditor, edit(db))))
+	mux.HandleFunc("/export/epub", requireAuth(db, authorize(roleViewer, roleEditor, exportEPUB(db))))
+	mux.HandleFunc("/export/jsonld", requireAuth(db, authorize(roleViewer, roleEditor, exportJSONLD(db))))
+	mux.HandleFunc("/plans", requireAuth(db, authorize(roleViewer, roleEditor, mealPlans(db))))
+	mux.HandleFunc("/plan", requireAuth(db, authorize(roleViewer, roleEditor, mealPlan(db))))
+	mux.HandleFunc("/api/plans", requireAuth(db, authorize(roleViewer, roleEditor, apiMealPlans(db))))
+	mux.HandleFunc("/api/plans/", requireAuth(db, authorize(roleViewer, roleEditor, apiMealPlans(db))))
+	mux.HandleFunc("/plan.ics", mealPlanICS(db))
+	mux.HandleFunc("/shopping", requireAuth(db, authorize(roleViewer, roleEditor, shoppingList(db))))
+	mux.HandleFunc("/pantry", requireAuth(db, authorize(roleViewer, roleEditor, pantry(db))))
+	mux.HandleFunc("/cook-now", requireAuth(db, authorize(roleViewer, roleEditor, cookNow(db))))
+	mux.HandleFunc("/tokens", requireAuth(db, authorize(roleViewer, roleViewer, apiTokens(db))))
+	mux.HandleFunc("/admin/users", requireAuth(db, authorize(roleAdmin, roleAdmin, adminUsers(db))))
+	mux.HandleFunc("/admin/prompts", requireAuth(db, authorize(roleAdmin, roleAdmin, adminPrompts(db))))
+	mux.HandleFunc("/admin/tags", requireAuth(db, authorize(roleAdmin, roleAdmin, adminTags(db))))
+	mux.HandleFunc("/admin/retag", requireAuth(db, authorize(roleAdmin, roleAdmin, adminRetag(db))))
+	mux.HandleFunc("/admin/spend", requireAuth(db, authorize(roleAdmin, roleAdmin, adminSpend(db))))
+	mux.HandleFunc("/admin/audit", requireAuth(db, authorize(roleAdmin, roleAdmin, auditLog(db))))
+}
+
+// listPage is what list.html is rendered with, Diet and FreeFrom are the
+// filters picked
+type listPage struct {
+	Recipes   []*listRecipe
+	Diets     []string
+	Allergens []string
+	Diet      map[string]bool
+	FreeFrom  map[string]bool
+}
+
+type listRecipe struct {
+	*Recipe
+	Diet *DietInfo
+}
+
+// matches is true when the recipe suits every diet and is known to be free
+// from every allergen picked
+func (r *listRecipe) matches(diets, freeFrom map[string]bool) bool {
+	for diet := range diets {
+		if !r.Diet.SuitableFor(diet) {
+			return false
+		}
+	}
+	for allergen := range freeFrom {
+		if !r.Diet.FreeFrom(allergen) {
+			return false
+		}
+	}
+	return true
 }
 
 func list(db *sql.DB) http.HandlerFunc {
@@ -26,14 +91,37 @@ func list(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		recipesMeta, err := getAllRecipeMeta(db)
+		recipes, err := getAllRecipes(db, requestUser(req).HouseholdID)
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(res, "error getting recipes: %+v", err)
+			return
+		}
+		guessed, err := getIngredientClasses(db)
 		if err != nil {
 			res.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(res, "error getting recipe metadata: %+v", err)
+			fmt.Fprintf(res, "error: %v", err)
 			return
 		}
 
-		if err := templates.ExecuteTemplate(res, "list.html", recipesMeta); err != nil {
+		page := &listPage{Diets: diets, Allergens: allergens, Diet: map[string]bool{}, FreeFrom: map[string]bool{}}
+		for _, diet := range req.URL.Query()["diet"] {
+			page.Diet[diet] = true
+		}
+		for _, allergen := range req.URL.Query()["free"] {
+			page.FreeFrom[allergen] = true
+		}
+		for _, recipe := range recipes {
+			item := &listRecipe{Recipe: recipe, Diet: classifyRecipe(recipe, guessed)}
+			if item.matches(page.Diet, page.FreeFrom) {
+				page.Recipes = append(page.Recipes, item)
+			}
+		}
+		sort.Slice(page.Recipes, func(i, j int) bool {
+			return strings.ToLower(page.Recipes[i].Name) < strings.ToLower(page.Recipes[j].Name)
+		})
+
+		if err := renderTemplate(res, req, "list.html", page); err != nil {
 			res.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(res, "error rendering list: %v", err)
 			return
@@ -41,6 +129,38 @@ func list(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// recipePage is what recipe.html is rendered with. CanEdit is set for
+// editors in the household that owns the recipe and the sharing fields are
+// only filled in for them. Public pages from share links have no controls.
+type recipePage struct {
+	*Recipe
+	// ServingSize is what the recipe is generated for when it hasn't been
+	ServingSize int
+	CanEdit     bool
+	Public      bool
+	Households  []*Household
+	SharedWith  []*Household
+	// Job is set while a new version is being generated
+	Job *GenerationJob
+	// Diet and Nutrition are worked out from the ingredients
+	Diet      *DietInfo
+	Nutrition *Nutrition
+}
+
+// JSONLD is the recipe as schema.org JSON-LD for the page's head
+func (p *recipePage) JSONLD() map[string]interface{} {
+	return recipeJSONLD(p.Recipe, p.Nutrition, p.Diet)
+}
+
+// apiRecipe is a recipe as the API returns it, ForServingSize is the
+// nutrition for the serving size that was asked for
+type apiRecipe struct {
+	*Recipe
+	Nutrition      *Nutrition `json:"nutrition"`
+	ServingSize    int        `json:"serving_size,omitempty"`
+	ForServingSize *Nutrients `json:"nutrition_for_serving_size,omitempty"`
+}
+
 func recipe(db *sql.DB) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		if req.Method != http.MethodGet {
@@ -76,19 +196,15 @@ func recipe(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		regenerateParam := req.URL.Query().Get("regenerate")
-		var regenerate bool
-		if regenerateParam != "" {
-			regenerate, err = strconv.ParseBool(regenerateParam)
-			if err != nil {
-				res.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(res, "error: invalid regenerate provided")
-				return
-			}
+		if req.URL.Query().Get("regenerate") != "" {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(res, "error: recipes are regenerated with a POST to /generate, use the button on the recipe page")
+			return
 		}
 
 		// find recipe by ID
-		recipe, err := getRecipeByID(db, recipeID)
+		user := requestUser(req)
+		recipe, err := getRecipeByID(db, user.HouseholdID, recipeID)
 		if err != nil {
 			res.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(res, "error: unable to check DB for recipe")
@@ -101,26 +217,47 @@ func recipe(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// generate recipe
-		if recipe.RecipeText == "" || regenerate {
-			newRecipeVersion, err := generateRecipe(recipe, servingSizeInt)
-			if err != nil {
+		page := &recipePage{Recipe: recipe, ServingSize: servingSizeInt, CanEdit: !recipe.Shared && canDo(req, roleEditor)}
+		guessed, err := getIngredientClasses(db)
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(res, "error: %v", err)
+			return
+		}
+		page.Diet = classifyRecipe(recipe, guessed)
+		page.Nutrition = recipeNutrition(recipe)
+
+		if strings.Contains(req.Header.Get("Accept"), "application/json") {
+			api := &apiRecipe{Recipe: recipe, Nutrition: page.Nutrition, ServingSize: servingSizeInt}
+			if page.Nutrition != nil {
+				n := page.Nutrition.For(servingSizeInt)
+				api.ForServingSize = &n
+			}
+			writeJSON(res, http.StatusOK, api)
+			return
+		}
+
+		if !recipe.Shared {
+			if page.Job, err = getInFlightJob(db, recipe.ID); err != nil {
 				res.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(res, "error generating recipe: %v", err)
+				fmt.Fprintf(res, "error: %v", err)
 				return
 			}
-
-			newRecipe, err := insertRecipeVersion(db, newRecipeVersion)
-			if err != nil {
+		}
+		if page.CanEdit {
+			if page.Households, err = getHouseholds(db); err != nil {
 				res.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(res, "error inserting recipe version: %v", err)
+				fmt.Fprintf(res, "error: %v", err)
+				return
+			}
+			if page.SharedWith, err = getRecipeShares(db, recipe.ID); err != nil {
+				res.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(res, "error: %v", err)
 				return
 			}
-
-			recipe = newRecipe
 		}
 
-		if err := templates.ExecuteTemplate(res, "recipe.html", recipe); err != nil {
+		if err := renderTemplate(res, req, "recipe.html", page); err != nil {
 			res.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(res, "error rendering recipe: %v", err)
 			return
@@ -128,6 +265,95 @@ func recipe(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// generate queues making a new version of a recipe with the LLM and sends
+// the browser to the job's status page. It's a POST from the recipe page as
+// it costs money, so it checks for the generate scope itself rather than
+// asking tokens for write as well.
+func generate(db *sql.DB, jobs *JobQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+		if !canDo(r, roleEditor) {
+			forbidden(w, r, roleEditor)
+			return
+		}
+		if !tokenAllows(r, "generate") {
+			forbiddenScope(w, "generate")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error parsing form: %v", err)
+			return
+		}
+
+		recipeID, err := strconv.Atoi(r.PostFormValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: recipe ID must be an integer")
+			return
+		}
+		servingSize, err := strconv.Atoi(r.PostFormValue("serving_size"))
+		if err != nil || servingSize <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid serving size provided")
+			return
+		}
+
+		recipe, err := getRecipeByID(db, requestUser(r).HouseholdID, recipeID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to check DB for recipe")
+			log.Println(err.Error())
+			return
+		}
+		if recipe == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: recipe not found")
+			return
+		}
+		if recipe.Shared {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "forbidden: this recipe was shared with your household read only")
+			return
+		}
+
+		if !jobs.Available() {
+			generationUnavailable(w, r)
+			return
+		}
+
+		// checked here as well as when the job runs so people find out
+		// straight away
+		user := requestUser(r)
+		if err := checkBudget(db, user, time.Now()); err != nil {
+			if !budgetExceeded(w, err) {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+			}
+			return
+		}
+
+		job, err := enqueueJob(db, user, recipe, servingSize, strings.TrimSpace(r.PostFormValue("dietary")), r.PostFormValue("fresh") == "true", time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		jobs.Wake()
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Location", fmt.Sprintf("/job?id=%d", job.ID))
+			writeJSON(w, http.StatusAccepted, job)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/job?id=%d", job.ID), http.StatusSeeOther)
+	}
+}
+
 func extractRecipes(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -136,14 +362,19 @@ func extractRecipes(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		recipes, err := getAllRecipes(db)
+		recipes, err := getAllRecipes(db, requestUser(r).HouseholdID)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "error fetching recipes: %v", err)
 			return
 		}
 
-		recipesJSON, err := json.Marshal(recipes)
+		items := make([]*apiRecipe, 0, len(recipes))
+		for _, recipe := range recipes {
+			items = append(items, &apiRecipe{Recipe: recipe, Nutrition: recipeNutrition(recipe)})
+		}
+
+		recipesJSON, err := json.Marshal(items)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "error marshalling recipes: %v", err)
@@ -159,7 +390,7 @@ func edit(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			if err := templates.ExecuteTemplate(w, "edit.html", nil); err != nil {
+			if err := renderTemplate(w, r, "edit.html", nil); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				fmt.Fprintf(w, "error rendering edit: %v", err)
 				return
@@ -244,10 +475,12 @@ func edit(db *sql.DB) http.HandlerFunc {
 		}
 
 		// create recipe
+		user := requestUser(r)
 		recipe := &Recipe{
-			Name:      recipeName,
-			Reference: recipeURL,
-			Tags:      tags,
+			Name:        recipeName,
+			Reference:   recipeURL,
+			Tags:        tags,
+			HouseholdID: user.HouseholdID,
 			Content: &RecipeContent{
 				Servings:      servingSize,
 				Ingredients:   ingredients,
@@ -257,7 +490,14 @@ func edit(db *sql.DB) http.HandlerFunc {
 			},
 		}
 
-		if err := generateTags(recipe, false); err != nil {
+		// tags are a nice to have, the recipe is saved without them once the
+		// budget is used up
+		var usage *LLMUsage
+		if err := checkBudget(db, user, time.Now()); err != nil {
+			fmt.Printf("not generating tags: %v\n", err)
+		} else if prompt, err := renderPrompt(db, usageTaskTags, tagPromptData(recipe.Name)); err != nil {
+			fmt.Printf("error rendering tags prompt: %v\n", err)
+		} else if usage, err = generateTags(recipe, prompt, false); err != nil {
 			fmt.Printf("error generating tags: %v", err)
 		}
 
@@ -267,6 +507,9 @@ func edit(db *sql.DB) http.HandlerFunc {
 			fmt.Fprintf(w, "error: unable to commit recipe to db")
 			return
 		}
+		if err := recordUsage(db, user, newRecipe.ID, usage, time.Now()); err != nil {
+			fmt.Println(err)
+		}
 
 		// redirect to recipe
 		http.Redirect(w, r, fmt.Sprintf("/recipe?id=%d&serving_size=%d", newRecipe.ID, servingSize), http.StatusFound)
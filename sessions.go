@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "session"
+	sessionLifetime   = 30 * 24 * time.Hour
+)
+
+type Session struct {
+	ID        string
+	UserID    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// hashToken is what session and api tokens are stored as, a copy of the db
+// on its own is no good for logging in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession stores a new session for the user and returns the token to
+// put in the cookie
+func createSession(db *sql.DB, user *User, now time.Time) (string, *Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("unable to generate session token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	session := &Session{
+		ID:        hashToken(token),
+		UserID:    user.ID,
+		CreatedAt: now.UTC(),
+		ExpiresAt: now.UTC().Add(sessionLifetime),
+	}
+	if _, err := db.Exec("INSERT INTO sessions(id, user_id, created_at, expires_at) values(?,?,?,?)",
+		session.ID, session.UserID, session.CreatedAt.Format(time.RFC3339), session.ExpiresAt.Format(time.RFC3339)); err != nil {
+		return "", nil, fmt.Errorf("unable to store session: %w", err)
+	}
+
+	return token, session, nil
+}
+
+// getSessionUser returns the user a session token belongs to, or nil if the
+// session doesn't exist, has expired or has been revoked
+func getSessionUser(db *sql.DB, token string, now time.Time) (*User, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	var expiresAt string
+	user, err := scanUser(db.QueryRow(`
+SELECT `+userColumns+`, s.expires_at
+FROM sessions s JOIN users u ON u.id = s.user_id
+WHERE s.id = ? AND s.revoked_at IS NULL`, hashToken(token)), &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get session: %w", err)
+	}
+
+	expires, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil || !now.Before(expires) {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+func revokeSession(db *sql.DB, token string, now time.Time) error {
+	if _, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", now.UTC().Format(time.RFC3339), hashToken(token)); err != nil {
+		return fmt.Errorf("unable to revoke session: %w", err)
+	}
+	return nil
+}
+
+// revokeUserSessions logs a user out everywhere, used when their password
+// changes or they're removed
+func revokeUserSessions(db *sql.DB, username string, now time.Time) error {
+	if _, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE revoked_at IS NULL AND user_id IN (SELECT id FROM users WHERE username = ?)", now.UTC().Format(time.RFC3339), username); err != nil {
+		return fmt.Errorf("unable to revoke sessions for %s: %w", username, err)
+	}
+	return nil
+}
+
+// deleteStaleSessions clears out sessions that can never be used again
+func deleteStaleSessions(db *sql.DB, now time.Time) error {
+	if _, err := db.Exec("DELETE FROM sessions WHERE expires_at < ? OR revoked_at IS NOT NULL", now.UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("unable to delete stale sessions: %w", err)
+	}
+	return nil
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(requestBaseURL(r), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(requestBaseURL(r), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// safeRedirectTarget only allows redirecting back to a path on this site so
+// the login form can't be used to bounce people somewhere else. Browsers
+// treat \ as / and drop tabs and newlines, so "/\t/evil.com" is "//evil.com"
+// to them and anything with those in is refused too.
+func safeRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\t\r\n") {
+		return "/list"
+	}
+	if u, err := url.Parse(next); err != nil || u.Scheme != "" || u.Host != "" {
+		return "/list"
+	}
+	return next
+}
+
+type loginPage struct {
+	Next  string
+	Error string
+	SSO   bool
+}
+
+func login(db *sql.DB, oidc *OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			page := loginPage{Next: safeRedirectTarget(r.URL.Query().Get("next")), SSO: oidc != nil}
+			if err := renderTemplate(w, r, "login.html", page); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error rendering login: %v", err)
+			}
+			return
+		case http.MethodPost:
+			break
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error parsing form: %v", err)
+			return
+		}
+
+		next := safeRedirectTarget(r.PostFormValue("next"))
+		username := r.PostFormValue("username")
+		ip := clientIP(r)
+		now := time.Now()
+
+		// locked out logins aren't checked at all so guesses made while
+		// locked out can't be told apart
+		wait, err := loginLockedFor(db, ip, username, now)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to check credentials")
+			fmt.Println(err)
+			return
+		}
+		if wait > 0 {
+			audit(db, r, auditLoginLocked, username, "login form")
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			page := loginPage{Next: next, Error: "Too many failed attempts, try again in " + formatWait(wait), SSO: oidc != nil}
+			if err := renderTemplate(w, r, "login.html", page); err != nil {
+				fmt.Fprintf(w, "error rendering login: %v", err)
+			}
+			return
+		}
+
+		user, err := authenticateUser(db, username, r.PostFormValue("password"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to check credentials")
+			fmt.Println("error authenticating", username, err)
+			return
+		}
+		if user == nil {
+			audit(db, r, auditLoginFailed, username, "login form")
+			if _, err := recordLoginFailure(db, ip, username, now); err != nil {
+				fmt.Println(err)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			page := loginPage{Next: next, Error: "Incorrect username or password", SSO: oidc != nil}
+			if err := renderTemplate(w, r, "login.html", page); err != nil {
+				fmt.Fprintf(w, "error rendering login: %v", err)
+			}
+			return
+		}
+		if err := clearLoginFailures(db, user.Username); err != nil {
+			fmt.Println(err)
+		}
+
+		token, session, err := createSession(db, user, now)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to start session")
+			fmt.Println(err)
+			return
+		}
+
+		audit(db, r, auditLogin, user.Username, "login form")
+		setSessionCookie(w, r, token, session.ExpiresAt)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+}
+
+func logout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			if user, _ := getSessionUser(db, cookie.Value, time.Now()); user != nil {
+				audit(db, r, auditLogout, user.Username, "")
+			}
+			if err := revokeSession(db, cookie.Value, time.Now()); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+		}
+
+		clearSessionCookie(w, r)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
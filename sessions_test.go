@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_getSessionUser(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "alice", "secret", roleEditor); err != nil {
+		t.Fatal(err)
+	}
+	if err := addUser(db, "bob", "secret", roleEditor); err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := getUser(db, "alice")
+	bob, _ := getUser(db, "bob")
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	token, session, err := createSession(db, alice, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ID == token {
+		t.Errorf("expected the session to be stored hashed")
+	}
+	other, _, err := createSession(db, alice, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobs, _, err := createSession(db, bob, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  string
+	}{
+		{"valid", token, now, "alice"},
+		{"just before expiry", token, now.Add(sessionLifetime - time.Second), "alice"},
+		{"expired", token, now.Add(sessionLifetime), ""},
+		{"empty", "", now, ""},
+		{"unknown", "not-a-session", now, ""},
+		{"hash isn't a token", session.ID, now, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := getSessionUser(db, tt.token, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if user != nil {
+				got = user.Username
+			}
+			if got != tt.want {
+				t.Errorf("getSessionUser() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if err := revokeSession(db, token, now); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := getSessionUser(db, token, now); user != nil {
+		t.Errorf("expected revoked session not to log in")
+	}
+	if user, _ := getSessionUser(db, other, now); user == nil {
+		t.Errorf("expected revoking one session to leave the others")
+	}
+
+	if err := revokeUserSessions(db, "alice", now); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := getSessionUser(db, other, now); user != nil {
+		t.Errorf("expected all of alice's sessions to be revoked")
+	}
+	if user, _ := getSessionUser(db, bobs, now); user == nil {
+		t.Errorf("expected bob's session to be left alone")
+	}
+
+	if err := deleteStaleSessions(db, now); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected only bob's session to be kept, got %d", count)
+	}
+}
+
+func Test_logout(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "alice", "secret", roleEditor); err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := getUser(db, "alice")
+	token, _, err := createSession(db, alice, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	res := httptest.NewRecorder()
+	logout(db).ServeHTTP(res, req)
+
+	if res.Code != http.StatusSeeOther || res.Header().Get("Location") != "/login" {
+		t.Errorf("logout = %d to %q, want 303 to /login", res.Code, res.Header().Get("Location"))
+	}
+	cleared := false
+	for _, c := range res.Result().Cookies() {
+		if c.Name == sessionCookieName && c.Value == "" && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Errorf("expected the session cookie to be cleared")
+	}
+	if user, _ := getSessionUser(db, token, time.Now()); user != nil {
+		t.Errorf("expected the session to be revoked on logout")
+	}
+
+	entries, err := getAuditEntries(db, AuditFilter{Event: auditLogout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Username != "alice" {
+		t.Errorf("expected logout to be audited for alice, got %+v", entries)
+	}
+
+	res = httptest.NewRecorder()
+	logout(db).ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/logout", nil))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /logout = %d, want 405", res.Code)
+	}
+}
+
+func Test_safeRedirectTarget(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"/recipe?id=3", "/recipe?id=3"},
+		{"/plans/2?week=1#dinner", "/plans/2?week=1#dinner"},
+		{"", "/list"},
+		{"list", "/list"},
+		{"//evil.com", "/list"},
+		{"/\\evil.com", "/list"},
+		{"https://evil.com", "/list"},
+		{"javascript:alert(1)", "/list"},
+		{"/\t/evil.com", "/list"},
+		{"/\n/evil.com", "/list"},
+		{"/path\\..\\", "/list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.next, func(t *testing.T) {
+			if got := safeRedirectTarget(tt.next); got != tt.want {
+				t.Errorf("safeRedirectTarget(%q) = %q, want %q", tt.next, got, tt.want)
+			}
+		})
+	}
+}
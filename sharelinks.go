@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ShareLink is a signed, read only link to one version of a recipe at a
+// fixed serving size, anyone with the link can view it without logging in
+type ShareLink struct {
+	RecipeID    int
+	HouseholdID int
+	Servings    int
+	// Expires is the zero time for links that never expire
+	Expires time.Time
+}
+
+// getShareLinkSecret returns the key share links are signed with. It's
+// SHARE_LINK_SECRET when that's set, otherwise a random key is made the first
+// time and kept in the db so links survive restarts. Changing it breaks
+// every link handed out so far.
+func getShareLinkSecret(db *sql.DB, getenv func(string) string) ([]byte, error) {
+	if secret := getenv("SHARE_LINK_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	return getAppSecret(db, "share_links")
+}
+
+func (l *ShareLink) signature(secret []byte) string {
+	var expires int64
+	if !l.Expires.IsZero() {
+		expires = l.Expires.Unix()
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "recipe:%d:%d:%d:%d", l.RecipeID, l.HouseholdID, l.Servings, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the signed link relative to the site root
+func (l *ShareLink) URL(secret []byte) string {
+	query := url.Values{
+		"id":       {strconv.Itoa(l.RecipeID)},
+		"h":        {strconv.Itoa(l.HouseholdID)},
+		"servings": {strconv.Itoa(l.Servings)},
+		"sig":      {l.signature(secret)},
+	}
+	if !l.Expires.IsZero() {
+		query.Set("expires", strconv.FormatInt(l.Expires.Unix(), 10))
+	}
+	return "/shared?" + query.Encode()
+}
+
+var (
+	errShareLinkInvalid = fmt.Errorf("this link isn't valid, check it was copied in full")
+	errShareLinkExpired = fmt.Errorf("this link has expired, ask for a new one")
+)
+
+// parseShareLink checks the signature and expiry of a link's query
+func parseShareLink(query url.Values, secret []byte, now time.Time) (*ShareLink, error) {
+	link := &ShareLink{}
+	var err error
+	if link.RecipeID, err = strconv.Atoi(query.Get("id")); err != nil {
+		return nil, errShareLinkInvalid
+	}
+	if link.HouseholdID, err = strconv.Atoi(query.Get("h")); err != nil {
+		return nil, errShareLinkInvalid
+	}
+	if link.Servings, err = strconv.Atoi(query.Get("servings")); err != nil {
+		return nil, errShareLinkInvalid
+	}
+	if expires := query.Get("expires"); expires != "" {
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || unix == 0 {
+			return nil, errShareLinkInvalid
+		}
+		link.Expires = time.Unix(unix, 0)
+	}
+
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(link.signature(secret))) {
+		return nil, errShareLinkInvalid
+	}
+	if !link.Expires.IsZero() && !now.Before(link.Expires) {
+		return nil, errShareLinkExpired
+	}
+	return link, nil
+}
+
+type shareLinkPage struct {
+	Recipe  *Recipe
+	URL     string
+	Expires time.Time
+}
+
+// createShareLink makes a link for the recipe page's share form, the link
+// is for the version being looked at so later changes aren't shared
+func createShareLink(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error parsing form: %v", err)
+			return
+		}
+
+		recipeID, err := strconv.Atoi(r.PostFormValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: recipe ID must be an integer")
+			return
+		}
+		days, err := strconv.Atoi(r.PostFormValue("expires_in"))
+		if err != nil || days < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: expires_in must be a number of days, 0 for never")
+			return
+		}
+
+		recipe, err := getRecipeByID(db, requestUser(r).HouseholdID, recipeID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if recipe == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: recipe not found")
+			return
+		}
+		if recipe.Shared {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "forbidden: this recipe was shared with your household, only its owners can share it")
+			return
+		}
+		if recipe.Content == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: this recipe hasn't been generated yet")
+			return
+		}
+
+		secret, err := getShareLinkSecret(db, os.Getenv)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		link := &ShareLink{RecipeID: recipe.ID, HouseholdID: recipe.HouseholdID, Servings: recipe.Content.Servings}
+		if days > 0 {
+			link.Expires = time.Now().AddDate(0, 0, days).Truncate(time.Second)
+		}
+
+		page := shareLinkPage{Recipe: recipe, URL: requestBaseURL(r) + link.URL(secret), Expires: link.Expires}
+		if err := renderTemplate(w, r, "sharelink.html", page); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error rendering share link: %v", err)
+		}
+	}
+}
+
+// sharedRecipe renders a recipe from a share link. It sits outside of auth,
+// the signature is what lets people in.
+func sharedRecipe(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		secret, err := getShareLinkSecret(db, os.Getenv)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		link, err := parseShareLink(r.URL.Query(), secret, time.Now())
+		if err == errShareLinkExpired {
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		recipe, err := getRecipeByID(db, link.HouseholdID, link.RecipeID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to get recipe")
+			fmt.Println(err)
+			return
+		}
+		if recipe == nil || recipe.Content == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: recipe not found")
+			return
+		}
+		recipe.Content.Servings = link.Servings
+		guessed, err := getIngredientClasses(db)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to get recipe")
+			fmt.Println(err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		if err := renderTemplate(w, r, "recipe.html", &recipePage{Recipe: recipe, Public: true, Diet: classifyRecipe(recipe, guessed), Nutrition: recipeNutrition(recipe)}); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error rendering recipe: %v", err)
+		}
+	}
+}
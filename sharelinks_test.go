@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseShareLink(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	query := func(link *ShareLink, secret []byte) url.Values {
+		u, err := url.Parse(link.URL(secret))
+		if err != nil {
+			t.Fatalf("unable to parse link: %v", err)
+		}
+		return u.Query()
+	}
+
+	tampered := query(&ShareLink{RecipeID: 1, HouseholdID: 1, Servings: 2}, secret)
+	tampered.Set("id", "2")
+	resized := query(&ShareLink{RecipeID: 1, HouseholdID: 1, Servings: 2}, secret)
+	resized.Set("servings", "20")
+	unexpired := query(&ShareLink{RecipeID: 1, HouseholdID: 1, Servings: 2, Expires: now.Add(time.Hour)}, secret)
+	unexpired.Del("expires")
+
+	tests := []struct {
+		name    string
+		query   url.Values
+		wantErr error
+	}{
+		{"never expires", query(&ShareLink{RecipeID: 1, HouseholdID: 1, Servings: 2}, secret), nil},
+		{"not expired yet", query(&ShareLink{RecipeID: 1, HouseholdID: 1, Servings: 2, Expires: now.Add(time.Hour)}, secret), nil},
+		{"expired", query(&ShareLink{RecipeID: 1, HouseholdID: 1, Servings: 2, Expires: now.Add(-time.Hour)}, secret), errShareLinkExpired},
+		{"other secret", query(&ShareLink{RecipeID: 1, HouseholdID: 1, Servings: 2}, []byte("other")), errShareLinkInvalid},
+		{"tampered recipe", tampered, errShareLinkInvalid},
+		{"tampered servings", resized, errShareLinkInvalid},
+		{"expiry removed", unexpired, errShareLinkInvalid},
+		{"empty", url.Values{}, errShareLinkInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link, err := parseShareLink(tt.query, secret, now)
+			if err != tt.wantErr {
+				t.Fatalf("parseShareLink() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (link.RecipeID != 1 || link.Servings != 2) {
+				t.Errorf("parseShareLink() = %+v", link)
+			}
+		})
+	}
+}
+
+func Test_getShareLinkSecret(t *testing.T) {
+	db := newTestDB(t)
+	noenv := func(string) string { return "" }
+
+	first, err := getShareLinkSecret(db, noenv)
+	if err != nil {
+		t.Fatalf("unable to get secret: %v", err)
+	}
+	second, err := getShareLinkSecret(db, noenv)
+	if err != nil {
+		t.Fatalf("unable to get secret: %v", err)
+	}
+	if len(first) != 32 || string(first) != string(second) {
+		t.Errorf("expected the generated secret to be kept, got %x then %x", first, second)
+	}
+
+	env, _ := getShareLinkSecret(db, func(string) string { return "from env" })
+	if !strings.EqualFold(string(env), "from env") {
+		t.Errorf("expected SHARE_LINK_SECRET to win, got %q", env)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// itemWeights are rough weights in grams for a single whole item, they let
+// "200 g onion" and "1 onion" be added together
+var itemWeights = map[string]float64{
+	"onion":        150,
+	"red onion":    150,
+	"shallot":      40,
+	"tomato":       120,
+	"potato":       200,
+	"sweet potato": 250,
+	"carrot":       80,
+	"lemon":        100,
+	"lime":         70,
+	"bell pepper":  160,
+	"red pepper":   160,
+	"courgette":    200,
+	"zucchini":     200,
+	"aubergine":    250,
+	"eggplant":     250,
+	"apple":        180,
+	"banana":       120,
+	"avocado":      170,
+	"cucumber":     300,
+	"leek":         200,
+}
+
+// aisles are the store sections a shopping list is grouped into, in the
+// order you'd walk round the shop. An ingredient goes in the aisle with the
+// longest keyword it contains so "tomato sauce" beats "tomato".
+var aisles = []struct {
+	Name     string
+	Keywords []string
+}{
+	{"Produce", []string{"onion", "shallot", "garlic", "tomato", "potato", "carrot", "celery", "lemon", "lime", "pepper", "bell pepper", "chilli", "chili", "jalapeno", "ginger", "lettuce", "spinach", "kale", "cabbage", "broccoli", "cauliflower", "courgette", "zucchini", "aubergine", "eggplant", "mushroom", "avocado", "cucumber", "leek", "spring onion", "scallion", "apple", "banana", "berry", "pea", "bean sprout", "squash", "pumpkin", "corn", "herb", "parsley", "coriander", "cilantro", "basil", "mint", "dill", "chive", "rosemary", "thyme", "sage"}},
+	{"Meat & Fish", []string{"chicken", "beef", "pork", "lamb", "mince", "bacon", "sausage", "chorizo", "ham", "turkey", "duck", "steak", "fish", "salmon", "tuna", "cod", "haddock", "prawn", "shrimp", "mussel", "anchovy"}},
+	{"Dairy & Eggs", []string{"milk", "butter", "cream", "cheese", "parmesan", "cheddar", "mozzarella", "feta", "halloumi", "ricotta", "yoghurt", "yogurt", "egg", "creme fraiche", "mascarpone"}},
+	{"Bakery", []string{"bread", "baguette", "tortilla", "wrap", "pitta", "pita", "naan", "bun", "roll", "crouton", "breadcrumb"}},
+	{"Dry Goods", []string{"pasta", "spaghetti", "penne", "orzo", "noodle", "rice", "flour", "sugar", "oat", "lentil", "quinoa", "couscous", "cornflour", "baking powder", "bicarbonate", "yeast", "nut", "almond", "walnut", "cashew", "peanut", "seed", "chocolate", "cocoa", "dried"}},
+	{"Tins & Jars", []string{"tinned", "canned", "tomato sauce", "passata", "tomato paste", "tomato puree", "chopped tomato", "coconut milk", "stock", "broth", "chickpea", "kidney bean", "black bean", "bean", "olive", "caper", "jam", "pesto", "curry paste", "peanut butter"}},
+	{"Oils & Condiments", []string{"oil", "olive oil", "vinegar", "sauce", "soy sauce", "mustard", "ketchup", "mayonnaise", "mayo", "honey", "syrup", "dressing", "worcestershire"}},
+	{"Herbs & Spices", []string{"salt", "salt and pepper", "black pepper", "pepper flake", "peppercorn", "paprika", "cumin", "turmeric", "cinnamon", "nutmeg", "oregano", "chilli powder", "chili powder", "chilli flake", "garam masala", "curry powder", "spice", "bay leaf", "cardamom", "clove", "coriander seed", "cayenne", "vanilla"}},
+	{"Frozen", []string{"frozen", "ice cream"}},
+}
+
+const otherAisle = "Other"
+
+func aisleFor(name string) string {
+	best, bestLen := otherAisle, 0
+	for _, a := range aisles {
+		for _, k := range a.Keywords {
+			if len(k) > bestLen && strings.Contains(name, k) {
+				best, bestLen = a.Name, len(k)
+			}
+		}
+	}
+	return best
+}
+
+type ShoppingList struct {
+	Key     string           `json:"key"`
+	Title   string           `json:"title"`
+	Aisles  []*ShoppingAisle `json:"aisles"`
+	Missing []string         `json:"missing_recipes,omitempty"`
+}
+
+type ShoppingAisle struct {
+	Name  string          `json:"name"`
+	Items []*ShoppingItem `json:"items"`
+}
+
+type ShoppingItem struct {
+	Name       string     `json:"name"`
+	Quantity   string     `json:"quantity"`
+	Quantities []Quantity `json:"quantities"`
+	Recipes    []string   `json:"recipes"`
+	Checked    bool       `json:"checked"`
+}
+
+// shoppingSelection is a recipe and the number of people it's being cooked for
+type shoppingSelection struct {
+	Recipe   *Recipe
+	Servings int
+}
+
+// buildShoppingList scales every selected recipe to its serving count and
+// merges the same ingredient across recipes, quantities in different units
+// that can't be converted are kept side by side on the same line
+func buildShoppingList(selections []shoppingSelection) *ShoppingList {
+	list := &ShoppingList{}
+
+	items := map[string]*ShoppingItem{}
+	amounts := map[string]map[string]float64{}
+	for _, s := range selections {
+		if s.Recipe.Content == nil || len(s.Recipe.Content.Ingredients) == 0 {
+			list.Missing = append(list.Missing, s.Recipe.Name)
+			continue
+		}
+
+		scale := 1.0
+		if s.Recipe.Content.Servings > 0 && s.Servings > 0 {
+			scale = float64(s.Servings) / float64(s.Recipe.Content.Servings)
+		}
+
+		for rawName, amount := range s.Recipe.Content.Ingredients {
+			name, q, ok := parseIngredientQuantity(rawName, amount)
+			if name == "" {
+				continue
+			}
+			item, found := items[name]
+			if !found {
+				item = &ShoppingItem{Name: name}
+				items[name] = item
+				amounts[name] = map[string]float64{}
+			}
+			if !containsString(item.Recipes, s.Recipe.Name) {
+				item.Recipes = append(item.Recipes, s.Recipe.Name)
+			}
+			if ok {
+				amounts[name][q.Unit] += q.Value * scale
+			}
+		}
+	}
+
+	byAisle := map[string]*ShoppingAisle{}
+	for name, item := range items {
+		units := amounts[name]
+		if weight, ok := itemWeights[name]; ok {
+			if count, hasCount := units[""]; hasCount {
+				if _, hasMass := units["g"]; hasMass {
+					units["g"] += count * weight
+					delete(units, "")
+				}
+			}
+		}
+
+		unitNames := []string{}
+		for u := range units {
+			unitNames = append(unitNames, u)
+		}
+		sort.Strings(unitNames)
+
+		formatted := []string{}
+		for _, u := range unitNames {
+			q := Quantity{Value: units[u], Unit: u}
+			item.Quantities = append(item.Quantities, q)
+			formatted = append(formatted, formatQuantity(q))
+		}
+		item.Quantity = strings.Join(formatted, " + ")
+		sort.Strings(item.Recipes)
+
+		aisle := aisleFor(name)
+		if _, ok := byAisle[aisle]; !ok {
+			byAisle[aisle] = &ShoppingAisle{Name: aisle}
+		}
+		byAisle[aisle].Items = append(byAisle[aisle].Items, item)
+	}
+
+	for _, a := range aisles {
+		if aisle, ok := byAisle[a.Name]; ok {
+			list.Aisles = append(list.Aisles, aisle)
+		}
+	}
+	if aisle, ok := byAisle[otherAisle]; ok {
+		list.Aisles = append(list.Aisles, aisle)
+	}
+	for _, aisle := range list.Aisles {
+		sort.Slice(aisle.Items, func(i, j int) bool {
+			return aisle.Items[i].Name < aisle.Items[j].Name
+		})
+	}
+
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeShoppingText writes the unchecked items in a form that pastes nicely
+// into a messaging app
+func writeShoppingText(w io.Writer, list *ShoppingList) {
+	fmt.Fprintf(w, "%s\n", list.Title)
+	for _, aisle := range list.Aisles {
+		lines := []string{}
+		for _, item := range aisle.Items {
+			if item.Checked {
+				continue
+			}
+			if item.Quantity == "" {
+				lines = append(lines, "- "+item.Name)
+			} else {
+				lines = append(lines, fmt.Sprintf("- %s %s", item.Quantity, item.Name))
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\n%s\n", aisle.Name, strings.Join(lines, "\n"))
+	}
+}
+
+func getShoppingChecks(db *sql.DB, key string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT item FROM shopping_list_checks WHERE list_key = ?", key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query shopping list checks: %w", err)
+	}
+	defer rows.Close()
+
+	checks := map[string]bool{}
+	for rows.Next() {
+		var item string
+		if err := rows.Scan(&item); err != nil {
+			return nil, fmt.Errorf("unable to scan shopping list check: %w", err)
+		}
+		checks[item] = true
+	}
+	return checks, rows.Err()
+}
+
+func setShoppingCheck(db *sql.DB, key, item string, checked bool) error {
+	var err error
+	if checked {
+		_, err = db.Exec("INSERT OR IGNORE INTO shopping_list_checks(list_key, item) values(?,?)", key, item)
+	} else {
+		_, err = db.Exec("DELETE FROM shopping_list_checks WHERE list_key = ? AND item = ?", key, item)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to update shopping list check: %w", err)
+	}
+	return nil
+}
+
+// shoppingSelectionFromQuery reads either a meal plan week (plan=N&week=W)
+// or a set of recipes (recipe=ID:servings, repeated) from the query string.
+// It also returns a key that identifies the household's list for storing
+// check-offs.
+func shoppingSelectionFromQuery(db *sql.DB, householdID int, query url.Values) ([]shoppingSelection, string, string, error) {
+	selections := []shoppingSelection{}
+
+	if planParam := query.Get("plan"); planParam != "" {
+		planID, err := strconv.Atoi(planParam)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("plan ID must be an integer")
+		}
+		week, _ := strconv.Atoi(query.Get("week"))
+
+		plan, err := getMealPlan(db, householdID, planID)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if plan == nil {
+			return nil, "", "", fmt.Errorf("meal plan not found")
+		}
+
+		for _, day := range buildPlanWeek(plan, week) {
+			for _, meal := range meals {
+				for _, slot := range day.Slots[meal] {
+					recipe, err := getRecipeByID(db, householdID, slot.RecipeID)
+					if err != nil {
+						return nil, "", "", fmt.Errorf("unable to get recipe %d: %w", slot.RecipeID, err)
+					}
+					if recipe == nil {
+						// the share was taken away after it was planned
+						continue
+					}
+					selections = append(selections, shoppingSelection{Recipe: recipe, Servings: slot.Servings})
+				}
+			}
+		}
+
+		start, _ := time.Parse(planDateFormat, plan.StartDate)
+		title := fmt.Sprintf("Shopping for %s (week of %s)", plan.Name, start.AddDate(0, 0, 7*week).Format("2 Jan"))
+		return selections, fmt.Sprintf("plan:%d:%d", planID, week), title, nil
+	}
+
+	params := query["recipe"]
+	if len(params) == 0 {
+		return nil, "", "", fmt.Errorf("no plan or recipes provided")
+	}
+
+	sort.Strings(params)
+	for _, p := range params {
+		idPart, servingsPart, _ := strings.Cut(p, ":")
+		recipeID, err := strconv.Atoi(idPart)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("recipe ID must be an integer")
+		}
+		recipe, err := getRecipeByID(db, householdID, recipeID)
+		if err != nil || recipe == nil {
+			return nil, "", "", fmt.Errorf("recipe %d not found", recipeID)
+		}
+
+		servings := 0
+		if servingsPart != "" {
+			if servings, err = strconv.Atoi(servingsPart); err != nil || servings <= 0 {
+				return nil, "", "", fmt.Errorf("invalid serving size for recipe %d", recipeID)
+			}
+		}
+		selections = append(selections, shoppingSelection{Recipe: recipe, Servings: servings})
+	}
+
+	key := fmt.Sprintf("recipes:%d:%x", householdID, sha1.Sum([]byte(strings.Join(params, ","))))
+	return selections, key, "Shopping list", nil
+}
+
+func shoppingList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		selections, key, title, err := shoppingSelectionFromQuery(db, requestUser(r).HouseholdID, r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error parsing form: %v", err)
+				return
+			}
+			item := r.PostFormValue("item")
+			if item == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: no item provided")
+				return
+			}
+			checked, err := strconv.ParseBool(r.PostFormValue("checked"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: invalid checked provided")
+				return
+			}
+			if err := setShoppingCheck(db, key, item, checked); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+			return
+		}
+
+		list := buildShoppingList(selections)
+		list.Key, list.Title = key, title
+
+		checks, err := getShoppingChecks(db, key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		for _, aisle := range list.Aisles {
+			for _, item := range aisle.Items {
+				item.Checked = checks[item.Name]
+			}
+		}
+
+		switch r.URL.Query().Get("format") {
+		case "json":
+			writeJSON(w, http.StatusOK, list)
+		case "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writeShoppingText(w, list)
+		default:
+			query := r.URL.Query()
+			query.Del("format")
+			data := struct {
+				*ShoppingList
+				URL template.URL
+			}{list, template.URL("/shopping?" + query.Encode())}
+			if err := renderTemplate(w, r, "shopping.html", data); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error rendering shopping list: %v", err)
+			}
+		}
+	}
+}
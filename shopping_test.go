@@ -0,0 +1,143 @@
+package main
+
+import "testing"
+
+func Test_parseIngredientQuantity(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawName  string
+		amount   *IngredientAmount
+		wantName string
+		want     Quantity
+		wantOK   bool
+	}{
+		{
+			name:     "formatted line",
+			rawName:  "flour, sifted",
+			amount:   &IngredientAmount{Amount: "250", Unit: "g"},
+			wantName: "flour",
+			want:     Quantity{Value: 250, Unit: "g"},
+			wantOK:   true,
+		},
+		{
+			name:     "fractional spoon",
+			rawName:  "salt",
+			amount:   &IngredientAmount{Amount: "1/2", Unit: "tsp"},
+			wantName: "salt",
+			want:     Quantity{Value: 2.5, Unit: "ml"},
+			wantOK:   true,
+		},
+		{
+			name:     "amount glued to unit",
+			rawName:  "caesar salad dressing",
+			amount:   &IngredientAmount{Amount: "60ml"},
+			wantName: "caesar salad dressing",
+			want:     Quantity{Value: 60, Unit: "ml"},
+			wantOK:   true,
+		},
+		{
+			name:     "quantity left in the name",
+			rawName:  "1 small onion, diced",
+			amount:   &IngredientAmount{},
+			wantName: "onion",
+			want:     Quantity{Value: 1, Unit: ""},
+			wantOK:   true,
+		},
+		{
+			name:     "count unit in the name",
+			rawName:  "2 slices of white bread",
+			amount:   nil,
+			wantName: "white bread",
+			want:     Quantity{Value: 2, Unit: "slice"},
+			wantOK:   true,
+		},
+		{
+			name:     "size word before the unit",
+			rawName:  "2 small heads of romaine lettuce",
+			amount:   &IngredientAmount{},
+			wantName: "romaine lettuce",
+			want:     Quantity{Value: 2, Unit: "head"},
+			wantOK:   true,
+		},
+		{
+			name:     "no quantity",
+			rawName:  "Salt and pepper to taste",
+			amount:   nil,
+			wantName: "salt and pepper to taste",
+			wantOK:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotName, got, gotOK := parseIngredientQuantity(tt.rawName, tt.amount)
+			if gotName != tt.wantName {
+				t.Errorf("expected name %q, got %q", tt.wantName, gotName)
+			}
+			if gotOK != tt.wantOK {
+				t.Fatalf("expected ok to be %v, got %v", tt.wantOK, gotOK)
+			}
+			if gotOK && got != tt.want {
+				t.Errorf("expected quantity %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_buildShoppingList(t *testing.T) {
+	curry := &Recipe{
+		Name: "Curry",
+		Content: &RecipeContent{
+			Servings: 2,
+			Ingredients: map[string]*IngredientAmount{
+				"onion, diced": {Amount: "200", Unit: "g"},
+				"rice":         {Amount: "150", Unit: "g"},
+			},
+		},
+	}
+	soup := &Recipe{
+		Name: "Soup",
+		Content: &RecipeContent{
+			Servings: 4,
+			Ingredients: map[string]*IngredientAmount{
+				"2 onions": {},
+				"stock":    {Amount: "1", Unit: "l"},
+			},
+		},
+	}
+	unwritten := &Recipe{Name: "Mystery"}
+
+	list := buildShoppingList([]shoppingSelection{
+		{Recipe: curry, Servings: 4},
+		{Recipe: soup, Servings: 2},
+		{Recipe: unwritten, Servings: 2},
+	})
+
+	items := map[string]*ShoppingItem{}
+	aisleOf := map[string]string{}
+	for _, aisle := range list.Aisles {
+		for _, item := range aisle.Items {
+			items[item.Name] = item
+			aisleOf[item.Name] = aisle.Name
+		}
+	}
+
+	// 200g doubled for four people plus one onion from halving the soup
+	if got := items["onion"]; got == nil || got.Quantity != "550 g" {
+		t.Errorf("expected onions to merge into 550 g, got %+v", got)
+	}
+	if got := items["onion"]; got != nil && len(got.Recipes) != 2 {
+		t.Errorf("expected onion to list both recipes, got %v", got.Recipes)
+	}
+	if got := items["rice"]; got == nil || got.Quantity != "300 g" {
+		t.Errorf("expected 300 g rice, got %+v", got)
+	}
+	if got := items["stock"]; got == nil || got.Quantity != "500 ml" {
+		t.Errorf("expected 500 ml stock, got %+v", got)
+	}
+	if aisleOf["onion"] != "Produce" || aisleOf["rice"] != "Dry Goods" || aisleOf["stock"] != "Tins & Jars" {
+		t.Errorf("unexpected aisles %v", aisleOf)
+	}
+	if len(list.Missing) != 1 || list.Missing[0] != "Mystery" {
+		t.Errorf("expected Mystery to be reported as missing, got %v", list.Missing)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamTimeout is longer than generateRecipe's deadline as the text keeps
+// arriving the whole time
+const streamTimeout = 3 * time.Minute
+
+// writeEvent sends one server-sent event, data is json so newlines in the
+// recipe text can't end it early
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// generateStream generates a recipe in the request and streams the text back
+// as server-sent events while it's written:
+//
+//	event: delta  data: "the next bit of text"
+//	event: done   data: {"url": "/recipe?id=..."} once the new version is saved
+//	event: job    data: {"url": "/job?id=..."} when it's already being generated
+//	event: error  data: "what went wrong"
+//
+// It's a POST with a csrf token like /generate, so the page reads it with
+// fetch rather than EventSource. Closing the page cancels the generation.
+func generateStream(db *sql.DB, jobs *JobQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+		if !canDo(r, roleEditor) {
+			forbidden(w, r, roleEditor)
+			return
+		}
+		if !tokenAllows(r, "generate") {
+			forbiddenScope(w, "generate")
+			return
+		}
+		if _, ok := w.(http.Flusher); !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: streaming isn't supported")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error parsing form: %v", err)
+			return
+		}
+
+		recipeID, err := strconv.Atoi(r.PostFormValue("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: recipe ID must be an integer")
+			return
+		}
+		servingSize, err := strconv.Atoi(r.PostFormValue("serving_size"))
+		if err != nil || servingSize <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid serving size provided")
+			return
+		}
+
+		user := requestUser(r)
+		recipe, err := getRecipeByID(db, user.HouseholdID, recipeID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: unable to check DB for recipe")
+			fmt.Println(err)
+			return
+		}
+		if recipe == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: recipe not found")
+			return
+		}
+		if recipe.Shared {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "forbidden: this recipe was shared with your household read only")
+			return
+		}
+		if !jobs.Available() {
+			w.Header().Set("Retry-After", retryAfterSeconds(client.RetryAt(), time.Now()))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "error: %v, try again in %s", errGenerationUnavailable, formatWait(time.Until(client.RetryAt())))
+			return
+		}
+
+		fresh := r.PostFormValue("fresh") == "true"
+		prompt, err := renderPrompt(db, usageTaskRecipe, PromptData{Name: recipe.Name, ServingSize: servingSize, Dietary: strings.TrimSpace(r.PostFormValue("dietary"))})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		// cached recipes are free so only generating checks the budget,
+		// before the stream starts so it can still answer with a status
+		newRecipeVersion := recipe
+		cached, err := fromGenerationCache(db, recipe, prompt, fresh, time.Now())
+		if err != nil {
+			fmt.Println(err)
+		}
+		if !cached {
+			if err := checkBudget(db, user, time.Now()); err != nil {
+				if !budgetExceeded(w, err) {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintf(w, "error: %v", err)
+				}
+				return
+			}
+		}
+
+		job, created, err := startJob(db, user, recipe, servingSize, prompt.Data.Dietary, fresh, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		jobURL := map[string]string{"url": fmt.Sprintf("/job?id=%d", job.ID)}
+		if !created {
+			writeEvent(w, "job", jobURL)
+			return
+		}
+
+		// the request's context is cancelled when the client goes away
+		ctx, cancel := context.WithTimeout(r.Context(), streamTimeout)
+		defer cancel()
+
+		// a cached recipe arrives all at once
+		var usage *LLMUsage
+		if cached {
+			writeEvent(w, "delta", recipe.RecipeText)
+		} else {
+			newRecipeVersion, usage, err = jobs.stream(ctx, recipe, servingSize, prompt, func(delta string) error {
+				return writeEvent(w, "delta", delta)
+			})
+			if err != nil {
+				if usage != nil {
+					if err := recordUsage(db, user, recipe.ID, usage, time.Now()); err != nil {
+						fmt.Println(err)
+					}
+				}
+				if errors.Is(r.Context().Err(), context.Canceled) {
+					err = errors.New("cancelled, the page was closed while it was being generated")
+				}
+				if err := finishJob(db, job, 0, err, time.Now()); err != nil {
+					fmt.Println(err)
+				}
+				writeEvent(w, "error", job.Error)
+				return
+			}
+			if err := cacheGeneration(db, newRecipeVersion, prompt, usage, time.Now()); err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		newRecipe, err := insertRecipeVersion(db, newRecipeVersion)
+		if err != nil {
+			if err := finishJob(db, job, 0, err, time.Now()); err != nil {
+				fmt.Println(err)
+			}
+			writeEvent(w, "error", fmt.Sprintf("unable to save the recipe: %v", err))
+			return
+		}
+		if err := finishJob(db, job, newRecipe.ID, nil, time.Now()); err != nil {
+			fmt.Println(err)
+		}
+		if err := recordUsage(db, user, newRecipe.ID, usage, time.Now()); err != nil {
+			fmt.Println(err)
+		}
+
+		writeEvent(w, "done", map[string]string{"url": fmt.Sprintf("/recipe?id=%d&serving_size=%d", newRecipe.ID, servingSize)})
+	}
+}
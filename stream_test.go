@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_generateStream(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "alice", "password1", roleEditor); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	alice, _ := getUser(db, "alice")
+	soup, err := insertRecipeVersion(db, &Recipe{Name: "Soup", HouseholdID: defaultHouseholdID})
+	if err != nil {
+		t.Fatalf("unable to insert recipe: %v", err)
+	}
+
+	jobs := newJobQueue(db)
+	handler := generateStream(db, jobs)
+	post := func(ctx context.Context, fresh bool) *httptest.ResponseRecorder {
+		form := url.Values{"id": {strconv.Itoa(soup.ID)}, "serving_size": {"2"}, "fresh": {strconv.FormatBool(fresh)}}
+		req := httptest.NewRequest(http.MethodPost, "/generate/stream", strings.NewReader(form.Encode())).WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		handler(res, withUser(req, alice))
+		return res
+	}
+
+	jobs.stream = func(ctx context.Context, recipe *Recipe, servingSize int, prompt *RenderedPrompt, onDelta func(string) error) (*Recipe, *LLMUsage, error) {
+		text := ""
+		for _, delta := range []string{"Ingredients:\n", "- 1 onion\n", "Instructions:\n1. Chop"} {
+			text += delta
+			if err := onDelta(delta); err != nil {
+				return nil, nil, err
+			}
+		}
+		recipe.RecipeText = text
+		parseRecipeText(recipe, servingSize)
+		return recipe, &LLMUsage{Task: usageTaskRecipe, Model: "gpt-3.5-turbo", CompletionTokens: 3}, nil
+	}
+
+	res := post(context.Background(), false)
+	body := res.Body.String()
+	if ct := res.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(body, "event: delta\ndata: \"- 1 onion\\n\"\n\n") {
+		t.Errorf("expected the deltas to be streamed, got %q", body)
+	}
+	done, _ := getJob(db, defaultHouseholdID, 1)
+	if done == nil || done.Status != jobDone {
+		t.Fatalf("expected the job to be done, got %+v", done)
+	}
+	if !strings.Contains(body, "event: done\ndata: {\"url\":\"/recipe?id="+strconv.Itoa(done.ResultID)+"\\u0026serving_size=2\"}") {
+		t.Errorf("expected a done event pointing at the new version, got %q", body)
+	}
+	newRecipe, _ := getRecipeByID(db, defaultHouseholdID, done.ResultID)
+	if newRecipe == nil || newRecipe.Content == nil || newRecipe.Content.MethodLines[0] != "Chop" {
+		t.Errorf("expected the streamed text to be parsed and saved, got %+v", newRecipe)
+	}
+
+	// asking again is answered from the cache in one go, even over budget
+	// as it costs nothing
+	if err := setBudget(db, budgetUser, alice.ID, 0); err != nil {
+		t.Fatalf("unable to set budget: %v", err)
+	}
+	jobs.stream = func(ctx context.Context, recipe *Recipe, servingSize int, prompt *RenderedPrompt, onDelta func(string) error) (*Recipe, *LLMUsage, error) {
+		t.Errorf("expected the cached recipe to be used")
+		return nil, nil, errors.New("not cached")
+	}
+	body = post(context.Background(), false).Body.String()
+	if !strings.Contains(body, "event: delta\ndata: \"Ingredients:\\n- 1 onion\\nInstructions:\\n1. Chop\"\n\n") {
+		t.Errorf("expected the cached text in one delta, got %q", body)
+	}
+	cached, _ := getJob(db, defaultHouseholdID, 2)
+	if cached == nil || cached.Status != jobDone || cached.ResultID == done.ResultID {
+		t.Errorf("expected a new version from the cache, got %+v", cached)
+	}
+	if code := post(context.Background(), true).Code; code != http.StatusPaymentRequired {
+		t.Errorf("expected generating over budget to be refused, got %d", code)
+	}
+	if err := setBudget(db, budgetUser, alice.ID, -1); err != nil {
+		t.Fatalf("unable to remove budget: %v", err)
+	}
+
+	// the client going away cancels the generation
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs.stream = func(ctx context.Context, recipe *Recipe, servingSize int, prompt *RenderedPrompt, onDelta func(string) error) (*Recipe, *LLMUsage, error) {
+		onDelta("Ingredients:\n")
+		cancel()
+		<-ctx.Done()
+		return nil, &LLMUsage{Task: usageTaskRecipe, Model: "gpt-3.5-turbo", CompletionTokens: 1}, ctx.Err()
+	}
+	post(ctx, true)
+	job, _ := getJob(db, defaultHouseholdID, 3)
+	if job == nil || job.Status != jobFailed || !strings.Contains(job.Error, "cancelled") {
+		t.Errorf("expected the job to be cancelled, got %+v", job)
+	}
+	if r, _ := getRecipeByID(db, defaultHouseholdID, cached.ResultID+1); r != nil {
+		t.Errorf("expected nothing to be saved for a cancelled stream")
+	}
+
+	// one already in flight is handed back rather than started again
+	running, err := enqueueJob(db, alice, soup, 2, "", false, time.Now())
+	if err != nil {
+		t.Fatalf("unable to queue job: %v", err)
+	}
+	body = post(context.Background(), false).Body.String()
+	if !strings.Contains(body, "event: job\ndata: {\"url\":\"/job?id="+strconv.Itoa(running.ID)+"\"}") {
+		t.Errorf("expected the queued job to be handed back, got %q", body)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// tagCloudSizes is how many sizes tags come in on /tags
+const tagCloudSizes = 5
+
+// TagCount is how many recipes have a tag. Size is from 1 to tagCloudSizes,
+// scaled by the log of the count so a few very common tags don't make the
+// rest unreadable.
+type TagCount struct {
+	Name     string
+	Count    int
+	Category string
+	Size     int
+}
+
+// countTags counts the tags on recipes, sorted by name
+func countTags(recipes []*Recipe) []*TagCount {
+	byName := map[string]*TagCount{}
+	for _, recipe := range recipes {
+		for _, tag := range mergeTags(nil, recipe.Tags) {
+			count, ok := byName[tag]
+			if !ok {
+				count = &TagCount{Name: tag, Category: tagTaxonomy.Category(tag)}
+				byName[tag] = count
+			}
+			count.Count++
+		}
+	}
+
+	counts := []*TagCount{}
+	most := 0
+	for _, count := range byName {
+		counts = append(counts, count)
+		if count.Count > most {
+			most = count.Count
+		}
+	}
+	for _, count := range counts {
+		count.Size = 1
+		if most > 1 {
+			count.Size += int(math.Round(float64(tagCloudSizes-1) * math.Log(float64(count.Count)) / math.Log(float64(most))))
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := strings.ToLower(counts[i].Name), strings.ToLower(counts[j].Name)
+		if a == b {
+			return counts[i].Name < counts[j].Name
+		}
+		return a < b
+	})
+	return counts
+}
+
+// replaceTags swaps any of from in tags for to, which goes where the first
+// of them was. changed is false if none of from were there.
+func replaceTags(tags []string, from map[string]bool, to []string) (replaced []string, changed bool) {
+	replaced = []string{}
+	for _, tag := range tags {
+		if !from[tag] {
+			replaced = append(replaced, tag)
+			continue
+		}
+		if !changed {
+			replaced = append(replaced, to...)
+		}
+		changed = true
+	}
+	return mergeTags(nil, replaced), changed
+}
+
+// changeTags replaces from with to on the latest version of every recipe,
+// saving a new version of each one it changes. Renaming is one tag to
+// another, merging several to one, splitting one to several and deleting
+// one to none. It's all or nothing, if any recipe can't be saved or got a
+// newer version in the meantime none of them are changed.
+func changeTags(db *sql.DB, from []string, to []string) (int, error) {
+	fromSet := map[string]bool{}
+	for _, tag := range from {
+		fromSet[tag] = true
+	}
+
+	recipes, err := latestRecipes(db)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error beginning db transaction for tag change: %w", err)
+	}
+	defer tx.Rollback()
+
+	changed := 0
+	for _, recipe := range recipes {
+		tags, ok := replaceTags(recipe.Tags, fromSet, to)
+		if !ok {
+			continue
+		}
+		var newer int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM recipes WHERE parent_id = ?", recipe.ID).Scan(&newer); err != nil {
+			return 0, fmt.Errorf("unable to check %s is the latest version: %w", recipe.Name, err)
+		}
+		if newer > 0 {
+			return 0, fmt.Errorf("%s was changed while the tags were, try again", recipe.Name)
+		}
+		recipe.Tags = tags
+		if _, err := insertRecipeVersionTx(tx, recipe); err != nil {
+			return 0, fmt.Errorf("unable to save %s: %w", recipe.Name, err)
+		}
+		changed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit tag change: %w", err)
+	}
+	return changed, nil
+}
+
+// splitTagList reads a comma separated list of tags
+func splitTagList(value string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+type tagAdminPage struct {
+	Tags  []*TagCount
+	Error string
+}
+
+// adminTags lists every tag in every household and renames, merges, splits
+// and deletes them
+func adminTags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := tagAdminPage{}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error parsing form: %v", err)
+				return
+			}
+
+			var from, to []string
+			switch action := r.PostFormValue("action"); action {
+			case "rename":
+				from, to = []string{r.PostFormValue("tag")}, splitTagList(r.PostFormValue("to"))
+				if len(to) == 0 {
+					page.Error = "give a new name, or several separated by commas to split it"
+				}
+			case "merge":
+				from, to = r.PostForm["tag"], splitTagList(r.PostFormValue("into"))
+				if len(from) == 0 || len(to) != 1 {
+					page.Error = "tick the tags to merge and give one tag to merge them into"
+				}
+			case "delete":
+				from = []string{r.PostFormValue("tag")}
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: unknown action %q", action)
+				return
+			}
+			if page.Error == "" && (len(from) == 0 || from[0] == "") {
+				page.Error = "no tag given"
+			}
+
+			if page.Error != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				break
+			}
+			changed, err := changeTags(db, from, to)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+			audit(db, r, auditTagsChanged, "",
+				fmt.Sprintf("%s %q to %q, %d recipes", r.PostFormValue("action"), from, to, changed))
+			http.Redirect(w, r, "/admin/tags", http.StatusSeeOther)
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		recipes, err := latestRecipes(db)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		page.Tags = countTags(recipes)
+		sort.SliceStable(page.Tags, func(i, j int) bool { return page.Tags[i].Count > page.Tags[j].Count })
+
+		if err := renderTemplate(w, r, "tagadmin.html", page); err != nil {
+			fmt.Fprintf(w, "error rendering tags: %v", err)
+			return
+		}
+	}
+}
+
+type tagsPage struct {
+	Tags   []*TagCount
+	Public bool
+}
+
+type tagPage struct {
+	Name    string
+	Recipes []*Recipe
+	Public  bool
+	// Links are share links by recipe ID for people who aren't logged in
+	Links map[int]string
+}
+
+// publicRecipes are what people who aren't logged in can browse, the
+// generated recipes of the household named by PUBLIC_HOUSEHOLD. Recipes
+// shared with it aren't its to publish. Nothing is public when it isn't
+// set.
+func publicRecipes(db *sql.DB, getenv func(string) string) ([]*Recipe, error) {
+	name := getenv("PUBLIC_HOUSEHOLD")
+	if name == "" {
+		return []*Recipe{}, nil
+	}
+	h, err := getHouseholdByName(db, name)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, fmt.Errorf("PUBLIC_HOUSEHOLD %q doesn't exist", name)
+	}
+
+	recipes, err := getAllRecipes(db, h.ID)
+	if err != nil {
+		return nil, err
+	}
+	public := []*Recipe{}
+	for _, recipe := range recipes {
+		if !recipe.Shared && recipe.Content != nil {
+			public = append(public, recipe)
+		}
+	}
+	return public, nil
+}
+
+// browseTags shows every tag the household's recipes have at /tags and the
+// recipes with one at /tags/{name}. People who aren't logged in see the
+// public recipes instead, linked to by share links.
+func browseTags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		user := requestUser(r)
+		var recipes []*Recipe
+		var err error
+		if user == nil {
+			recipes, err = publicRecipes(db, os.Getenv)
+		} else {
+			recipes, err = getAllRecipes(db, user.HouseholdID)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error getting recipes: %v", err)
+			return
+		}
+
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tags"), "/")
+		if name == "" {
+			if err := renderTemplate(w, r, "tags.html", tagsPage{Tags: countTags(recipes), Public: user == nil}); err != nil {
+				fmt.Fprintf(w, "error rendering tags: %v", err)
+			}
+			return
+		}
+
+		page := tagPage{Name: name, Recipes: []*Recipe{}, Public: user == nil}
+		for _, recipe := range recipes {
+			for _, tag := range recipe.Tags {
+				if tagKey(tag) == tagKey(name) {
+					page.Name = tag
+					page.Recipes = append(page.Recipes, recipe)
+					break
+				}
+			}
+		}
+		if len(page.Recipes) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "error: no recipes are tagged %q", name)
+			return
+		}
+		sort.Slice(page.Recipes, func(i, j int) bool { return page.Recipes[i].Name < page.Recipes[j].Name })
+
+		if page.Public {
+			secret, err := getShareLinkSecret(db, os.Getenv)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+			page.Links = map[int]string{}
+			for _, recipe := range page.Recipes {
+				link := &ShareLink{RecipeID: recipe.ID, HouseholdID: recipe.HouseholdID, Servings: recipe.Content.Servings}
+				page.Links[recipe.ID] = link.URL(secret)
+			}
+		}
+
+		if err := renderTemplate(w, r, "tag.html", page); err != nil {
+			fmt.Fprintf(w, "error rendering tag: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_countTags(t *testing.T) {
+	recipes := []*Recipe{}
+	for i := 0; i < 9; i++ {
+		recipes = append(recipes, &Recipe{Tags: []string{"Dinner"}})
+	}
+	recipes = append(recipes,
+		&Recipe{Tags: []string{"Soup", "soup", "Lunch"}},
+		&Recipe{Tags: []string{"Lunch", "Comfort Food"}},
+		&Recipe{Tags: []string{"Lunch"}},
+	)
+
+	got := map[string]TagCount{}
+	names := []string{}
+	for _, count := range countTags(recipes) {
+		got[count.Name] = *count
+		names = append(names, count.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"Comfort Food", "Dinner", "Lunch", "Soup"}) {
+		t.Errorf("expected tags sorted by name and counted once a recipe, got %v", names)
+	}
+	want := map[string]TagCount{
+		"Dinner":       {"Dinner", 9, tagCourse, 5},
+		"Lunch":        {"Lunch", 3, tagCourse, 3},
+		"Soup":         {"Soup", 1, tagCourse, 1},
+		"Comfort Food": {"Comfort Food", 1, "", 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("countTags() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_replaceTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		tags        []string
+		from        []string
+		to          []string
+		want        []string
+		wantChanged bool
+	}{
+		{"rename", []string{"Soup", "Veg"}, []string{"Veg"}, []string{"Vegetables"}, []string{"Soup", "Vegetables"}, true},
+		{"merge", []string{"Pasta", "Spaghetti", "Dinner"}, []string{"Spaghetti", "Pasta"}, []string{"Pasta"}, []string{"Pasta", "Dinner"}, true},
+		{"merge into one already there", []string{"Fish", "Salmon"}, []string{"Salmon"}, []string{"Fish"}, []string{"Fish"}, true},
+		{"split", []string{"Vegan Curry"}, []string{"Vegan Curry"}, []string{"Vegan", "Indian"}, []string{"Vegan", "Indian"}, true},
+		{"delete", []string{"Easy", "Soup"}, []string{"Easy"}, nil, []string{"Soup"}, true},
+		{"missing", []string{"Soup"}, []string{"Easy"}, nil, []string{"Soup"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := map[string]bool{}
+			for _, tag := range tt.from {
+				from[tag] = true
+			}
+			got, changed := replaceTags(tt.tags, from, tt.to)
+			if !reflect.DeepEqual(got, tt.want) || changed != tt.wantChanged {
+				t.Errorf("replaceTags() = %v, %v, want %v, %v", got, changed, tt.want, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func Test_changeTags(t *testing.T) {
+	db := newTestDB(t)
+	other, err := insertHousehold(db, "Other")
+	if err != nil {
+		t.Fatalf("unable to add household: %v", err)
+	}
+	soup, _ := insertRecipeVersion(db, &Recipe{Name: "Soup", HouseholdID: defaultHouseholdID, Tags: []string{"Easy", "Soup"}})
+	stew, _ := insertRecipeVersion(db, &Recipe{Name: "Stew", HouseholdID: other.ID, Tags: []string{"easy"}})
+	insertRecipeVersion(db, &Recipe{Name: "Cake", HouseholdID: defaultHouseholdID, Tags: []string{"Dessert"}})
+
+	changed, err := changeTags(db, []string{"Easy", "easy"}, []string{"Quick"})
+	if err != nil {
+		t.Fatalf("unable to change tags: %v", err)
+	}
+	if changed != 2 {
+		t.Errorf("expected 2 recipes to change, got %d", changed)
+	}
+
+	recipes, _ := latestRecipes(db)
+	got := map[string][]string{}
+	for _, recipe := range recipes {
+		got[recipe.Name] = recipe.Tags
+		if recipe.ID == soup.ID || recipe.ID == stew.ID {
+			t.Errorf("expected %s to have a new version", recipe.Name)
+		}
+	}
+	want := map[string][]string{"Soup": {"Quick", "Soup"}, "Stew": {"Quick"}, "Cake": {"Dessert"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected tags %v, got %v", want, got)
+	}
+	if old, _ := getRecipeByID(db, defaultHouseholdID, soup.ID); old == nil || !reflect.DeepEqual(old.Tags, []string{"Easy", "Soup"}) {
+		t.Errorf("expected the old version to be left as it was, got %+v", old)
+	}
+}
+
+func Test_changeTags_allOrNothing(t *testing.T) {
+	db := newTestDB(t)
+	soup, _ := insertRecipeVersion(db, &Recipe{Name: "Soup", HouseholdID: defaultHouseholdID, Tags: []string{"Easy"}})
+	insertRecipeVersion(db, &Recipe{Name: "Stew", HouseholdID: defaultHouseholdID, Tags: []string{"Easy"}})
+
+	if _, err := db.Exec(`CREATE TRIGGER no_stew BEFORE INSERT ON recipes WHEN NEW.name = 'Stew' BEGIN SELECT RAISE(ABORT, 'no stew'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := changeTags(db, []string{"Easy"}, []string{"Quick"}); err == nil {
+		t.Fatalf("expected saving the stew to fail")
+	}
+
+	recipes, _ := latestRecipes(db)
+	for _, recipe := range recipes {
+		if !reflect.DeepEqual(recipe.Tags, []string{"Easy"}) {
+			t.Errorf("expected %s to be left alone, got %v", recipe.Name, recipe.Tags)
+		}
+	}
+	var versions int
+	if err := db.QueryRow("SELECT COUNT(*) FROM recipes WHERE parent_id = ?", soup.ID).Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions != 0 {
+		t.Errorf("expected the soup's new version to be rolled back")
+	}
+}
+
+func Test_publicRecipes(t *testing.T) {
+	db := newTestDB(t)
+	public, err := insertHousehold(db, "Public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := &RecipeContent{Servings: 2}
+	insertRecipeVersion(db, &Recipe{Name: "Soup", HouseholdID: public.ID, Tags: []string{"Soup"}, Content: content})
+	insertRecipeVersion(db, &Recipe{Name: "Not generated", HouseholdID: public.ID, Tags: []string{"Soup"}})
+	private, _ := insertRecipeVersion(db, &Recipe{Name: "Family stew", HouseholdID: defaultHouseholdID, Tags: []string{"Soup"}, Content: content})
+	if err := shareRecipe(db, defaultHouseholdID, private.ID, public.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(getenv func(string) string) ([]string, error) {
+		recipes, err := publicRecipes(db, getenv)
+		got := []string{}
+		for _, r := range recipes {
+			got = append(got, r.Name)
+		}
+		return got, err
+	}
+
+	if got, err := names(func(string) string { return "" }); err != nil || len(got) != 0 {
+		t.Errorf("expected nothing to be public without PUBLIC_HOUSEHOLD, got %v, %v", got, err)
+	}
+	if got, err := names(func(string) string { return "Public" }); err != nil || !reflect.DeepEqual(got, []string{"Soup"}) {
+		t.Errorf("expected only the public household's own generated recipes, got %v, %v", got, err)
+	}
+	if _, err := names(func(string) string { return "Nobody" }); err == nil {
+		t.Errorf("expected an error for a household that doesn't exist")
+	}
+}
+
+func Test_optionalAuth(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "alice", "secret", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := getUser(db, "alice")
+	token, _, err := createSession(db, alice, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := createSession(db, alice, time.Now().Add(-sessionLifetime-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := optionalAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, requestUsername(r))
+	})
+
+	tests := []struct {
+		name     string
+		session  string
+		basic    string
+		wantCode int
+		wantUser string
+	}{
+		{"logged out", "", "", http.StatusOK, ""},
+		{"session", token, "", http.StatusOK, "alice"},
+		{"ended session", expired, "", http.StatusOK, ""},
+		{"basic auth", "", "secret", http.StatusOK, "alice"},
+		{"wrong password", "", "wrong", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/tags", nil)
+			if tt.session != "" {
+				r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tt.session})
+			}
+			if tt.basic != "" {
+				r.SetBasicAuth("alice", tt.basic)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d", tt.wantCode, w.Code)
+			}
+			if tt.wantCode == http.StatusOK && w.Body.String() != tt.wantUser {
+				t.Errorf("expected user %q, got %q", tt.wantUser, w.Body.String())
+			}
+		})
+	}
+}
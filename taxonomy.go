@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Tag categories, in the order tags are listed
+const (
+	tagCuisine    = "cuisine"
+	tagCourse     = "course"
+	tagDiet       = "diet"
+	tagIngredient = "main ingredient"
+	tagMethod     = "method"
+)
+
+var tagCategories = []string{tagCuisine, tagCourse, tagDiet, tagIngredient, tagMethod}
+
+// TaxonomyTag is a tag recipes can have. Aliases are the other ways it gets
+// written, they're merged into Name.
+type TaxonomyTag struct {
+	Name     string
+	Category string
+	Aliases  []string
+}
+
+// tagTaxonomy is every tag recipes can have. Tags are matched ignoring case,
+// spaces and punctuation and plurals fall back to the singular, so aliases
+// only need to cover different words.
+var tagTaxonomy = newTaxonomy([]TaxonomyTag{
+	{"American", tagCuisine, []string{"USA", "Southern", "Cajun"}},
+	{"Asian", tagCuisine, []string{"Pan-Asian", "Fusion"}},
+	{"British", tagCuisine, []string{"English", "Scottish", "Welsh", "Irish"}},
+	{"Caribbean", tagCuisine, []string{"Jamaican"}},
+	{"Chinese", tagCuisine, []string{"Cantonese", "Sichuan", "Szechuan"}},
+	{"French", tagCuisine, nil},
+	{"Greek", tagCuisine, nil},
+	{"Indian", tagCuisine, []string{"Punjabi", "South Indian"}},
+	{"Italian", tagCuisine, []string{"Tuscan", "Sicilian"}},
+	{"Japanese", tagCuisine, nil},
+	{"Korean", tagCuisine, nil},
+	{"Mediterranean", tagCuisine, nil},
+	{"Mexican", tagCuisine, []string{"Tex-Mex"}},
+	{"Middle Eastern", tagCuisine, []string{"Lebanese", "Turkish", "Persian", "Israeli"}},
+	{"North African", tagCuisine, []string{"Moroccan", "Tunisian", "African"}},
+	{"Spanish", tagCuisine, nil},
+	{"Thai", tagCuisine, nil},
+	{"Vietnamese", tagCuisine, nil},
+
+	{"Breakfast", tagCourse, nil},
+	{"Brunch", tagCourse, nil},
+	{"Lunch", tagCourse, nil},
+	{"Dinner", tagCourse, []string{"Supper"}},
+	{"Main", tagCourse, []string{"Main Dish", "Main Course", "Entree", "Entrée"}},
+	{"Side", tagCourse, []string{"Side Dish"}},
+	{"Starter", tagCourse, []string{"Appetizer", "Appetiser", "Small Plate"}},
+	{"Soup", tagCourse, nil},
+	{"Salad", tagCourse, nil},
+	{"Sandwich", tagCourse, []string{"Wrap", "Burger"}},
+	{"Snack", tagCourse, []string{"Finger Food"}},
+	{"Dessert", tagCourse, []string{"Pudding", "Sweet Treat"}},
+	{"Drink", tagCourse, []string{"Beverage", "Smoothie", "Cocktail"}},
+
+	{"Vegetarian", tagDiet, nil},
+	{"Vegan", tagDiet, []string{"Plant-Based"}},
+	{"Pescatarian", tagDiet, nil},
+	{"Gluten-Free", tagDiet, []string{"GF"}},
+	{"Dairy-Free", tagDiet, []string{"Lactose-Free"}},
+	{"Low-Carb", tagDiet, []string{"Keto"}},
+	{"High-Protein", tagDiet, []string{"Protein", "Protein-Rich"}},
+
+	{"Chicken", tagIngredient, []string{"Chicken Breast", "Chicken Thigh"}},
+	{"Beef", tagIngredient, []string{"Ground Beef", "Minced Beef", "Beef Mince", "Steak"}},
+	{"Pork", tagIngredient, []string{"Bacon", "Ham", "Pork Belly", "Chorizo"}},
+	{"Sausage", tagIngredient, nil},
+	{"Lamb", tagIngredient, nil},
+	{"Turkey", tagIngredient, nil},
+	{"Duck", tagIngredient, nil},
+	{"Fish", tagIngredient, []string{"Salmon", "Tuna", "Cod", "White Fish", "Mackerel", "Haddock"}},
+	{"Seafood", tagIngredient, []string{"Prawn", "Shrimp", "Mussel", "Crab", "Squid"}},
+	{"Egg", tagIngredient, nil},
+	{"Cheese", tagIngredient, []string{"Parmesan", "Parmesan Cheese", "Mozzarella", "Cheddar", "Feta", "Goat Cheese", "Halloumi", "Ricotta"}},
+	{"Tofu", tagIngredient, []string{"Tempeh"}},
+	{"Paneer", tagIngredient, nil},
+	{"Pasta", tagIngredient, []string{"Spaghetti", "Orzo", "Penne", "Lasagne", "Lasagna", "Macaroni", "Gnocchi"}},
+	{"Noodles", tagIngredient, []string{"Ramen", "Udon", "Rice Noodles"}},
+	{"Rice", tagIngredient, []string{"Risotto", "Fried Rice"}},
+	{"Potato", tagIngredient, []string{"Mashed Potato"}},
+	{"Sweet Potato", tagIngredient, nil},
+	{"Beans", tagIngredient, []string{"Bean", "Black Beans", "Kidney Beans"}},
+	{"Lentils", tagIngredient, []string{"Lentil", "Dal", "Dhal"}},
+	{"Chickpeas", tagIngredient, []string{"Chickpea", "Hummus"}},
+	{"Mushroom", tagIngredient, nil},
+	{"Tomato", tagIngredient, []string{"Tomato Sauce", "Cherry Tomato"}},
+	{"Vegetables", tagIngredient, []string{"Vegetable", "Veg", "Veggies", "Mixed Vegetables"}},
+	{"Spinach", tagIngredient, nil},
+	{"Cauliflower", tagIngredient, nil},
+	{"Broccoli", tagIngredient, nil},
+	{"Aubergine", tagIngredient, []string{"Eggplant"}},
+	{"Courgette", tagIngredient, []string{"Zucchini"}},
+	{"Squash", tagIngredient, []string{"Butternut Squash", "Pumpkin"}},
+	{"Bread", tagIngredient, []string{"Flatbread", "Tortilla", "Naan", "Pitta"}},
+	{"Pastry", tagIngredient, []string{"Puff Pastry", "Pie"}},
+	{"Chocolate", tagIngredient, []string{"Cocoa"}},
+	{"Fruit", tagIngredient, []string{"Berries", "Apple", "Banana", "Lemon", "Lime"}},
+
+	{"Baked", tagMethod, []string{"Baking", "Oven-Baked", "Bake", "Traybake"}},
+	{"Roasted", tagMethod, []string{"Roast", "Roasting"}},
+	{"Grilled", tagMethod, []string{"Barbecue", "BBQ", "Grill", "Chargrilled"}},
+	{"Fried", tagMethod, []string{"Pan-Fried", "Deep-Fried", "Shallow-Fried"}},
+	{"Stir-Fried", tagMethod, []string{"Stir-Fry", "Wok"}},
+	{"Stewed", tagMethod, []string{"Stew", "Casserole", "Simmered"}},
+	{"Braised", tagMethod, nil},
+	{"Slow-Cooked", tagMethod, []string{"Slow Cooker", "Crockpot"}},
+	{"Pressure-Cooked", tagMethod, []string{"Instant Pot", "Pressure Cooker"}},
+	{"Steamed", tagMethod, nil},
+	{"One-Pot", tagMethod, []string{"One-Pot Meal", "One-Pan", "Sheet Pan"}},
+	{"Marinated", tagMethod, nil},
+	{"No-Cook", tagMethod, []string{"Raw", "No-Bake"}},
+})
+
+// Taxonomy looks tags up by any of the ways they're written
+type Taxonomy struct {
+	Tags  []TaxonomyTag
+	byKey map[string]int
+}
+
+func newTaxonomy(tags []TaxonomyTag) *Taxonomy {
+	t := &Taxonomy{Tags: tags, byKey: map[string]int{}}
+	for i, tag := range tags {
+		for _, name := range append([]string{tag.Name}, tag.Aliases...) {
+			key := tagKey(name)
+			if other, ok := t.byKey[key]; ok && other != i {
+				panic(fmt.Sprintf("tag %q is in the taxonomy twice, as %s and %s", name, tags[other].Name, tag.Name))
+			}
+			t.byKey[key] = i
+		}
+	}
+	return t
+}
+
+// tagKey is what tags are compared by, "Gluten free" and "gluten-free" are
+// the same tag
+func tagKey(tag string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(tag) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// lookup returns the index of the tag in the taxonomy, trying the singular
+// when a plural isn't there
+func (t *Taxonomy) lookup(tag string) (int, bool) {
+	key := tagKey(tag)
+	candidates := []string{key}
+	if strings.HasSuffix(key, "es") {
+		candidates = append(candidates, strings.TrimSuffix(key, "es"))
+	}
+	if strings.HasSuffix(key, "s") {
+		candidates = append(candidates, strings.TrimSuffix(key, "s"))
+	}
+	for _, c := range candidates {
+		if i, ok := t.byKey[c]; ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Canonical returns how a tag is written in the taxonomy, ok is false for
+// tags that aren't in it
+func (t *Taxonomy) Canonical(tag string) (string, bool) {
+	i, ok := t.lookup(tag)
+	if !ok {
+		return "", false
+	}
+	return t.Tags[i].Name, true
+}
+
+// Category returns which category a tag is in, or "" if it isn't in the
+// taxonomy
+func (t *Taxonomy) Category(tag string) string {
+	if i, ok := t.lookup(tag); ok {
+		return t.Tags[i].Category
+	}
+	return ""
+}
+
+// Normalize merges tags into the taxonomy's names, drops duplicates and
+// sorts them by category. Tags that aren't in the taxonomy are returned as
+// dropped.
+func (t *Taxonomy) Normalize(tags []string) (normalized []string, dropped []string) {
+	seen := map[int]bool{}
+	indexes := []int{}
+	for _, tag := range tags {
+		i, ok := t.lookup(tag)
+		if !ok {
+			if strings.TrimSpace(tag) != "" {
+				dropped = append(dropped, tag)
+			}
+			continue
+		}
+		if !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	normalized = []string{}
+	for _, i := range indexes {
+		normalized = append(normalized, t.Tags[i].Name)
+	}
+	return normalized, dropped
+}
+
+// Vocabulary lists the tags a category per line, for prompts
+func (t *Taxonomy) Vocabulary() string {
+	var b strings.Builder
+	for _, category := range tagCategories {
+		names := []string{}
+		for _, tag := range t.Tags {
+			if tag.Category == category {
+				names = append(names, tag.Name)
+			}
+		}
+		fmt.Fprintf(&b, "%s: %s\n", category, strings.Join(names, ", "))
+	}
+	return b.String()
+}
+
+// mergeTags adds tags to existing ones, skipping any already there however
+// they're written
+func mergeTags(existing, tags []string) []string {
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, tag := range append(append([]string{}, existing...), tags...) {
+		key := tagKey(tag)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, tag)
+	}
+	return merged
+}
+
+// tagPromptData is what the tags prompt is rendered with
+func tagPromptData(name string) PromptData {
+	return PromptData{Name: name, Vocabulary: tagTaxonomy.Vocabulary()}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTaxonomy_Canonical(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+		ok   bool
+	}{
+		{"Italian", "Italian", true},
+		{"italian", "Italian", true},
+		{"Tomatoes", "Tomato", true},
+		{"Tomato Sauce", "Tomato", true},
+		{"Gluten-free", "Gluten-Free", true},
+		{"Gluten Free", "Gluten-Free", true},
+		{"Mashed Potatoes", "Potato", true},
+		{"Dishes", "", false},
+		{"Zucchini", "Courgette", true},
+		{"Onions", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			got, ok := tagTaxonomy.Canonical(tt.tag)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Canonical(%q) = %q, %v, want %q, %v", tt.tag, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTaxonomy_Normalize(t *testing.T) {
+	tests := []struct {
+		name        string
+		tags        []string
+		want        []string
+		wantDropped []string
+	}{
+		{"empty", nil, []string{}, nil},
+		{"sorted by category", []string{"Pasta", "Dinner", "Italian"}, []string{"Italian", "Dinner", "Pasta"}, nil},
+		{"aliases merged", []string{"Spaghetti", "Pasta", "Tex-Mex", "Mexican"}, []string{"Mexican", "Pasta"}, nil},
+		{"unknown dropped", []string{"Onions", "Soup", "Comfort Food", " "}, []string{"Soup"}, []string{"Onions", "Comfort Food"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped := tagTaxonomy.Normalize(tt.tags)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Normalize() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("Normalize() dropped %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestTaxonomy_Vocabulary(t *testing.T) {
+	vocabulary := tagTaxonomy.Vocabulary()
+	for _, category := range tagCategories {
+		if !strings.Contains(vocabulary, category+": ") {
+			t.Errorf("expected a line for %s, got %q", category, vocabulary)
+		}
+	}
+	if !strings.Contains(vocabulary, "Gluten-Free") || strings.Contains(vocabulary, "Tex-Mex") {
+		t.Errorf("expected names without aliases, got %q", vocabulary)
+	}
+}
+
+func Test_mergeTags(t *testing.T) {
+	got := mergeTags([]string{"Soup", "Lunch"}, []string{"soup", "Vegan", "", "Lunch"})
+	want := []string{"Soup", "Lunch", "Vegan"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeTags() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failed logins are counted per client IP and per username. After
+// loginFreeAttempts failures in a row the key is locked out, starting at
+// loginLockoutBase and doubling with every failure after that up to
+// loginLockoutMax. A key is forgotten once it has gone loginFailureWindow
+// without a failure.
+const (
+	loginFreeAttempts  = 5
+	loginLockoutBase   = 30 * time.Second
+	loginLockoutMax    = time.Hour
+	loginFailureWindow = 24 * time.Hour
+)
+
+// behindFlyProxy is set when running on fly.io, whose proxy overwrites
+// Fly-Client-IP on everything it forwards. Anywhere else clients could set
+// the header themselves to dodge the IP lockout.
+var behindFlyProxy bool
+
+// clientIP is who the request came from, Fly-Client-IP behind the fly.io
+// proxy and the peer address anywhere else
+func clientIP(r *http.Request) string {
+	if ip := strings.TrimSpace(r.Header.Get("Fly-Client-IP")); ip != "" && behindFlyProxy {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginThrottleKeys are the keys failures are counted against, a blank
+// username only counts against the IP
+func loginThrottleKeys(ip, username string) []string {
+	keys := []string{"ip:" + ip}
+	if username = strings.ToLower(strings.TrimSpace(username)); username != "" {
+		keys = append(keys, "user:"+username)
+	}
+	return keys
+}
+
+// loginLockout is how long a key is locked for after its nth failure
+func loginLockout(failures int) time.Duration {
+	if failures < loginFreeAttempts {
+		return 0
+	}
+	lockout := loginLockoutBase
+	for i := loginFreeAttempts; i < failures && lockout < loginLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > loginLockoutMax {
+		lockout = loginLockoutMax
+	}
+	return lockout
+}
+
+// loginLockedFor returns how long until the IP or username can try again,
+// zero if neither is locked out
+func loginLockedFor(db *sql.DB, ip, username string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range loginThrottleKeys(ip, username) {
+		var lockedUntil string
+		err := db.QueryRow("SELECT locked_until FROM login_failures WHERE key = ?", key).Scan(&lockedUntil)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("unable to check login failures: %w", err)
+		}
+		until, err := time.Parse(time.RFC3339, lockedUntil)
+		if err != nil {
+			continue
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failure against the IP and username and
+// returns how long they're now locked out for
+func recordLoginFailure(db *sql.DB, ip, username string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range loginThrottleKeys(ip, username) {
+		failures := 0
+		var lastFailure string
+		err := db.QueryRow("SELECT failures, last_failure_at FROM login_failures WHERE key = ?", key).Scan(&failures, &lastFailure)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, fmt.Errorf("unable to check login failures: %w", err)
+		}
+		if last, err := time.Parse(time.RFC3339, lastFailure); err != nil || now.Sub(last) > loginFailureWindow {
+			failures = 0
+		}
+		failures++
+
+		lockout := loginLockout(failures)
+		if lockout > wait {
+			wait = lockout
+		}
+		if _, err := db.Exec(`
+INSERT INTO login_failures(key, failures, last_failure_at, locked_until) values(?,?,?,?)
+ON CONFLICT(key) DO UPDATE SET failures = excluded.failures, last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until`,
+			key, failures, now.UTC().Format(time.RFC3339), now.UTC().Add(lockout).Format(time.RFC3339)); err != nil {
+			return 0, fmt.Errorf("unable to record login failure: %w", err)
+		}
+	}
+	return wait, nil
+}
+
+// clearLoginFailures forgets a username's failures once it logs in. The
+// IP's are kept, logging in to one account shouldn't reset guessing at
+// others from the same place.
+func clearLoginFailures(db *sql.DB, username string) error {
+	if _, err := db.Exec("DELETE FROM login_failures WHERE key = ?", "user:"+strings.ToLower(strings.TrimSpace(username))); err != nil {
+		return fmt.Errorf("unable to clear login failures: %w", err)
+	}
+	return nil
+}
+
+// deleteStaleLoginFailures clears out keys that have been quiet long enough
+// to be forgotten
+func deleteStaleLoginFailures(db *sql.DB, now time.Time) error {
+	if _, err := db.Exec("DELETE FROM login_failures WHERE last_failure_at < ?", now.UTC().Add(-loginFailureWindow).Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("unable to delete stale login failures: %w", err)
+	}
+	return nil
+}
+
+// tooManyAttempts tells scripted clients when to come back
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+	http.Error(w, fmt.Sprintf("Too many failed attempts, try again in %s", formatWait(wait)), http.StatusTooManyRequests)
+}
+
+func formatWait(wait time.Duration) string {
+	if wait < time.Minute {
+		return "under a minute"
+	}
+	minutes := int(wait.Round(time.Minute) / time.Minute)
+	if minutes == 1 {
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
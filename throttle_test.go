@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_loginLockout(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{loginFreeAttempts - 1, 0},
+		{loginFreeAttempts, 30 * time.Second},
+		{loginFreeAttempts + 1, time.Minute},
+		{loginFreeAttempts + 3, 4 * time.Minute},
+		{loginFreeAttempts + 7, loginLockoutMax},
+		{1000, loginLockoutMax},
+	}
+	for _, tt := range tests {
+		if got := loginLockout(tt.failures); got != tt.want {
+			t.Errorf("loginLockout(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func Test_loginThrottling(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	locked := func(ip, username string, at time.Time) bool {
+		wait, err := loginLockedFor(db, ip, username, at)
+		if err != nil {
+			t.Fatalf("unable to check lockout: %v", err)
+		}
+		return wait > 0
+	}
+
+	for i := 0; i < loginFreeAttempts; i++ {
+		if locked("10.0.0.1", "alice", now) {
+			t.Fatalf("locked out after %d failures", i)
+		}
+		if _, err := recordLoginFailure(db, "10.0.0.1", "Alice", now); err != nil {
+			t.Fatalf("unable to record failure: %v", err)
+		}
+	}
+
+	if !locked("10.0.0.1", "bob", now) {
+		t.Errorf("expected the IP to be locked out for every username")
+	}
+	if !locked("10.0.0.2", "alice", now) {
+		t.Errorf("expected alice to be locked out from every IP")
+	}
+	if locked("10.0.0.2", "bob", now) {
+		t.Errorf("expected bob on another IP to be allowed")
+	}
+	if locked("10.0.0.1", "alice", now.Add(loginLockoutBase)) {
+		t.Errorf("expected the lockout to run out")
+	}
+
+	// the next failure doubles the lockout
+	wait, err := recordLoginFailure(db, "10.0.0.1", "alice", now.Add(loginLockoutBase))
+	if err != nil {
+		t.Fatalf("unable to record failure: %v", err)
+	}
+	if wait != 2*loginLockoutBase {
+		t.Errorf("expected the lockout to double, got %v", wait)
+	}
+
+	// logging in clears the user but not the IP
+	if err := clearLoginFailures(db, "alice"); err != nil {
+		t.Fatalf("unable to clear failures: %v", err)
+	}
+	if locked("10.0.0.2", "alice", now.Add(loginLockoutBase)) {
+		t.Errorf("expected alice to be cleared")
+	}
+	if !locked("10.0.0.1", "", now.Add(loginLockoutBase)) {
+		t.Errorf("expected the IP to stay locked out")
+	}
+
+	// failures are forgotten after a quiet day
+	later := now.Add(loginFailureWindow + time.Hour)
+	if wait, _ := recordLoginFailure(db, "10.0.0.1", "", later); wait != 0 {
+		t.Errorf("expected old failures to be forgotten, got a %v lockout", wait)
+	}
+}
+
+func Test_clientIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		onFly  bool
+		header string
+		want   string
+	}{
+		{"peer address", false, "", "192.0.2.1"},
+		{"header ignored off fly", false, "203.0.113.9", "192.0.2.1"},
+		{"header on fly", true, "203.0.113.9", "203.0.113.9"},
+		{"no header on fly", true, "", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old bool) { behindFlyProxy = old }(behindFlyProxy)
+			behindFlyProxy = tt.onFly
+
+			r := httptest.NewRequest(http.MethodPost, "/login", nil)
+			r.RemoteAddr = "192.0.2.1:51234"
+			if tt.header != "" {
+				r.Header.Set("Fly-Client-IP", tt.header)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getAuditEntries(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	for i, e := range []*AuditEntry{
+		{Event: auditLoginFailed, Username: "alice"},
+		{Event: auditLogin, Username: "alice"},
+		{Event: auditRoleChanged, Username: "bob", Detail: "bob is now editor"},
+		{Event: auditLogin, Username: "bob"},
+	} {
+		e.CreatedAt, e.IP = now.Add(time.Duration(i)*time.Second), "10.0.0.1"
+		if err := insertAuditEntry(db, e); err != nil {
+			t.Fatalf("unable to insert entry: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   []string
+	}{
+		{"newest first", AuditFilter{}, []string{"bob", "bob", "alice", "alice"}},
+		{"by event", AuditFilter{Event: auditLogin}, []string{"bob", "alice"}},
+		{"by username", AuditFilter{Username: "alice"}, []string{"alice", "alice"}},
+		{"paged", AuditFilter{Before: 3, Limit: 1}, []string{"alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := getAuditEntries(db, tt.filter)
+			if err != nil {
+				t.Fatalf("getAuditEntries() error = %v", err)
+			}
+			got := []string{}
+			for _, e := range entries {
+				got = append(got, e.Username)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("getAuditEntries() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("getAuditEntries() = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix makes tokens easy to spot if one ends up somewhere it
+// shouldn't, like a log or a commit
+const apiTokenPrefix = "fa_"
+
+// apiTokenScopes limit what a token can do on top of its user's role, the
+// role needed for each is what the scope is offered to
+var apiTokenScopes = []struct {
+	Name string
+	Role Role
+	Help string
+}{
+	{"read", roleViewer, "read recipes, plans and lists"},
+	{"write", roleEditor, "change recipes, plans and the pantry"},
+	{"generate", roleEditor, "generate recipes with the LLM"},
+	{"admin", roleAdmin, "manage users"},
+}
+
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	return containsString(t.Scopes, scope)
+}
+
+// parseScopes reads a comma separated scope list, checking each one is
+// allowed for the role and returning them in a consistent order
+func parseScopes(s string, role Role) ([]string, error) {
+	requested := map[string]bool{}
+	for _, scope := range strings.Split(s, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			requested[scope] = true
+		}
+	}
+	if len(requested) == 0 {
+		return nil, fmt.Errorf("a token needs at least one scope")
+	}
+
+	scopes := []string{}
+	for _, scope := range apiTokenScopes {
+		if !requested[scope.Name] {
+			continue
+		}
+		if role < scope.Role {
+			return nil, fmt.Errorf("the %s scope needs the %s role", scope.Name, scope.Role)
+		}
+		scopes = append(scopes, scope.Name)
+		delete(requested, scope.Name)
+	}
+	for scope := range requested {
+		return nil, fmt.Errorf("unknown scope %q", scope)
+	}
+	return scopes, nil
+}
+
+// createAPIToken stores a new token for the user and returns it, this is the
+// only time the token itself is available
+func createAPIToken(db *sql.DB, user *User, name string, scopes []string, expires *time.Time, now time.Time) (string, *APIToken, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", nil, fmt.Errorf("a token needs a name")
+	}
+	if expires != nil && !expires.After(now) {
+		return "", nil, fmt.Errorf("expiry must be in the future")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("unable to generate api token: %w", err)
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	apiToken := &APIToken{
+		UserID:    user.ID,
+		Name:      strings.TrimSpace(name),
+		Scopes:    scopes,
+		CreatedAt: now.UTC(),
+	}
+	var expiresAt interface{}
+	if expires != nil {
+		e := expires.UTC()
+		apiToken.ExpiresAt = &e
+		expiresAt = e.Format(time.RFC3339)
+	}
+
+	res, err := db.Exec("INSERT INTO api_tokens(user_id, name, token_hash, scopes, created_at, expires_at) values(?,?,?,?,?,?)",
+		apiToken.UserID, apiToken.Name, hashToken(token), strings.Join(scopes, ","), apiToken.CreatedAt.Format(time.RFC3339), expiresAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to store api token: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to get api token ID: %w", err)
+	}
+	apiToken.ID = int(id)
+
+	return token, apiToken, nil
+}
+
+func parseOptionalTime(s sql.NullString) *time.Time {
+	if !s.Valid {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s.String)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// getAPITokens returns the user's tokens that haven't been revoked, expired
+// ones are included so it's clear why a script stopped working
+func getAPITokens(db *sql.DB, userID int) ([]*APIToken, error) {
+	rows, err := db.Query(`
+SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+FROM api_tokens WHERE user_id = ? AND revoked_at IS NULL ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query api tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []*APIToken{}
+	for rows.Next() {
+		token := &APIToken{}
+		var scopes, createdAt string
+		var expiresAt, lastUsedAt sql.NullString
+		if err := rows.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+			return nil, fmt.Errorf("unable to scan api token: %w", err)
+		}
+		token.Scopes = strings.Split(scopes, ",")
+		token.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		token.ExpiresAt = parseOptionalTime(expiresAt)
+		token.LastUsedAt = parseOptionalTime(lastUsedAt)
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func revokeAPIToken(db *sql.DB, userID, id int, now time.Time) error {
+	res, err := db.Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL", now.UTC().Format(time.RFC3339), id, userID)
+	if err != nil {
+		return fmt.Errorf("unable to revoke api token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such api token %d", id)
+	}
+	return nil
+}
+
+// getAPITokenUser returns the user a token belongs to along with the token,
+// or nils if it doesn't exist, has expired or has been revoked
+func getAPITokenUser(db *sql.DB, token string, now time.Time) (*User, *APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, nil, nil
+	}
+
+	apiToken := &APIToken{}
+	var scopes string
+	var expiresAt sql.NullString
+	user, err := scanUser(db.QueryRow(`
+SELECT `+userColumns+`, t.id, t.name, t.scopes, t.expires_at
+FROM api_tokens t JOIN users u ON u.id = t.user_id
+WHERE t.token_hash = ? AND t.revoked_at IS NULL`, hashToken(token)), &apiToken.ID, &apiToken.Name, &scopes, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get api token: %w", err)
+	}
+
+	apiToken.UserID = user.ID
+	apiToken.Scopes = strings.Split(scopes, ",")
+	apiToken.ExpiresAt = parseOptionalTime(expiresAt)
+	if expiresAt.Valid && (apiToken.ExpiresAt == nil || !now.Before(*apiToken.ExpiresAt)) {
+		return nil, nil, nil
+	}
+
+	if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now.UTC().Format(time.RFC3339), apiToken.ID); err != nil {
+		return nil, nil, fmt.Errorf("unable to record api token use: %w", err)
+	}
+
+	return user, apiToken, nil
+}
+
+// bearerToken returns the token from an `Authorization: Bearer` header
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+type tokensPage struct {
+	Tokens   []*APIToken
+	Scopes   []string
+	NewToken string
+	Error    string
+	Now      time.Time
+}
+
+// apiTokens lets a user manage their own tokens. It only works when logged
+// in with a password so a leaked token can't be used to mint more.
+func apiTokens(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestToken(r) != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "forbidden: api tokens can't be managed with an api token")
+			return
+		}
+
+		user := requestUser(r)
+		now := time.Now()
+		page := tokensPage{Now: now}
+		for _, scope := range apiTokenScopes {
+			if user.Role >= scope.Role {
+				page.Scopes = append(page.Scopes, scope.Name)
+			}
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error parsing form: %v", err)
+				return
+			}
+
+			switch r.PostFormValue("action") {
+			case "create":
+				token, err := createAPITokenFromForm(db, user, r, now)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					page.Error = err.Error()
+					break
+				}
+				page.NewToken = token
+				audit(db, r, auditTokenCreated, user.Username, r.PostFormValue("name"))
+			case "revoke":
+				id, err := strconv.Atoi(r.PostFormValue("id"))
+				if err == nil {
+					err = revokeAPIToken(db, user.ID, id, now)
+				}
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "error: %v", err)
+					return
+				}
+				audit(db, r, auditTokenRevoked, user.Username, fmt.Sprintf("token %d", id))
+				http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+				return
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: unknown action %q", r.PostFormValue("action"))
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		tokens, err := getAPITokens(db, user.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		page.Tokens = tokens
+
+		if err := renderTemplate(w, r, "tokens.html", page); err != nil {
+			fmt.Fprintf(w, "error rendering tokens: %v", err)
+			return
+		}
+	}
+}
+
+func createAPITokenFromForm(db *sql.DB, user *User, r *http.Request, now time.Time) (string, error) {
+	scopes, err := parseScopes(strings.Join(r.PostForm["scope"], ","), user.Role)
+	if err != nil {
+		return "", err
+	}
+
+	var expires *time.Time
+	if value := r.PostFormValue("expires"); value != "" {
+		day, err := time.ParseInLocation(planDateFormat, value, time.Local)
+		if err != nil {
+			return "", fmt.Errorf("expiry must be a date like 2023-06-01")
+		}
+		expires = &day
+	}
+
+	token, _, err := createAPIToken(db, user, r.PostFormValue("name"), scopes, expires, now)
+	return token, err
+}
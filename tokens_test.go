@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  string
+		role    Role
+		want    []string
+		wantErr bool
+	}{
+		{name: "single", scopes: "read", role: roleViewer, want: []string{"read"}},
+		{name: "ordered and deduplicated", scopes: "generate, read,read", role: roleEditor, want: []string{"read", "generate"}},
+		{name: "above role", scopes: "read,write", role: roleViewer, wantErr: true},
+		{name: "unknown", scopes: "delete", role: roleAdmin, wantErr: true},
+		{name: "empty", scopes: " , ", role: roleAdmin, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseScopes(tt.scopes, tt.role)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("expected %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_getAPITokenUser(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := addUser(db, "cron", "unused", roleViewer); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	user, _ := getUser(db, "cron")
+
+	expires := now.Add(24 * time.Hour)
+	token, created, err := createAPIToken(db, user, "nightly extract", []string{"read"}, &expires, now)
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		at    time.Time
+		want  bool
+	}{
+		{name: "valid", token: token, at: now.Add(time.Hour), want: true},
+		{name: "expired", token: token, at: expires, want: false},
+		{name: "wrong token", token: token + "x", at: now, want: false},
+		{name: "not a token", token: "hunter2", at: now, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, apiToken, err := getAPITokenUser(db, tt.token, tt.at)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (got != nil) != tt.want {
+				t.Fatalf("expected valid to be %v, got user %+v", tt.want, got)
+			}
+			if got != nil && (got.Username != "cron" || !apiToken.HasScope("read") || apiToken.HasScope("write")) {
+				t.Errorf("unexpected user %+v with token %+v", got, apiToken)
+			}
+		})
+	}
+
+	if err := revokeAPIToken(db, user.ID, created.ID, now); err != nil {
+		t.Fatalf("unable to revoke token: %v", err)
+	}
+	if got, _, _ := getAPITokenUser(db, token, now); got != nil {
+		t.Errorf("expected revoked token to be rejected")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Quantity is an amount in a canonical unit, mass is always in grams and
+// volume in millilitres so that amounts from different recipes can be added.
+// An empty unit means a count of whole items.
+type Quantity struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+type unitConversion struct {
+	unit   string
+	factor float64
+}
+
+// unitAliases maps every spelling we have seen in recipe text to a canonical
+// unit, anything missing from here is kept as its own unit (slice, clove...)
+var unitAliases = map[string]unitConversion{
+	"g":           {"g", 1},
+	"gram":        {"g", 1},
+	"grams":       {"g", 1},
+	"gr":          {"g", 1},
+	"kg":          {"g", 1000},
+	"kilogram":    {"g", 1000},
+	"kilograms":   {"g", 1000},
+	"oz":          {"g", 28.35},
+	"ounce":       {"g", 28.35},
+	"ounces":      {"g", 28.35},
+	"lb":          {"g", 453.6},
+	"lbs":         {"g", 453.6},
+	"pound":       {"g", 453.6},
+	"pounds":      {"g", 453.6},
+	"ml":          {"ml", 1},
+	"millilitre":  {"ml", 1},
+	"millilitres": {"ml", 1},
+	"milliliter":  {"ml", 1},
+	"milliliters": {"ml", 1},
+	"cl":          {"ml", 10},
+	"l":           {"ml", 1000},
+	"litre":       {"ml", 1000},
+	"litres":      {"ml", 1000},
+	"liter":       {"ml", 1000},
+	"liters":      {"ml", 1000},
+	"tsp":         {"ml", 5},
+	"teaspoon":    {"ml", 5},
+	"teaspoons":   {"ml", 5},
+	"tbsp":        {"ml", 15},
+	"tablespoon":  {"ml", 15},
+	"tablespoons": {"ml", 15},
+	"cup":         {"ml", 250},
+	"cups":        {"ml", 250},
+	"each":        {"", 1},
+	"whole":       {"", 1},
+	"piece":       {"", 1},
+	"pieces":      {"", 1},
+	"pc":          {"", 1},
+	"pcs":         {"", 1},
+	"x":           {"", 1},
+}
+
+// countUnits are units that aren't a measure but are still worth keeping
+// apart from a plain count, "2 cloves garlic" shouldn't become "2 garlic"
+var countUnits = map[string]string{
+	"slice": "slice", "slices": "slice",
+	"clove": "clove", "cloves": "clove",
+	"head": "head", "heads": "head",
+	"can": "can", "cans": "can", "tin": "can", "tins": "can",
+	"jar": "jar", "jars": "jar",
+	"bunch": "bunch", "bunches": "bunch",
+	"handful": "handful", "handfuls": "handful",
+	"pinch": "pinch", "pinches": "pinch",
+	"sprig": "sprig", "sprigs": "sprig",
+	"stalk": "stalk", "stalks": "stalk",
+	"stick": "stick", "sticks": "stick",
+	"sheet": "sheet", "sheets": "sheet",
+	"packet": "packet", "packets": "packet", "pack": "packet", "packs": "packet",
+	"fillet": "fillet", "fillets": "fillet",
+	"rasher": "rasher", "rashers": "rasher",
+	"bag": "bag", "bags": "bag",
+	"pot": "pot", "pots": "pot", "tub": "pot", "tubs": "pot",
+	"block": "block", "blocks": "block",
+	"ball": "ball", "balls": "ball",
+	"cube": "cube", "cubes": "cube",
+	"nest": "nest", "nests": "nest",
+	"sachet": "sachet", "sachets": "sachet",
+	"loaf": "loaf", "loaves": "loaf",
+}
+
+var (
+	leadingQuantity = regexp.MustCompile(`^\s*(\d+\s+\d+/\d+|\d+/\d+|\d+(?:[.,]\d+)?)\s*(\S.*)$`)
+	numberWithUnit  = regexp.MustCompile(`^\s*(\d+\s+\d+/\d+|\d+/\d+|\d+(?:[.,]\d+)?)\s*([a-zA-Z]*)\s*$`)
+	parenthetical   = regexp.MustCompile(`\([^)]*\)`)
+	extraSpaces     = regexp.MustCompile(`\s+`)
+)
+
+// preparationWords describe how an ingredient is prepared rather than what to
+// buy, they're dropped when working out which ingredients are the same
+var preparationWords = map[string]bool{
+	"chopped": true, "diced": true, "minced": true, "sliced": true, "grated": true,
+	"shaved": true, "crushed": true, "peeled": true, "finely": true, "roughly": true,
+	"thinly": true, "fresh": true, "freshly": true, "large": true, "small": true,
+	"medium": true, "ground": true, "cooked": true, "drained": true, "rinsed": true,
+	"softened": true, "melted": true, "beaten": true, "halved": true, "quartered": true,
+	"trimmed": true, "optional": true,
+}
+
+// parseAmount understands whole numbers, decimals, fractions and mixed
+// numbers such as "1 1/2"
+func parseAmount(s string) (float64, bool) {
+	s = strings.TrimSpace(strings.ReplaceAll(s, ",", "."))
+	if s == "" {
+		return 0, false
+	}
+
+	total := 0.0
+	for _, part := range strings.Fields(s) {
+		if num, den, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, false
+			}
+			d, err := strconv.ParseFloat(den, 64)
+			if err != nil || d == 0 {
+				return 0, false
+			}
+			total += n / d
+			continue
+		}
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+		total += v
+	}
+
+	return total, true
+}
+
+// normalizeUnit returns the canonical unit and the factor to multiply an
+// amount by to get there
+func normalizeUnit(unit string) (string, float64) {
+	u := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(unit)), ".")
+	if u == "" {
+		return "", 1
+	}
+	if c, ok := unitAliases[u]; ok {
+		return c.unit, c.factor
+	}
+	if c, ok := countUnits[u]; ok {
+		return c, 1
+	}
+	return u, 1
+}
+
+func isKnownUnit(unit string) bool {
+	u := strings.TrimSuffix(strings.ToLower(unit), ".")
+	_, alias := unitAliases[u]
+	_, count := countUnits[u]
+	return alias || count
+}
+
+// singular makes a best effort at turning the last word of an ingredient
+// name into its singular so "onions" and "onion" are treated the same
+func singular(word string) string {
+	switch {
+	case len(word) <= 3 || strings.HasSuffix(word, "ss") || strings.HasSuffix(word, "us"):
+		return word
+	case strings.HasSuffix(word, "ies"):
+		return strings.TrimSuffix(word, "ies") + "y"
+	case strings.HasSuffix(word, "oes"), strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"):
+		return strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "s"):
+		return strings.TrimSuffix(word, "s")
+	}
+	return word
+}
+
+// normalizeIngredientName reduces an ingredient key from RecipeContent down
+// to the thing you would buy, "Onions, finely diced" becomes "onion"
+func normalizeIngredientName(name string) string {
+	name = strings.ToLower(name)
+	if i := strings.Index(name, ","); i >= 0 {
+		name = name[:i]
+	}
+	name = parenthetical.ReplaceAllString(name, " ")
+
+	words := []string{}
+	for _, w := range strings.Fields(name) {
+		if preparationWords[w] {
+			continue
+		}
+		words = append(words, w)
+	}
+	if len(words) == 0 {
+		return strings.TrimSpace(extraSpaces.ReplaceAllString(name, " "))
+	}
+	words[len(words)-1] = singular(words[len(words)-1])
+
+	return strings.Join(words, " ")
+}
+
+// splitLeadingUnit pulls a unit off the front of the text that followed a
+// quantity, skipping size words so "small heads of lettuce" is a head
+func splitLeadingUnit(text string) (string, string) {
+	words := strings.Fields(text)
+	for i, w := range words {
+		if preparationWords[strings.ToLower(w)] {
+			continue
+		}
+		if !isKnownUnit(w) {
+			break
+		}
+		rest := words[i+1:]
+		if len(rest) > 0 && strings.EqualFold(rest[0], "of") {
+			rest = rest[1:]
+		}
+		if len(rest) == 0 {
+			break
+		}
+		return w, strings.Join(rest, " ")
+	}
+	return "", text
+}
+
+// parseIngredientQuantity works out the canonical name and quantity for an
+// entry in RecipeContent.Ingredients. Older generations didn't always follow
+// the "amount unit : name" format so the amount can be glued to its unit
+// ("60ml") or missing entirely with the quantity left in the name ("1 lemon").
+func parseIngredientQuantity(name string, amount *IngredientAmount) (string, Quantity, bool) {
+	var amountText, unitText string
+	if amount != nil {
+		amountText, unitText = amount.Amount, amount.Unit
+	}
+
+	if strings.TrimSpace(amountText) == "" {
+		if m := leadingQuantity.FindStringSubmatch(name); m != nil {
+			amountText = m[1]
+			unitText, name = splitLeadingUnit(m[2])
+		}
+	} else if unitText == "" {
+		if m := numberWithUnit.FindStringSubmatch(amountText); m != nil {
+			amountText, unitText = m[1], m[2]
+		}
+	}
+
+	normalized := normalizeIngredientName(name)
+
+	value, ok := parseAmount(amountText)
+	if !ok {
+		return normalized, Quantity{}, false
+	}
+
+	unit, factor := normalizeUnit(unitText)
+	return normalized, Quantity{Value: value * factor, Unit: unit}, true
+}
+
+// formatQuantity turns a canonical quantity back into something readable,
+// large masses and volumes move up to kg and l
+func formatQuantity(q Quantity) string {
+	value, unit := q.Value, q.Unit
+	switch {
+	case unit == "g" && value >= 1000:
+		value, unit = value/1000, "kg"
+	case unit == "ml" && value >= 1000:
+		value, unit = value/1000, "l"
+	}
+
+	var number string
+	switch {
+	case unit == "":
+		number = strconv.FormatFloat(math.Ceil(value), 'f', -1, 64)
+	case value >= 10 && unit != "kg" && unit != "l":
+		number = strconv.FormatFloat(math.Round(value), 'f', -1, 64)
+	default:
+		number = strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+	}
+
+	if unit == "" {
+		return number
+	}
+	return number + " " + unit
+}
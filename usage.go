@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What the LLM was used for
+const (
+	usageTaskRecipe    = "recipe"
+	usageTaskTags      = "tags"
+	usageTaskAllergens = "allergens"
+)
+
+// ModelPrice is what a model costs in US dollars per million tokens
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+// defaultModelPrices are OpenAI's list prices, LLM_PRICES overrides or adds
+// to them
+var defaultModelPrices = map[string]ModelPrice{
+	"gpt-3.5-turbo": {Prompt: 0.5, Completion: 1.5},
+	"gpt-4":         {Prompt: 30, Completion: 60},
+	"gpt-4-turbo":   {Prompt: 10, Completion: 30},
+	"gpt-4o":        {Prompt: 2.5, Completion: 10},
+	"gpt-4o-mini":   {Prompt: 0.15, Completion: 0.6},
+}
+
+// modelPrices is the price table costs are worked out with, set from
+// LLM_PRICES in main
+var modelPrices = defaultModelPrices
+
+// parseModelPrices reads LLM_PRICES, a comma separated list of
+// model=prompt:completion in dollars per million tokens. A model called *
+// prices anything not in the table.
+func parseModelPrices(s string) (map[string]ModelPrice, error) {
+	prices := map[string]ModelPrice{}
+	for model, price := range defaultModelPrices {
+		prices[model] = price
+	}
+	for _, entry := range splitList(s) {
+		model, value, ok := strings.Cut(entry, "=")
+		promptValue, completionValue, ok2 := strings.Cut(value, ":")
+		if !ok || !ok2 || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("price %q should look like model=prompt:completion", entry)
+		}
+		prompt, err := strconv.ParseFloat(strings.TrimSpace(promptValue), 64)
+		if err != nil || prompt < 0 {
+			return nil, fmt.Errorf("price %q has an invalid prompt price", entry)
+		}
+		completion, err := strconv.ParseFloat(strings.TrimSpace(completionValue), 64)
+		if err != nil || completion < 0 {
+			return nil, fmt.Errorf("price %q has an invalid completion price", entry)
+		}
+		prices[strings.TrimSpace(model)] = ModelPrice{Prompt: prompt, Completion: completion}
+	}
+	return prices, nil
+}
+
+// priceFor finds a model's price. The API answers with dated model names
+// like gpt-3.5-turbo-0613 so the longest matching prefix wins.
+func priceFor(prices map[string]ModelPrice, model string) (ModelPrice, bool) {
+	best := ""
+	for name := range prices {
+		if (model == name || strings.HasPrefix(model, name+"-")) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best != "" {
+		return prices[best], true
+	}
+	price, ok := prices["*"]
+	return price, ok
+}
+
+// Costs are kept in millionths of a dollar so they add up exactly
+type Micros int64
+
+func (m Micros) String() string {
+	return fmt.Sprintf("$%.2f", float64(m)/1e6)
+}
+
+func (u *LLMUsage) Cost(prices map[string]ModelPrice) Micros {
+	price, ok := priceFor(prices, u.Model)
+	if !ok {
+		fmt.Printf("no price for model %s, it's recorded as free, add it to LLM_PRICES\n", u.Model)
+		return 0
+	}
+	// dollars per million tokens is micros per token
+	return Micros(math.Round(float64(u.PromptTokens)*price.Prompt + float64(u.CompletionTokens)*price.Completion))
+}
+
+// recordUsage stores a call against the user and their household, recipeID
+// is zero when there's no recipe to put it against
+func recordUsage(db *sql.DB, user *User, recipeID int, usage *LLMUsage, now time.Time) error {
+	if usage == nil {
+		return nil
+	}
+	if _, err := db.Exec(`
+INSERT INTO llm_usage(created_at, user_id, household_id, recipe_id, task, model, prompt_tokens, completion_tokens, cost_micros)
+values(?,?,?,?,?,?,?,?,?)`,
+		now.UTC().Format(time.RFC3339), user.ID, user.HouseholdID, recipeID, usage.Task, usage.Model,
+		usage.PromptTokens, usage.CompletionTokens, int64(usage.Cost(modelPrices))); err != nil {
+		return fmt.Errorf("unable to record llm usage: %w", err)
+	}
+	return nil
+}
+
+func monthStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+}
+
+// Budgets are set for a user or for a whole household
+const (
+	budgetUser      = "user"
+	budgetHousehold = "household"
+)
+
+// getBudget returns the monthly limit, ok is false when there isn't one
+func getBudget(db *sql.DB, scope string, id int) (Micros, bool, error) {
+	var limit int64
+	err := db.QueryRow("SELECT monthly_limit_micros FROM llm_budgets WHERE scope = ? AND subject_id = ?", scope, id).Scan(&limit)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to get budget: %w", err)
+	}
+	return Micros(limit), true, nil
+}
+
+// setBudget sets a monthly limit, a negative limit removes it
+func setBudget(db *sql.DB, scope string, id int, limit Micros) error {
+	var err error
+	if limit < 0 {
+		_, err = db.Exec("DELETE FROM llm_budgets WHERE scope = ? AND subject_id = ?", scope, id)
+	} else {
+		_, err = db.Exec(`
+INSERT INTO llm_budgets(scope, subject_id, monthly_limit_micros) values(?,?,?)
+ON CONFLICT(scope, subject_id) DO UPDATE SET monthly_limit_micros = excluded.monthly_limit_micros`, scope, id, int64(limit))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to set budget: %w", err)
+	}
+	return nil
+}
+
+// monthSpend adds up what a user or household has spent since the start of
+// the month
+func monthSpend(db *sql.DB, scope string, id int, now time.Time) (Micros, error) {
+	column := "user_id"
+	if scope == budgetHousehold {
+		column = "household_id"
+	}
+	var spent int64
+	if err := db.QueryRow("SELECT COALESCE(SUM(cost_micros), 0) FROM llm_usage WHERE "+column+" = ? AND created_at >= ?",
+		id, monthStart(now).UTC().Format(time.RFC3339)).Scan(&spent); err != nil {
+		return 0, fmt.Errorf("unable to add up llm usage: %w", err)
+	}
+	return Micros(spent), nil
+}
+
+var errBudgetExceeded = errors.New("monthly generation budget used up")
+
+// checkBudget returns an error wrapping errBudgetExceeded, with who ran out
+// and when it resets, once the user's or their household's spend this month
+// has reached its budget
+func checkBudget(db *sql.DB, user *User, now time.Time) error {
+	checks := []struct {
+		scope, name string
+		id          int
+	}{
+		{budgetUser, "your", user.ID},
+		{budgetHousehold, "your household's", user.HouseholdID},
+	}
+	for _, check := range checks {
+		limit, ok, err := getBudget(db, check.scope, check.id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		spent, err := monthSpend(db, check.scope, check.id, now)
+		if err != nil {
+			return err
+		}
+		if spent >= limit {
+			resets := monthStart(now).AddDate(0, 1, 0)
+			return fmt.Errorf("%w: %s %s budget has %s spent this month, generation is blocked until %s",
+				errBudgetExceeded, check.name, limit, spent, resets.Format("2 January"))
+		}
+	}
+	return nil
+}
+
+// budgetExceeded writes the response for a generation checkBudget refused,
+// it returns false when err is something else
+func budgetExceeded(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errBudgetExceeded) {
+		return false
+	}
+	w.WriteHeader(http.StatusPaymentRequired)
+	fmt.Fprintf(w, "error: %v", err)
+	return true
+}
+
+type SpendRow struct {
+	Name             string
+	Calls            int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             Micros
+}
+
+// spendBy groups usage since from, name is the SQL each group is named by
+func spendBy(db *sql.DB, from time.Time, name string) ([]*SpendRow, error) {
+	rows, err := db.Query(`
+SELECT `+name+` AS name, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens), SUM(cost_micros)
+FROM llm_usage l
+WHERE l.created_at >= ?
+GROUP BY name
+ORDER BY SUM(cost_micros) DESC`, from.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("unable to query llm usage: %w", err)
+	}
+	defer rows.Close()
+
+	spend := []*SpendRow{}
+	for rows.Next() {
+		row := &SpendRow{}
+		var cost int64
+		if err := rows.Scan(&row.Name, &row.Calls, &row.PromptTokens, &row.CompletionTokens, &cost); err != nil {
+			return nil, fmt.Errorf("unable to scan llm usage: %w", err)
+		}
+		row.Cost = Micros(cost)
+		spend = append(spend, row)
+	}
+	return spend, rows.Err()
+}
+
+// BudgetRow is a user or household's spend this month against its budget
+type BudgetRow struct {
+	Scope    string
+	ID       int
+	Name     string
+	Spent    Micros
+	Limit    Micros
+	HasLimit bool
+}
+
+func (b *BudgetRow) Over() bool {
+	return b.HasLimit && b.Spent >= b.Limit
+}
+
+func getBudgetRows(db *sql.DB, now time.Time) ([]*BudgetRow, error) {
+	users, err := getUsers(db)
+	if err != nil {
+		return nil, err
+	}
+	households, err := getHouseholds(db)
+	if err != nil {
+		return nil, err
+	}
+
+	budgets := []*BudgetRow{}
+	for _, h := range households {
+		budgets = append(budgets, &BudgetRow{Scope: budgetHousehold, ID: h.ID, Name: h.Name})
+	}
+	for _, u := range users {
+		budgets = append(budgets, &BudgetRow{Scope: budgetUser, ID: u.ID, Name: u.Username})
+	}
+	for _, b := range budgets {
+		if b.Limit, b.HasLimit, err = getBudget(db, b.Scope, b.ID); err != nil {
+			return nil, err
+		}
+		if b.Spent, err = monthSpend(db, b.Scope, b.ID, now); err != nil {
+			return nil, err
+		}
+	}
+	return budgets, nil
+}
+
+type spendPage struct {
+	Month   time.Time
+	Months  []*SpendRow
+	Recipes []*SpendRow
+	Models  []*SpendRow
+	Budgets []*BudgetRow
+	Cache   CacheStats
+	Prices  []string
+}
+
+// adminSpend shows what generation has cost and sets budgets
+func adminSpend(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error parsing form: %v", err)
+				return
+			}
+
+			scope := r.PostFormValue("scope")
+			id, err := strconv.Atoi(r.PostFormValue("id"))
+			if err != nil || (scope != budgetUser && scope != budgetHousehold) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error: a budget needs a scope of user or household and an id")
+				return
+			}
+			limit := Micros(-1)
+			value := strings.TrimPrefix(strings.TrimSpace(r.PostFormValue("limit")), "$")
+			if value != "" {
+				dollars, err := strconv.ParseFloat(value, 64)
+				if err != nil || dollars < 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "error: the budget must be an amount in dollars, or blank for none")
+					return
+				}
+				limit = Micros(math.Round(dollars * 1e6))
+			}
+			if err := setBudget(db, scope, id, limit); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+			if value == "" {
+				value = "none"
+			}
+			audit(db, r, auditBudgetChanged, "", fmt.Sprintf("%s %d budget set to %s", scope, id, value))
+			http.Redirect(w, r, "/admin/spend", http.StatusSeeOther)
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "error: method not allowed")
+			return
+		}
+
+		now := time.Now()
+		page := spendPage{Month: monthStart(now)}
+		var err error
+		queries := []struct {
+			into *[]*SpendRow
+			from time.Time
+			name string
+		}{
+			// created_at is UTC so months are too
+			{&page.Months, page.Month.AddDate(-1, 0, 0), "substr(l.created_at, 1, 7)"},
+			{&page.Recipes, page.Month, "CASE WHEN l.recipe_id = 0 THEN '(no recipe)' ELSE COALESCE((SELECT name FROM recipes WHERE id = l.recipe_id), '(removed)') END"},
+			{&page.Models, page.Month, "l.model"},
+		}
+		for _, q := range queries {
+			if *q.into, err = spendBy(db, q.from, q.name); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error: %v", err)
+				return
+			}
+		}
+		// months read better oldest first
+		sort.Slice(page.Months, func(i, j int) bool { return page.Months[i].Name < page.Months[j].Name })
+
+		if page.Budgets, err = getBudgetRows(db, now); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if page.Cache, err = getCacheStats(db, page.Month); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		for model, price := range modelPrices {
+			page.Prices = append(page.Prices, fmt.Sprintf("%s $%g / $%g", model, price.Prompt, price.Completion))
+		}
+		sort.Strings(page.Prices)
+
+		if err := renderTemplate(w, r, "spend.html", page); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error rendering spend: %v", err)
+			return
+		}
+	}
+}
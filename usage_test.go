@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_parseModelPrices(t *testing.T) {
+	prices, err := parseModelPrices("gpt-4o=5:15, local=0:0,*=1:2")
+	if err != nil {
+		t.Fatalf("parseModelPrices() error = %v", err)
+	}
+
+	tests := []struct {
+		model string
+		want  ModelPrice
+	}{
+		{"gpt-4o", ModelPrice{5, 15}},
+		{"gpt-4o-2024-05-13", ModelPrice{5, 15}},
+		{"gpt-4o-mini-2024-07-18", defaultModelPrices["gpt-4o-mini"]},
+		{"gpt-3.5-turbo-0613", defaultModelPrices["gpt-3.5-turbo"]},
+		{"local", ModelPrice{0, 0}},
+		{"something-else", ModelPrice{1, 2}},
+	}
+	for _, tt := range tests {
+		if got, _ := priceFor(prices, tt.model); got != tt.want {
+			t.Errorf("priceFor(%q) = %v, want %v", tt.model, got, tt.want)
+		}
+	}
+
+	if _, ok := priceFor(defaultModelPrices, "something-else"); ok {
+		t.Errorf("expected no price for an unknown model without a * price")
+	}
+
+	for _, bad := range []string{"gpt-4o", "gpt-4o=1", "gpt-4o=a:1", "=1:1", "gpt-4o=-1:1"} {
+		if _, err := parseModelPrices(bad); err == nil {
+			t.Errorf("parseModelPrices(%q) expected an error", bad)
+		}
+	}
+}
+
+func Test_LLMUsage_Cost(t *testing.T) {
+	usage := &LLMUsage{Model: "gpt-3.5-turbo-0613", PromptTokens: 1000, CompletionTokens: 500}
+	// 1000 * $0.5/M + 500 * $1.5/M
+	if got := usage.Cost(defaultModelPrices); got != 1250 {
+		t.Errorf("Cost() = %d, want 1250", got)
+	}
+	if got := Micros(1250000).String(); got != "$1.25" {
+		t.Errorf("String() = %s, want $1.25", got)
+	}
+}
+
+func Test_checkBudget(t *testing.T) {
+	db := newTestDB(t)
+	if err := addUser(db, "alice", "password1", roleEditor); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	if err := addUser(db, "bob", "password1", roleEditor); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	alice, _ := getUser(db, "alice")
+	bob, _ := getUser(db, "bob")
+
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	spend := func(user *User, at time.Time, promptTokens int) {
+		// $1 per million prompt tokens
+		usage := &LLMUsage{Task: usageTaskRecipe, Model: "gpt-4o", PromptTokens: promptTokens}
+		modelPrices = map[string]ModelPrice{"gpt-4o": {Prompt: 1}}
+		defer func() { modelPrices = defaultModelPrices }()
+		if err := recordUsage(db, user, 1, usage, at); err != nil {
+			t.Fatalf("unable to record usage: %v", err)
+		}
+	}
+
+	if err := checkBudget(db, alice, now); err != nil {
+		t.Errorf("expected no budget to mean no limit, got %v", err)
+	}
+
+	if err := setBudget(db, budgetUser, alice.ID, 2000000); err != nil {
+		t.Fatalf("unable to set budget: %v", err)
+	}
+	spend(alice, now.AddDate(0, -1, 0), 5000000)
+	spend(alice, now, 1000000)
+	if err := checkBudget(db, alice, now); err != nil {
+		t.Errorf("expected last month's spend not to count, got %v", err)
+	}
+	spend(alice, now, 1000000)
+	if err := checkBudget(db, alice, now); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("expected alice to be over budget, got %v", err)
+	}
+	if err := checkBudget(db, alice, now.AddDate(0, 1, 0)); err != nil {
+		t.Errorf("expected the budget to reset next month, got %v", err)
+	}
+
+	// alice's spend counts against the household bob is in too
+	if err := checkBudget(db, bob, now); err != nil {
+		t.Errorf("expected bob to have no limit, got %v", err)
+	}
+	if err := setBudget(db, budgetHousehold, defaultHouseholdID, 1000000); err != nil {
+		t.Fatalf("unable to set budget: %v", err)
+	}
+	if err := checkBudget(db, bob, now); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("expected bob's household to be over budget, got %v", err)
+	}
+
+	if err := setBudget(db, budgetHousehold, defaultHouseholdID, -1); err != nil {
+		t.Fatalf("unable to remove budget: %v", err)
+	}
+	if err := checkBudget(db, bob, now); err != nil {
+		t.Errorf("expected removing the budget to unblock bob, got %v", err)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const userPasswordEnvPrefix = "USER_"
+
+// dummyPasswordHash is compared against when a username doesn't exist so an
+// unknown user takes as long to reject as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("food-archive-dummy-password"), bcrypt.DefaultCost)
+
+type User struct {
+	ID           int
+	Username     string
+	PasswordHash string
+	Role         Role
+	HouseholdID  int
+}
+
+// userColumns is selected wherever a User is loaded so scanUser can read it
+const userColumns = "u.id, u.username, u.password_hash, u.role, u.household_id"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner, extra ...interface{}) (*User, error) {
+	user := &User{}
+	var role string
+	if err := row.Scan(append([]interface{}{&user.ID, &user.Username, &user.PasswordHash, &role, &user.HouseholdID}, extra...)...); err != nil {
+		return nil, err
+	}
+	user.Role, _ = parseRole(role)
+	return user, nil
+}
+
+func getUser(db *sql.DB, username string) (*User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users u WHERE u.username = ?", username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get user: %w", err)
+	}
+	return user, nil
+}
+
+// getUserByID returns the user or nil if they've been removed
+func getUserByID(db *sql.DB, id int) (*User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users u WHERE u.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get user: %w", err)
+	}
+	return user, nil
+}
+
+func getUsers(db *sql.DB) ([]*User, error) {
+	rows, err := db.Query("SELECT " + userColumns + " FROM users u ORDER BY u.username")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("unable to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+func validUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("username must not be empty")
+	}
+	if strings.ContainsAny(username, ": \t\r\n") {
+		return fmt.Errorf("username must not contain spaces or colons")
+	}
+	return nil
+}
+
+// insertUserHash stores a user with an already hashed password, used by the
+// htpasswd import so we never see the plain text
+func insertUserHash(db *sql.DB, username, hash string, role Role) error {
+	if err := validUsername(username); err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO users(username, password_hash, role) values(?,?,?)", username, hash, role.String()); err != nil {
+		return fmt.Errorf("unable to insert user %s: %w", username, err)
+	}
+	return nil
+}
+
+func addUser(db *sql.DB, username, password string, role Role) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return insertUserHash(db, username, hash, role)
+}
+
+func setUserRole(db *sql.DB, username string, role Role) error {
+	res, err := db.Exec("UPDATE users SET role = ? WHERE username = ?", role.String(), username)
+	if err != nil {
+		return fmt.Errorf("unable to update role for %s: %w", username, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user %s", username)
+	}
+	return nil
+}
+
+func setUserPasswordHash(db *sql.DB, username, hash string) error {
+	res, err := db.Exec("UPDATE users SET password_hash = ? WHERE username = ?", hash, username)
+	if err != nil {
+		return fmt.Errorf("unable to update password for %s: %w", username, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user %s", username)
+	}
+	return nil
+}
+
+// setUserPassword changes a password and logs the user out everywhere
+func setUserPassword(db *sql.DB, username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := setUserPasswordHash(db, username, hash); err != nil {
+		return err
+	}
+	return revokeUserSessions(db, username, time.Now())
+}
+
+// removeUser deletes a user along with everything that logs in as them,
+// all or nothing so a failure can't leave a token behind for the username
+func removeUser(db *sql.DB, username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning db transaction for user removal: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id IN (SELECT id FROM users WHERE username = ?)", username); err != nil {
+		return fmt.Errorf("unable to remove sessions for %s: %w", username, err)
+	}
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE user_id IN (SELECT id FROM users WHERE username = ?)", username); err != nil {
+		return fmt.Errorf("unable to remove api tokens for %s: %w", username, err)
+	}
+	if _, err := tx.Exec("DELETE FROM calendar_tokens WHERE username = ?", username); err != nil {
+		return fmt.Errorf("unable to remove calendar token for %s: %w", username, err)
+	}
+	res, err := tx.Exec("DELETE FROM users WHERE username = ?", username)
+	if err != nil {
+		return fmt.Errorf("unable to remove user %s: %w", username, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user %s", username)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit user removal: %w", err)
+	}
+	return nil
+}
+
+// authenticateUser checks a username and password against the users table.
+// Hashes imported from htpasswd in older formats are upgraded to bcrypt the
+// first time they're used successfully.
+func authenticateUser(db *sql.DB, username, password string) (*User, error) {
+	user, err := getUser(db, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || password == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+
+	ok, legacy := verifyPasswordHash(user.PasswordHash, password)
+	if !ok {
+		return nil, nil
+	}
+
+	if legacy {
+		if hash, err := hashPassword(password); err == nil {
+			if err := setUserPasswordHash(db, username, hash); err != nil {
+				fmt.Printf("unable to upgrade password hash for %s: %v\n", username, err)
+			}
+		}
+	}
+
+	return user, nil
+}
+
+// verifyPasswordHash understands bcrypt plus the apr1 and sha1 formats that
+// htpasswd can produce, legacy is true when the hash should be replaced
+func verifyPasswordHash(hash, password string) (ok bool, legacy bool) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, false
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash, "$", 4)
+		if len(parts) != 4 {
+			return false, true
+		}
+		return subtle.ConstantTimeCompare([]byte(apr1Crypt(password, parts[2])), []byte(hash)) == 1, true
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1, true
+	}
+	return false, false
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Crypt is Apache's variant of md5-crypt, the default for `htpasswd -n`.
+// It's only here so existing htpasswd files can be imported.
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	encoded := []byte{}
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			encoded = append(encoded, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+
+	return magic + salt + "$" + string(encoded)
+}
+
+// importHtpasswd reads "username:hash" lines as written by htpasswd, existing
+// users get their hash replaced. It returns the number of users imported.
+func importHtpasswd(db *sql.DB, r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	imported := 0
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || hash == "" {
+			return imported, fmt.Errorf("line %d is not in username:hash format", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return imported, fmt.Errorf("line %d for %s uses an unsupported hash, use htpasswd -B or -m", line, username)
+		}
+
+		existing, err := getUser(db, username)
+		if err != nil {
+			return imported, err
+		}
+		if existing != nil {
+			err = setUserPasswordHash(db, username, hash)
+		} else {
+			err = insertUserHash(db, username, hash, roleViewer)
+		}
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+
+	return imported, scanner.Err()
+}
+
+// importEnvUsers moves USER_<name>_PASSWORD variables into the users table
+// when it's empty so an existing deployment keeps working after upgrading
+func importEnvUsers(db *sql.DB, environ []string) error {
+	users, err := getUsers(db)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return nil
+	}
+
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, userPasswordEnvPrefix) || !strings.HasSuffix(key, "_PASSWORD") || value == "" {
+			continue
+		}
+		username := strings.TrimSuffix(strings.TrimPrefix(key, userPasswordEnvPrefix), "_PASSWORD")
+		if err := addUser(db, username, value, roleAdmin); err != nil {
+			return err
+		}
+		fmt.Printf("imported %s from %s, remove the variable and manage users with `user` from now on\n", username, key)
+	}
+
+	return nil
+}
+
+// readPassword reads a password without echoing it when in is a terminal,
+// anything else like a pipe is read a line at a time
+func readPassword(in io.Reader, out io.Writer) (string, error) {
+	fmt.Fprint(out, "password: ")
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(out)
+		if err != nil {
+			return "", fmt.Errorf("unable to read password: %w", err)
+		}
+		return string(password), nil
+	}
+
+	scanner := bufio.NewScanner(in)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("no password provided")
+	}
+	fmt.Fprintln(out)
+	return strings.TrimRight(scanner.Text(), "\r\n"), nil
+}
+
+const userUsage = `usage:
+  user add <username> [role] create a user, the password is read from stdin
+                             role is viewer (the default), editor or admin
+  user role <username> <role> change what a user is allowed to do
+  user passwd <username>     change a user's password, read from stdin
+  user remove <username>     delete a user
+  user logout <username>     end every login session for a user
+  user link <username> <subject>
+                             let a single sign on subject log in as an
+                             existing user
+  user token <username> <name> [scopes] [days]
+                             create an api token for scripts, scopes are
+                             comma separated from read (the default), write,
+                             generate and admin, it never expires without days
+  user list                  list every user
+  user import <htpasswd>     import users from a htpasswd file`
+
+// runUserCommand handles `food-archive user ...` so users can be managed
+// without redeploying
+func runUserCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		users, err := getUsers(db)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			fmt.Printf("%s\t%s\n", u.Username, u.Role)
+		}
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		role := roleViewer
+		if len(args) == 3 {
+			var err error
+			if role, err = parseRole(args[2]); err != nil {
+				return err
+			}
+		}
+		password, err := readPassword(os.Stdin, os.Stderr)
+		if err != nil {
+			return err
+		}
+		if err := addUser(db, args[1], password, role); err != nil {
+			return err
+		}
+		auditCommand(db, auditUserAdded, args[1], "added as "+role.String())
+		fmt.Printf("added %s as %s\n", args[1], role)
+	case args[0] == "role" && len(args) == 3:
+		role, err := parseRole(args[2])
+		if err != nil {
+			return err
+		}
+		if err := setUserRole(db, args[1], role); err != nil {
+			return err
+		}
+		auditCommand(db, auditRoleChanged, args[1], fmt.Sprintf("%s is now %s", args[1], role))
+		fmt.Printf("%s is now %s\n", args[1], role)
+	case args[0] == "passwd" && len(args) == 2:
+		password, err := readPassword(os.Stdin, os.Stderr)
+		if err != nil {
+			return err
+		}
+		if err := setUserPassword(db, args[1], password); err != nil {
+			return err
+		}
+		auditCommand(db, auditPasswordChanged, args[1], "")
+		fmt.Printf("updated password for %s\n", args[1])
+	case args[0] == "remove" && len(args) == 2:
+		if err := removeUser(db, args[1]); err != nil {
+			return err
+		}
+		auditCommand(db, auditUserRemoved, args[1], "removed "+args[1])
+		fmt.Printf("removed %s\n", args[1])
+	case args[0] == "logout" && len(args) == 2:
+		if err := revokeUserSessions(db, args[1], time.Now()); err != nil {
+			return err
+		}
+		auditCommand(db, auditSessionsPurged, args[1], "logged out everywhere")
+		fmt.Printf("logged out %s everywhere\n", args[1])
+	case args[0] == "link" && len(args) == 3:
+		if err := linkOIDCSubject(db, args[1], args[2]); err != nil {
+			return err
+		}
+		auditCommand(db, auditUserLinked, args[1], "linked to single sign on subject "+args[2])
+		fmt.Printf("%s now logs in with single sign on subject %s\n", args[1], args[2])
+	case args[0] == "token" && len(args) >= 3 && len(args) <= 5:
+		user, err := getUser(db, args[1])
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("no such user %s", args[1])
+		}
+		scopeList := "read"
+		if len(args) >= 4 {
+			scopeList = args[3]
+		}
+		scopes, err := parseScopes(scopeList, user.Role)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		var expires *time.Time
+		if len(args) == 5 {
+			days, err := strconv.Atoi(args[4])
+			if err != nil || days <= 0 {
+				return fmt.Errorf("days must be a positive number")
+			}
+			e := now.AddDate(0, 0, days)
+			expires = &e
+		}
+		token, _, err := createAPIToken(db, user, args[2], scopes, expires, now)
+		if err != nil {
+			return err
+		}
+		auditCommand(db, auditTokenCreated, user.Username, args[2])
+		fmt.Println(token)
+	case args[0] == "import" && len(args) == 2:
+		f, err := os.Open(args[1])
+		if err != nil {
+			return fmt.Errorf("unable to open htpasswd file: %w", err)
+		}
+		defer f.Close()
+		n, err := importHtpasswd(db, f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("imported %d users\n", n)
+	default:
+		return errors.New(userUsage)
+	}
+
+	return nil
+}
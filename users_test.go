@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// newTestDB returns an empty in-memory database with every table created,
+// a single connection is used because each sqlite memory connection is its
+// own database
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unable to open test db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(`CREATE TABLE recipes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    parent_id INTEGER,
+    version INTEGER,
+    name TEXT,
+    reference TEXT,
+    recipe_data TEXT
+);`); err != nil {
+		t.Fatalf("unable to create recipes table: %v", err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatalf("unable to migrate test db: %v", err)
+	}
+
+	return db
+}
+
+func Test_authenticateUser(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := addUser(db, "alice", "correct horse", roleEditor); err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	if err := addUser(db, "bob", "", roleViewer); err == nil {
+		t.Errorf("expected an empty password to be rejected")
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     bool
+	}{
+		{name: "correct password", username: "alice", password: "correct horse", want: true},
+		{name: "wrong password", username: "alice", password: "battery staple", want: false},
+		{name: "empty password", username: "alice", password: "", want: false},
+		{name: "unknown user with empty password", username: "mallory", password: "", want: false},
+		{name: "unknown user", username: "mallory", password: "correct horse", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := authenticateUser(db, tt.username, tt.password)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (user != nil) != tt.want {
+				t.Errorf("expected authenticated to be %v, got user %+v", tt.want, user)
+			}
+		})
+	}
+
+	token, err := getCalendarToken(db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeUser(db, "alice"); err != nil {
+		t.Fatalf("unable to remove user: %v", err)
+	}
+	if user, _ := authenticateUser(db, "alice", "correct horse"); user != nil {
+		t.Errorf("expected removed user to be denied")
+	}
+	// someone added later with the same name mustn't get the old calendar link
+	if err := addUser(db, "alice", "another", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := getCalendarToken(db, "alice"); again == token {
+		t.Errorf("expected the calendar token to be removed with the user")
+	}
+}
+
+func Test_importHtpasswd(t *testing.T) {
+	db := newTestDB(t)
+
+	// generated with `openssl passwd -apr1 -salt r31.... password`
+	htpasswd := `# kitchen users
+carol:$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1
+dave:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`
+	n, err := importHtpasswd(db, strings.NewReader(htpasswd))
+	if err != nil {
+		t.Fatalf("unable to import htpasswd: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 users imported, got %d", n)
+	}
+
+	for _, username := range []string{"carol", "dave"} {
+		user, err := authenticateUser(db, username, "password")
+		if err != nil || user == nil {
+			t.Fatalf("expected %s to authenticate, got %v", username, err)
+		}
+
+		upgraded, _ := getUser(db, username)
+		if !strings.HasPrefix(upgraded.PasswordHash, "$2") {
+			t.Errorf("expected %s to be upgraded to bcrypt, got %s", username, upgraded.PasswordHash)
+		}
+	}
+
+	if _, err := importHtpasswd(db, strings.NewReader("erin:plaintext\n")); err == nil {
+		t.Errorf("expected plain text passwords to be rejected")
+	}
+}
+
+func Test_readPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"piped", "hunter2\n", "hunter2", false},
+		{"windows line ending", "hunter2\r\n", "hunter2", false},
+		{"only the first line", "hunter2\nsomething else\n", "hunter2", false},
+		{"no newline", "hunter2", "hunter2", false},
+		{"nothing", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			got, err := readPassword(strings.NewReader(tt.in), &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readPassword() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readPassword() = %q, want %q", got, tt.want)
+			}
+			if strings.Contains(out.String(), "hunter2") {
+				t.Errorf("expected the password not to be written out, got %q", out.String())
+			}
+		})
+	}
+}